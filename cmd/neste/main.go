@@ -0,0 +1,104 @@
+/*
+	The neste command renders a template with neste, for smoke testing 
+	templates and one-off generation.
+
+	Usage:
+
+		neste [flags] template
+
+	All files in the template directory are added to a template manager, 
+	and the named template is rendered with the data of a JSON file, or 
+	with nil data if there is none. The output is written to a file, or to 
+	the standard output. With -validate, the templates are only parsed.
+
+	The flags are:
+
+		-dir="."
+			template directory
+		-data=""
+			JSON data file
+		-o=""
+			output file, standard output if none
+		-ldelim="{", -rdelim="}"
+			template delimiters
+		-validate=false
+			only parse the templates
+
+	The exit status is 1 if any template fails to parse or execute, 
+	and 2 for invalid arguments.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/fzzbt/neste"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs the command with the given arguments, writing the output to 
+// stdout and errors to stderr, and returns the exit status.
+func run(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("neste", flag.ContinueOnError)
+	dir := fs.String("dir", ".", "template directory")
+	data := fs.String("data", "", "JSON data file")
+	out := fs.String("o", "", "output file, standard output if none")
+	ldelim := fs.String("ldelim", "{", "left template delimiter")
+	rdelim := fs.String("rdelim", "}", "right template delimiter")
+	validate := fs.Bool("validate", false, "only parse the templates")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: neste [flags] template")
+		fs.PrintDefaults()
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if *validate && fs.NArg() != 0 || !*validate && fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	m := neste.New(*dir, nil)
+	m.SetDelims(*ldelim, *rdelim)
+	err = m.AddDir("")
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if *validate {
+		return 0
+	}
+
+	name := fs.Arg(0)
+	var s string
+	if *data != "" {
+		s, err = m.RenderWithJSON(name, *data)
+	} else if t, ok := m.Lookup(name); ok {
+		s, err = t.Render(nil)
+	} else {
+		err = fmt.Errorf("neste: no such template: %s", name)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	if *out != "" {
+		err = ioutil.WriteFile(*out, []byte(s), 0644)
+	} else {
+		_, err = io.WriteString(stdout, s)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	. "launchpad.net/gocheck"
+	"bytes"
+	"github.com/fzzbt/neste/nestetest"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type S struct{}
+
+var _ = Suite(&S{})
+
+func (s *S) TestRun(c *C) {
+	dir := nestetest.WriteFiles(c, map[string]string{
+		"index.html": "<h1>{title}</h1>{.repeated section items}<li>{@}</li>{.end}",
+		"plain.txt":  "static"})
+	defer os.RemoveAll(dir)
+	dataDir := nestetest.WriteFiles(c, map[string]string{
+		"data.json": `{"title": "neste", "items": [1, 2]}`,
+		"bad.json":  `{"title": }`})
+	defer os.RemoveAll(dataDir)
+
+	var stdout, stderr bytes.Buffer
+	status := run([]string{"-dir", dir, "-data", path.Join(dataDir, "data.json"), "index.html"},
+		&stdout, &stderr)
+	c.Check(status, Equals, 0)
+	c.Check(stdout.String(), Equals, "<h1>neste</h1><li>1</li><li>2</li>")
+	c.Check(stderr.String(), Equals, "")
+
+	// Output file
+	out := path.Join(dataDir, "out.html")
+	stdout.Reset()
+	status = run([]string{"-dir", dir, "-o", out, "plain.txt"}, &stdout, &stderr)
+	c.Check(status, Equals, 0)
+	c.Check(stdout.String(), Equals, "")
+	b, err := ioutil.ReadFile(out)
+	c.Assert(err, IsNil)
+	c.Check(string(b), Equals, "static")
+
+	// Failures
+	for _, args := range [][]string{
+		{"-dir", dir, "-data", path.Join(dataDir, "bad.json"), "index.html"},
+		{"-dir", dir, "-data", path.Join(dataDir, "data.json"), "missing.html"},
+		{"-dir", dir, "missing.html"},
+		{"-dir", path.Join(dir, "missing"), "index.html"},
+	} {
+		stderr.Reset()
+		status = run(args, &stdout, &stderr)
+		c.Check(status, Equals, 1)
+		c.Check(stderr.Len() > 0, Equals, true)
+	}
+	c.Check(run([]string{"-dir", dir}, &stdout, &stderr), Equals, 2)
+	c.Check(run([]string{"-bogus", "index.html"}, &stdout, &stderr), Equals, 2)
+}
+
+func (s *S) TestRunValidate(c *C) {
+	dir := nestetest.WriteFiles(c, map[string]string{
+		"a.html": "<<title>>",
+		"b.html": "<<.section x>><<y>><<.end>>"})
+	defer os.RemoveAll(dir)
+
+	var stdout, stderr bytes.Buffer
+	status := run([]string{"-dir", dir, "-ldelim", "<<", "-rdelim", ">>", "-validate"},
+		&stdout, &stderr)
+	c.Check(status, Equals, 0)
+	c.Check(stdout.String(), Equals, "")
+
+	status = run([]string{"-dir", dir, "-validate"}, &stdout, &stderr)
+	c.Check(status, Equals, 0)
+
+	err := ioutil.WriteFile(path.Join(dir, "c.html"), []byte("<<.section x>>"), 0644)
+	c.Assert(err, IsNil)
+	stderr.Reset()
+	status = run([]string{"-dir", dir, "-ldelim", "<<", "-rdelim", ">>", "-validate"},
+		&stdout, &stderr)
+	c.Check(status, Equals, 1)
+	c.Check(stderr.String() != "", Equals, true)
+}
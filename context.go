@@ -0,0 +1,268 @@
+// neste template engine: render context
+
+package neste
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"template"
+	"unicode"
+	"utf8"
+)
+
+// renderContext holds the state of a single top-level Execute call.
+// It is passed down to nested renders instead of being stored on templates,
+// so that concurrent executions of the same templates don't interfere.
+type renderContext struct {
+	chain   []*Template              // Templates currently being rendered
+	slots   map[string]string        // Content for yield directives
+	vars    map[string]string        // Values of set directives
+	scopes  [][]interface{}          // Cursors of the sections of each template
+	cycles  map[*cycle]int           // Positions of cycle directives
+	limited []map[string]interface{} // Data maps of the limitedTemplates being rendered
+	locale  string                   // Locale for trans directives, "" for default
+}
+
+// enter adds t to the chain of templates being rendered.
+// If t is already being rendered, enter returns an error listing the cycle.
+func (ctx *renderContext) enter(t *Template) os.Error {
+	for i, v := range ctx.chain {
+		if v == t {
+			names := make([]string, 0, len(ctx.chain)-i+1)
+			for _, v := range ctx.chain[i:] {
+				names = append(names, v.name)
+			}
+			names = append(names, t.name)
+			return fmt.Errorf("neste: template cycle: %s", strings.Join(names, " -> "))
+		}
+	}
+
+	ctx.chain = append(ctx.chain, t)
+	return nil
+}
+
+// leave removes the most recently entered template from the chain.
+func (ctx *renderContext) leave() {
+	ctx.chain = ctx.chain[:len(ctx.chain)-1]
+}
+
+// lookup returns the value of the field name of cursor, or of the cursors 
+// of the enclosing sections of the template being rendered, and whether it 
+// was found.
+func (ctx *renderContext) lookup(cursor interface{}, name string) (interface{}, bool) {
+	if v, found := resolvePath(cursor, name); found {
+		return v, true
+	}
+	if len(ctx.scopes) == 0 {
+		return nil, false
+	}
+	scope := ctx.scopes[len(ctx.scopes)-1]
+	for i := len(scope) - 1; i >= 0; i-- {
+		if v, found := resolvePath(scope[i], name); found {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// contextWriter is the writer given to the template package when executing.
+// It carries the render context to the formatters of neste's directives.
+// Directives may capture the output of a region of the template by pushing 
+// a buffer, which receives all output until it is popped.
+type contextWriter struct {
+	io.Writer
+	ctx      *renderContext
+	captures []*bytes.Buffer // Stack of capturing buffers
+	ifs      []bool          // Whether the output of each open if is discarded
+	written  int             // Bytes written, captured or not, minus released captures
+}
+
+// Write writes p to the innermost capturing buffer, or to the underlying 
+// writer if there is none.
+func (w *contextWriter) Write(p []byte) (n int, err os.Error) {
+	if len(w.captures) > 0 {
+		n, err = w.captures[len(w.captures)-1].Write(p)
+	} else {
+		n, err = w.Writer.Write(p)
+	}
+	w.written += n
+	return
+}
+
+// stringWriter is implemented by writers that can write strings without
+// converting them to byte slices first, like bytes.Buffer.
+type stringWriter interface {
+	WriteString(s string) (n int, err os.Error)
+}
+
+// stringFormatter is the default formatter of the template package, except 
+// that it writes strings with the WriteString method of the writer if it 
+// has one.
+func stringFormatter(w io.Writer, formatter string, data ...interface{}) {
+	if len(data) == 1 {
+		if s, ok := data[0].(string); ok {
+			if sw, ok := w.(stringWriter); ok {
+				sw.WriteString(s)
+				return
+			}
+		}
+	}
+	template.StringFormatter(w, formatter, data...)
+}
+
+// WriteString is like Write, but writes with the WriteString method of 
+// the underlying writer if it has one.
+func (w *contextWriter) WriteString(s string) (n int, err os.Error) {
+	if len(w.captures) > 0 {
+		n, err = w.captures[len(w.captures)-1].WriteString(s)
+	} else if sw, ok := w.Writer.(stringWriter); ok {
+		n, err = sw.WriteString(s)
+	} else {
+		n, err = w.Writer.Write([]byte(s))
+	}
+	w.written += n
+	return
+}
+
+// capture starts capturing output to a new buffer.
+func (w *contextWriter) capture() {
+	w.captures = append(w.captures, new(bytes.Buffer))
+}
+
+// release stops capturing output to the innermost buffer and returns it.
+// The captured bytes are no longer counted as written, so that output which 
+// is discarded or written again is counted only as it is finally written.
+func (w *contextWriter) release() *bytes.Buffer {
+	buf := w.captures[len(w.captures)-1]
+	w.captures = w.captures[:len(w.captures)-1]
+	w.written -= buf.Len()
+	return buf
+}
+
+// beginIf begins a conditional block, discarding its output unless cond
+// is true.
+func (w *contextWriter) beginIf(cond bool) {
+	if !cond {
+		w.capture()
+	}
+	w.ifs = append(w.ifs, !cond)
+}
+
+// elseIf switches to the else branch of the innermost conditional block.
+func (w *contextWriter) elseIf() {
+	i := len(w.ifs) - 1
+	if w.ifs[i] {
+		w.release()
+	} else {
+		w.capture()
+	}
+	w.ifs[i] = !w.ifs[i]
+}
+
+// endIf ends the innermost conditional block.
+func (w *contextWriter) endIf() {
+	i := len(w.ifs) - 1
+	if w.ifs[i] {
+		w.release()
+	}
+	w.ifs = w.ifs[:i]
+}
+
+// execError is a type for errors raised by directives during execution.
+// They are passed through the template package as panics.
+type execError struct {
+	err os.Error
+}
+
+// catchError is a deferred function to turn a panic with type *execError
+// into a plain error return. Other panics are re-enabled.
+func catchError(err *os.Error) {
+	if v := recover(); v != nil {
+		if e, ok := v.(*execError); ok {
+			*err = e.err
+		} else {
+			panic(v)
+		}
+	}
+}
+
+// resolvePath returns the value at path in data, where path is a list of
+// map keys and exported struct field names separated by periods.
+// Found is false if there is no such value.
+func resolvePath(data interface{}, path string) (v interface{}, found bool) {
+	rv := reflect.ValueOf(data)
+	for _, name := range strings.Split(path, ".", -1) {
+		rv = indirect(rv)
+		if !rv.IsValid() {
+			return nil, false
+		}
+
+		switch rv.Kind() {
+		case reflect.Map:
+			if rv.Type().Key() != reflect.TypeOf(name) {
+				return nil, false
+			}
+			rv = rv.MapIndex(reflect.ValueOf(name))
+		case reflect.Struct:
+			r, _ := utf8.DecodeRuneInString(name)
+			if !unicode.IsUpper(r) {
+				return nil, false
+			}
+			rv = rv.FieldByName(name)
+		default:
+			return nil, false
+		}
+
+		if !rv.IsValid() {
+			return nil, false
+		}
+	}
+
+	return rv.Interface(), true
+}
+
+// indirect follows pointers and interfaces from v to the value they refer to.
+// The returned value is invalid, if a nil pointer or interface is found.
+func indirect(v reflect.Value) reflect.Value {
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+// argString returns the value of a directive argument split by splitArgs as
+// a string. Fields are formatted like with the default formatter, with @
+// referring to data itself, and missing fields are empty.
+func argString(data interface{}, field, literal string) string {
+	if field == "" {
+		return literal
+	}
+
+	v, found := data, true
+	if field != "@" {
+		v, found = resolvePath(data, field)
+	}
+	if !found {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// isEmpty returns true if v is nil, a nil pointer, an empty string or
+// an empty byte slice.
+func isEmpty(v interface{}) bool {
+	switch v := v.(type) {
+	case string:
+		return v == ""
+	case []byte:
+		return len(v) == 0
+	}
+	return !indirect(reflect.ValueOf(v)).IsValid()
+}
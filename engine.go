@@ -0,0 +1,86 @@
+// neste template engine: template engines
+
+package neste
+
+import (
+	exptemplate "exp/template"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Executer is the interface of parsed templates.
+// *template.Template of the old template package implements it.
+type Executer interface {
+	Execute(wr io.Writer, data interface{}) os.Error
+}
+
+// Engine is the interface of template engines other than the old template
+// package, used for template files added with AddFileEngine.
+// Parse parses the template source src of the template file name.
+type Engine interface {
+	Parse(name, src string) (Executer, os.Error)
+}
+
+// ExpEngine is an Engine for the exp/template package.
+// Funcs are added to the templates before parsing them, if not nil.
+type ExpEngine struct {
+	Funcs exptemplate.FuncMap
+}
+
+// Parse parses src as an exp/template template named name.
+func (e *ExpEngine) Parse(name, src string) (Executer, os.Error) {
+	t := exptemplate.New(name)
+	if e.Funcs != nil {
+		t.Funcs(e.Funcs)
+	}
+	_, err := t.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// AddFileEngine adds a given template file to the template manager,
+// parsing it with engine instead of the old template package. The engine
+// is also used when the template is reloaded, and for the file until it is
+// removed.
+// The preprocessing directives of neste, such as {extends}, {define} and
+// {include}, and formatters are features of the old template package and
+// don't apply to the template. Because of that, adding the template fails
+// if the template manager escapes output automatically (see
+// SetAutoEscape). Like in AddFile, the filename can't refer outside the 
+// base directory.
+// If any errors occur, returned error will be non-nil.
+func (m *Manager) AddFileEngine(filename string, engine Engine) (*Template, os.Error) {
+	err := m.writable()
+	if err != nil {
+		return nil, err
+	}
+	err = checkFilename(filename)
+	if err != nil {
+		return nil, err
+	}
+	filename = slashFilename(filename)
+	if m.autoEscape {
+		return nil, fmt.Errorf("neste: %s: automatic escaping requires "+
+			"formatters of the old template engine", filename)
+	}
+
+	m.mu.Lock()
+	old, present := m.engines[filename]
+	m.engines[filename] = engine
+	m.mu.Unlock()
+	t, err := m.addFile(filename, false)
+	if err != nil {
+		m.mu.Lock()
+		if present {
+			m.engines[filename] = old
+		} else {
+			m.engines[filename] = nil, false
+		}
+		m.mu.Unlock()
+		return nil, err
+	}
+	return t, nil
+}
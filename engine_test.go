@@ -0,0 +1,86 @@
+package neste
+
+import (
+	. "launchpad.net/gocheck"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+func (s *S) TestAddFileEngine(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"old.html": "<p>Hello, {Name}!</p>",
+		"exp.html": "<p>Hello, {{.Name}}!</p>"})
+	defer os.RemoveAll(dir)
+	data := &struct{ Name string }{"World"}
+
+	tm := New(dir, nil)
+	tOld, err := tm.AddFile("old.html")
+	c.Assert(err, IsNil)
+	tExp, err := tm.AddFileEngine("exp.html", &ExpEngine{})
+	c.Assert(err, IsNil)
+
+	output, err := tOld.Render(data)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "<p>Hello, World!</p>")
+	output, err = tExp.Render(data)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "<p>Hello, World!</p>")
+
+	// Reloading uses the engine of each file.
+	touch := func(name, src string) {
+		fpath := path.Join(dir, name)
+		err := ioutil.WriteFile(fpath, []byte(src), 0644)
+		c.Assert(err, IsNil)
+		mtime := time.Nanoseconds() + 10e9
+		err = os.Chtimes(fpath, mtime, mtime)
+		c.Assert(err, IsNil)
+	}
+	touch("old.html", "<p>Bye, {Name}!</p>")
+	touch("exp.html", "<p>Bye, {{.Name}}!</p>")
+	c.Assert(tOld.Reload(), IsNil)
+	c.Assert(tExp.Reload(), IsNil)
+
+	output, err = tm.Render("old.html", data)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "<p>Bye, World!</p>")
+	output, err = tm.Render("exp.html", data)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "<p>Bye, World!</p>")
+
+	// The engine is kept for the file until it is removed.
+	c.Check(tm.RemoveFile("exp.html"), Equals, true)
+	c.Check(tm.engines["exp.html"], IsNil)
+}
+
+func (s *S) TestAddFileEngineFuncs(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"funcs.html": "{{upper .}}"})
+	defer os.RemoveAll(dir)
+
+	tm := New(dir, nil)
+	t, err := tm.AddFileEngine("funcs.html", &ExpEngine{
+		Funcs: map[string]interface{}{"upper": strings.ToUpper}})
+	c.Assert(err, IsNil)
+	output, err := t.Render("hi")
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "HI")
+}
+
+func (s *S) TestAddFileEngineErrors(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"invalid.html": "{{.Name",
+		"valid.html":   "{{.Name}}"})
+	defer os.RemoveAll(dir)
+
+	tm := New(dir, nil)
+	_, err := tm.AddFileEngine("invalid.html", &ExpEngine{})
+	c.Check(err, NotNil)
+	c.Check(tm.GetFile("invalid.html"), IsNil)
+
+	tm.SetAutoEscape(true)
+	_, err = tm.AddFileEngine("valid.html", &ExpEngine{})
+	c.Check(err, ErrorMatches, "neste: valid.html: automatic escaping .*")
+}
@@ -7,14 +7,56 @@ import (
 	"template"
 	"fmt"
 	"bytes"
+	"html"
+	"json"
+	"strconv"
+	"strings"
 	"utf8"
 	"unicode"
+	"os"
+	"xml"
 )
 
 var builtinFormatters = template.FormatterMap{
-	"e":          template.HTMLFormatter, // Just a shorthand for the "html" escaping formatter
-	"addSlashes": AddSlashesFormatter,
-	"capFirst":   CapFirstFormatter}
+	"":              stringFormatter,
+	"str":           stringFormatter,
+	"e":             template.HTMLFormatter, // Just a shorthand for the "html" escaping formatter
+	"addSlashes":    AddSlashesFormatter,
+	"addSlashesAll": AddSlashesAllFormatter,
+	"capFirst":      CapFirstFormatter,
+	"safe":          stringFormatter, // Marks values as safe in automatic escaping mode
+	"attr":          AttrFormatter,
+	"urlAttr":       URLAttrFormatter,
+	"js":            JSFormatter,
+	"bytesize":      ByteSizeFormatter,
+	"json":          JsonEncodeFormatter,
+	"slug":          SlugFormatter,
+	"sanitize":      SanitizeFormatter,
+	"wrap":          WrapFormatter,
+	"indent":        IndentFormatter,
+	"wordcount":     WordCountFormatter,
+	"count":         CountFormatter,
+	"ellipsis":      EllipsisFormatter,
+	"htmlunescape":  HTMLUnescapeFormatter,
+	"linecount":     LineCountFormatter,
+	"pluralize":     PluralizeFormatter,
+	"ordinal":       OrdinalFormatter,
+	"xml":           XMLFormatter}
+
+// textFormatters are the built-in formatters of template managers created
+// with NewText.
+var textFormatters = template.FormatterMap{
+	"":              stringFormatter,
+	"str":           stringFormatter,
+	"addSlashes":    AddSlashesFormatter,
+	"addSlashesAll": AddSlashesAllFormatter,
+	"capFirst":      CapFirstFormatter,
+	"csv":           CSVFormatter,
+	"indent":        IndentFormatter,
+	"ljust":         LjustFormatter,
+	"rjust":         RjustFormatter,
+	"wordwrap":      WrapFormatter,
+	"wrap":          WrapFormatter}
 
 /*
 Adds slashes before quotes. Useful for escaping strings in CSV, for example.
@@ -26,17 +68,115 @@ Example:
 If value is "I'm using neste", the output will be "I\'m using neste".
 */
 func AddSlashesFormatter(w io.Writer, formatter string, data ...interface{}) {
-	b := getBytes(data...)
+	addSlashes(w, getBytes(data...), `"`)
+}
+
+/*
+Adds slashes before both double and single quotes. Useful for escaping 
+strings in SQL or PHP, for example.
 
+Example:
+
+	{value|addSlashesAll}
+
+If value is "I'm using neste", the output will be "I\'m using neste".
+*/
+func AddSlashesAllFormatter(w io.Writer, formatter string, data ...interface{}) {
+	addSlashes(w, getBytes(data...), `"'`)
+}
+
+// addSlashes writes b to w with slashes added before the quotes in quotes.
+func addSlashes(w io.Writer, b []byte, quotes string) {
 	for _, v := range b {
-		if v == '"' {
-			w.Write([]byte{'\\', '"'})
+		if strings.IndexRune(quotes, int(v)) >= 0 {
+			w.Write([]byte{'\\', v})
 		} else {
 			w.Write([]byte{v})
 		}
 	}
 }
 
+/*
+Escapes the value for use in an HTML attribute value, quoted with either 
+double or single quotes.
+
+Example:
+
+	<input value="{value|attr}">
+
+If value is "it's <b>", the output will be "it&#39;s &lt;b&gt;".
+*/
+func AttrFormatter(w io.Writer, formatter string, data ...interface{}) {
+	b := getBytes(data...)
+
+	last := 0
+	for i, v := range b {
+		var esc []byte
+		switch v {
+		case '&':
+			esc = []byte("&amp;")
+		case '<':
+			esc = []byte("&lt;")
+		case '>':
+			esc = []byte("&gt;")
+		case '"':
+			esc = []byte("&#34;")
+		case '\'':
+			esc = []byte("&#39;")
+		default:
+			continue
+		}
+		w.Write(b[last:i])
+		w.Write(esc)
+		last = i + 1
+	}
+	w.Write(b[last:])
+}
+
+/*
+Formats an integer value as a human-readable size of a file, like 
+"1.5 KB". Sizes are counted in multiples of 1024 by default. With the 
+argument "binary", the binary prefixes KiB, MiB and so on are used instead, 
+and with the argument "si", sizes are counted in multiples of 1000. 
+Values that aren't integers are output as they are.
+
+Example:
+
+	{size|bytesize}
+	{size|bytesize:binary}
+	{size|bytesize:si}
+
+If size is 1536, the output will be "1.5 KB", "1.5 KiB" and "1.5 KB".
+*/
+func ByteSizeFormatter(w io.Writer, formatter string, data ...interface{}) {
+	b := getBytes(data...)
+	n, err := strconv.Atoi64(string(b))
+	if err != nil {
+		w.Write(b)
+		return
+	}
+
+	unit, infix := int64(1024), ""
+	switch formatterArg(formatter) {
+	case "binary":
+		infix = "i"
+	case "si":
+		unit = 1000
+	}
+
+	if n < unit && n > -unit {
+		fmt.Fprintf(w, "%d B", n)
+		return
+	}
+	prefixes := "KMGTPE"
+	size, i := float64(n)/float64(unit), 0
+	for (size >= float64(unit) || size <= -float64(unit)) && i < len(prefixes)-1 {
+		size /= float64(unit)
+		i++
+	}
+	fmt.Fprintf(w, "%.1f %c%sB", size, prefixes[i], infix)
+}
+
 /*
 Capitalizes the first character of the value.
 
@@ -60,6 +200,598 @@ func CapFirstFormatter(w io.Writer, formatter string, data ...interface{}) {
 	}
 }
 
+/*
+Outputs the value followed by its number of words in parentheses.
+Words are separated by white space, like in WordCountFormatter.
+
+Example:
+
+	{body|count}
+
+If body is "Hello neste world", the output will be "Hello neste world (3 words)".
+*/
+func CountFormatter(w io.Writer, formatter string, data ...interface{}) {
+	b := getBytes(data...)
+	n := len(strings.Fields(string(b)))
+	w.Write(b)
+	if n == 1 {
+		io.WriteString(w, " (1 word)")
+	} else {
+		fmt.Fprintf(w, " (%d words)", n)
+	}
+}
+
+/*
+Quotes the value as a CSV field, if it contains commas, double quotes, 
+line breaks or leading or trailing spaces. Double quotes in quoted fields 
+are doubled. Available in template managers created with NewText.
+
+Example:
+
+	{name|csv},{price|csv}
+
+If name is `Tea, "green"` and price is 3, the output will be 
+`"Tea, ""green""",3`.
+*/
+func CSVFormatter(w io.Writer, formatter string, data ...interface{}) {
+	s := string(getBytes(data...))
+	if strings.IndexAny(s, ",\"\r\n") < 0 && strings.TrimSpace(s) == s {
+		io.WriteString(w, s)
+		return
+	}
+	io.WriteString(w, `"`+strings.Replace(s, `"`, `""`, -1)+`"`)
+}
+
+/*
+Truncates the value to as many characters as given by the argument, 
+and appends an ellipsis "…" (U+2026). The ellipsis is appended even if the 
+value is not truncated, unless the argument is followed by ",truncated".
+Without an argument, the value is not truncated.
+
+Example:
+
+	{title|ellipsis:10}
+	{title|ellipsis:10,truncated}
+
+If title is "Hello neste world", the output will be "Hello nest…".
+*/
+func EllipsisFormatter(w io.Writer, formatter string, data ...interface{}) {
+	args := strings.Split(formatterArg(formatter), ",", -1)
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 0 {
+		n = -1
+	}
+	onlyTruncated := len(args) > 1 && args[1] == "truncated"
+
+	s := string(getBytes(data...))
+	truncated := false
+	if n >= 0 && utf8.RuneCountInString(s) > n {
+		i := 0
+		for j := 0; j < n; j++ {
+			_, size := utf8.DecodeRuneInString(s[i:])
+			i += size
+		}
+		s = s[:i]
+		truncated = true
+	}
+
+	io.WriteString(w, s)
+	if truncated || !onlyTruncated {
+		io.WriteString(w, "…")
+	}
+}
+
+/*
+Unescapes HTML entities in the value, like "&lt;" to "<". The opposite of 
+the html formatter. Useful for data that is already HTML escaped, for example.
+
+Example:
+
+	{value|htmlunescape}
+
+If value is "Tom &amp; Jerry", the output will be "Tom & Jerry".
+*/
+func HTMLUnescapeFormatter(w io.Writer, formatter string, data ...interface{}) {
+	io.WriteString(w, html.UnescapeString(string(getBytes(data...))))
+}
+
+/*
+Indents every line of the value by as many spaces as given by the argument, 
+or 4 if none. Blank lines are indented too, unless the argument is followed 
+by ",skipblank". Useful for embedding text in YAML or other indented text, 
+for example.
+
+Example:
+
+	{block|indent:2}
+	{block|indent:2,skipblank}
+
+If block is "a:\n  b: 1", the output will be "  a:\n    b: 1".
+*/
+func IndentFormatter(w io.Writer, formatter string, data ...interface{}) {
+	args := strings.Split(formatterArg(formatter), ",", -1)
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 0 {
+		n = 4
+	}
+	skipBlank := len(args) > 1 && args[1] == "skipblank"
+	prefix := strings.Repeat(" ", n)
+
+	lines := strings.Split(string(getBytes(data...)), "\n", -1)
+	for i, line := range lines {
+		if i > 0 {
+			io.WriteString(w, "\n")
+		}
+		if i == len(lines)-1 && line == "" {
+			// Nothing after the last newline
+			break
+		}
+		if !skipBlank || strings.TrimSpace(line) != "" {
+			io.WriteString(w, prefix)
+		}
+		io.WriteString(w, line)
+	}
+}
+
+/*
+Escapes the value for use in a JavaScript string literal, quoted with 
+either double or single quotes. Characters that could end the string or 
+the script element, such as quotes, line breaks and "<", are written as 
+escape sequences.
+
+Example:
+
+	<script>var name = "{name|js}";</script>
+
+If name is `it's "<b>"`, the output will be 
+`<script>var name = "it\x27s \x22\x3cb\x3e\x22";</script>`.
+*/
+func JSFormatter(w io.Writer, formatter string, data ...interface{}) {
+	var buf bytes.Buffer
+	for _, rune := range string(getBytes(data...)) {
+		switch {
+		case rune == '\\':
+			buf.WriteString(`\\`)
+		case rune == '\n':
+			buf.WriteString(`\n`)
+		case rune == '\r':
+			buf.WriteString(`\r`)
+		case rune == '\t':
+			buf.WriteString(`\t`)
+		case rune < ' ' || strings.IndexRune(`"'&<>=`, rune) >= 0:
+			fmt.Fprintf(&buf, `\x%02x`, rune)
+		case rune == 0x2028 || rune == 0x2029:
+			fmt.Fprintf(&buf, `\u%04x`, rune)
+		default:
+			buf.WriteRune(rune)
+		}
+	}
+	w.Write(buf.Bytes())
+}
+
+/*
+Encodes the value as JSON. Useful for embedding data in JavaScript, for 
+example. The characters <, > and & are written as \u003c, \u003e and \u0026 
+escapes, so that strings like "</script>" can't end a script element. 
+If the value can't be encoded, the output is null.
+
+Example:
+
+	<script>var user = {user|json};</script>
+
+If user is struct{ Name string }{"neste"}, the output will be 
+"<script>var user = {"Name":"neste"};</script>".
+*/
+func JsonEncodeFormatter(w io.Writer, formatter string, data ...interface{}) {
+	var v interface{} = data
+	if len(data) == 1 {
+		v = data[0]
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		b = []byte("null")
+	}
+	var buf bytes.Buffer
+	json.HTMLEscape(&buf, b)
+	w.Write(buf.Bytes())
+}
+
+/*
+Outputs the number of lines in the value. A newline at the end of the value 
+ends the last line rather than starting a new one, so "a\nb" and "a\nb\n" 
+both have 2 lines. An empty value has no lines.
+
+Example:
+
+	{source|linecount}
+
+If source is "package main\n\nfunc main() {}\n", the output will be "3".
+*/
+func LineCountFormatter(w io.Writer, formatter string, data ...interface{}) {
+	b := getBytes(data...)
+	n := bytes.Count(b, []byte{'\n'})
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		n++
+	}
+	fmt.Fprint(w, n)
+}
+
+/*
+Pads the value with spaces on the right to be as many characters long 
+as given by the argument. Longer values are left as they are. 
+Available in template managers created with NewText.
+
+Example:
+
+	{name|ljust:10}|
+
+If name is "neste", the output will be "neste     |".
+*/
+func LjustFormatter(w io.Writer, formatter string, data ...interface{}) {
+	b := getBytes(data...)
+	w.Write(b)
+	io.WriteString(w, padding(formatter, b))
+}
+
+/*
+Pads the value with spaces on the left to be as many characters long 
+as given by the argument. Longer values are left as they are. 
+Available in template managers created with NewText.
+
+Example:
+
+	{price|rjust:6}
+
+If price is 3.50, the output will be "  3.50".
+*/
+func RjustFormatter(w io.Writer, formatter string, data ...interface{}) {
+	b := getBytes(data...)
+	io.WriteString(w, padding(formatter, b))
+	w.Write(b)
+}
+
+// padding returns the spaces for padding b to the width given by 
+// the argument of a formatter.
+func padding(formatter string, b []byte) string {
+	n := intArg(formatter, 0) - utf8.RuneCount(b)
+	if n <= 0 {
+		return ""
+	}
+	return strings.Repeat(" ", n)
+}
+
+/*
+Adds the English ordinal suffix to an integer value, like "1st", "2nd", 
+"3rd" and "4th". Values that aren't integers are output as they are.
+
+Example:
+
+	{day|ordinal}
+
+If day is 25, the output will be "25th".
+*/
+func OrdinalFormatter(w io.Writer, formatter string, data ...interface{}) {
+	b := getBytes(data...)
+	n, err := strconv.Atoi64(string(b))
+	if err != nil {
+		w.Write(b)
+		return
+	}
+
+	suffix := "th"
+	if n < 0 {
+		n = -n
+	}
+	if n%100 < 11 || n%100 > 13 {
+		switch n % 10 {
+		case 1:
+			suffix = "st"
+		case 2:
+			suffix = "nd"
+		case 3:
+			suffix = "rd"
+		}
+	}
+	w.Write(b)
+	io.WriteString(w, suffix)
+}
+
+/*
+Outputs the singular form given by the argument if the value is 1, and the 
+plural form otherwise, including for values that aren't integers. The forms 
+are separated by a colon in the argument. If only one form is given, the 
+plural form is it followed by "s", and without an argument, the forms are 
+"" and "s".
+
+Example:
+
+	{count} {count|pluralize:item:items}
+	{count} item{count|pluralize}
+
+If count is 1, the output will be "1 item", and if it is 2, "2 items".
+*/
+func PluralizeFormatter(w io.Writer, formatter string, data ...interface{}) {
+	singular, plural := "", "s"
+	if arg := formatterArg(formatter); arg != "" {
+		singular, plural = arg, arg+"s"
+		if i := strings.Index(arg, ":"); i >= 0 {
+			singular, plural = arg[:i], arg[i+1:]
+		}
+	}
+
+	n, err := strconv.Atoi64(strings.TrimSpace(string(getBytes(data...))))
+	if err == nil && n == 1 {
+		io.WriteString(w, singular)
+	} else {
+		io.WriteString(w, plural)
+	}
+}
+
+/*
+Removes all characters from the value except letters, digits and the 
+characters "-", "_" and ".". Useful for displaying user names or embedding 
+search queries safely, for example. See NewSanitizeFormatter for keeping 
+other characters.
+
+Example:
+
+	{value|sanitize}
+
+If value is "<script>j.doe</script>", the output will be "scriptj.doescript".
+*/
+var SanitizeFormatter = NewSanitizeFormatter("-_.")
+
+// NewSanitizeFormatter returns a formatter like SanitizeFormatter, which 
+// keeps the characters in safe instead of "-_.".
+func NewSanitizeFormatter(safe string) func(io.Writer, string, ...interface{}) {
+	return func(w io.Writer, formatter string, data ...interface{}) {
+		b := getBytes(data...)
+
+		var buf bytes.Buffer
+		for _, rune := range string(b) {
+			if unicode.IsLetter(rune) || unicode.IsDigit(rune) || strings.IndexRune(safe, rune) >= 0 {
+				buf.WriteRune(rune)
+			}
+		}
+		w.Write(buf.Bytes())
+	}
+}
+
+/*
+Converts the value to a slug for use in URLs. The value is lowercased, 
+letters with diacritics are replaced by their ASCII equivalents, and 
+all other characters than ASCII letters and digits are replaced by hyphens, 
+with no consecutive, leading or trailing hyphens.
+
+Example:
+
+	<a href="/posts/{title|slug}">
+
+If title is "Héllo, Wörld!", the output will be "<a href="/posts/hello-world">".
+*/
+func SlugFormatter(w io.Writer, formatter string, data ...interface{}) {
+	var buf bytes.Buffer
+	hyphen := false
+	for _, rune := range string(getBytes(data...)) {
+		rune = unicode.ToLower(rune)
+		s, present := slugFolds[rune]
+		if !present && (rune >= 'a' && rune <= 'z' || rune >= '0' && rune <= '9') {
+			s, present = string(rune), true
+		}
+
+		if !present {
+			hyphen = buf.Len() > 0
+			continue
+		}
+		if hyphen {
+			buf.WriteByte('-')
+			hyphen = false
+		}
+		buf.WriteString(s)
+	}
+	w.Write(buf.Bytes())
+}
+
+// slugFolds maps lowercase letters with diacritics and ligatures to their 
+// ASCII equivalents for SlugFormatter.
+var slugFolds = map[int]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'æ': "ae", 'ç': "c", 'ć': "c", 'ĉ': "c", 'ċ': "c", 'č': "c", 'ď': "d", 'đ': "d", 'ð': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ĕ': "e", 'ė': "e", 'ę': "e", 'ě': "e",
+	'ĝ': "g", 'ğ': "g", 'ġ': "g", 'ģ': "g", 'ĥ': "h", 'ħ': "h",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ĩ': "i", 'ī': "i", 'ĭ': "i", 'į': "i", 'ı': "i",
+	'ĵ': "j", 'ķ': "k", 'ĺ': "l", 'ļ': "l", 'ľ': "l", 'ŀ': "l", 'ł': "l",
+	'ñ': "n", 'ń': "n", 'ņ': "n", 'ň': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ō': "o", 'ŏ': "o", 'ő': "o",
+	'œ': "oe", 'ŕ': "r", 'ŗ': "r", 'ř': "r", 'ś': "s", 'ŝ': "s", 'ş': "s", 'š': "s", 'ß': "ss",
+	'ţ': "t", 'ť': "t", 'ŧ': "t", 'þ': "th",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ũ': "u", 'ū': "u", 'ŭ': "u", 'ů': "u", 'ű': "u", 'ų': "u",
+	'ŵ': "w", 'ý': "y", 'ÿ': "y", 'ŷ': "y", 'ź': "z", 'ż': "z", 'ž': "z"}
+
+/*
+Escapes the value for use as a URL in an HTML attribute value, like the 
+attr formatter. URLs with schemes other than http, https, mailto and ftp, 
+such as "javascript:alert(1)", are replaced by "#". Relative URLs are 
+output as they are.
+
+Example:
+
+	<a href="{link|urlAttr}">
+
+If link is "javascript:alert(1)", the output will be "<a href="#">".
+*/
+func URLAttrFormatter(w io.Writer, formatter string, data ...interface{}) {
+	b := getBytes(data...)
+	s := string(b)
+	if i := strings.IndexAny(s, ":/?#"); i >= 0 && s[i] == ':' {
+		// Browsers ignore white space and control characters in schemes.
+		scheme := strings.Map(func(rune int) int {
+			if rune <= ' ' {
+				return -1
+			}
+			return unicode.ToLower(rune)
+		}, s[:i])
+		if !safeSchemes[scheme] {
+			io.WriteString(w, "#")
+			return
+		}
+	}
+	AttrFormatter(w, formatter, b)
+}
+
+// safeSchemes are the URL schemes allowed by the urlAttr formatter.
+var safeSchemes = map[string]bool{
+	"http":   true,
+	"https":  true,
+	"mailto": true,
+	"ftp":    true}
+
+/*
+Outputs the number of words in the value. Words are separated by white space.
+
+Example:
+
+	{body|wordcount}
+
+If body is "Hello neste world", the output will be "3".
+*/
+func WordCountFormatter(w io.Writer, formatter string, data ...interface{}) {
+	fmt.Fprint(w, len(strings.Fields(string(getBytes(data...)))))
+}
+
+/*
+Wraps the lines of the value at word boundaries, so that they are at most 
+as many characters long as given by the argument, or 80 if none. Words 
+longer than that are broken. Existing newlines are kept.
+Useful for plain text email, for example.
+
+Example:
+
+	{body|wrap:72}
+
+If body is "Hello, this is neste" and the argument is 12, the output will 
+be "Hello, this\nis neste".
+*/
+func WrapFormatter(w io.Writer, formatter string, data ...interface{}) {
+	width := intArg(formatter, 80)
+	lines := strings.Split(string(getBytes(data...)), "\n", -1)
+	for i, line := range lines {
+		if i > 0 {
+			io.WriteString(w, "\n")
+		}
+		io.WriteString(w, wrapLine(line, width))
+	}
+}
+
+// wrapLine wraps a line at the given width for WrapFormatter.
+func wrapLine(line string, width int) string {
+	var buf bytes.Buffer
+	n := 0 // Length of the current line in characters
+	for _, word := range strings.Fields(line) {
+		wordLen := utf8.RuneCountInString(word)
+		if n > 0 && n+1+wordLen > width {
+			buf.WriteByte('\n')
+			n = 0
+		} else if n > 0 {
+			buf.WriteByte(' ')
+			n++
+		}
+
+		for wordLen > width {
+			i := 0
+			for j := 0; j < width; j++ {
+				_, size := utf8.DecodeRuneInString(word[i:])
+				i += size
+			}
+			buf.WriteString(word[:i])
+			buf.WriteByte('\n')
+			word = word[i:]
+			wordLen -= width
+		}
+		buf.WriteString(word)
+		n += wordLen
+	}
+	return buf.String()
+}
+
+/*
+Escapes the value for use in XML text and attribute values, and removes 
+the characters that aren't allowed in XML 1.0 documents, such as most 
+control characters. The default escaping formatter in the XML output mode. 
+See Manager.SetOutputMode.
+
+Example:
+
+	<loc>{url|xml}</loc>
+
+If url is "/?a=1&b=2", the output will be "<loc>/?a=1&amp;b=2</loc>".
+*/
+func XMLFormatter(w io.Writer, formatter string, data ...interface{}) {
+	var buf bytes.Buffer
+	for _, rune := range string(getBytes(data...)) {
+		switch {
+		case rune == '&':
+			buf.WriteString("&amp;")
+		case rune == '<':
+			buf.WriteString("&lt;")
+		case rune == '>':
+			buf.WriteString("&gt;")
+		case rune == '"':
+			buf.WriteString("&quot;")
+		case rune == '\'':
+			buf.WriteString("&apos;")
+		case isXMLChar(rune):
+			buf.WriteRune(rune)
+		}
+	}
+	w.Write(buf.Bytes())
+}
+
+// isXMLChar returns true if rune is allowed in XML 1.0 documents.
+func isXMLChar(rune int) bool {
+	return rune == '\t' || rune == '\n' || rune == '\r' ||
+		rune >= 0x20 && rune <= 0xD7FF ||
+		rune >= 0xE000 && rune <= 0xFFFD ||
+		rune >= 0x10000 && rune <= 0x10FFFF
+}
+
+// ValidateXML returns an error if s is not a well-formed XML document, 
+// for checking the output of templates in the XML output mode in tests, 
+// for example.
+func ValidateXML(s string) os.Error {
+	p := xml.NewParser(strings.NewReader(s))
+	for {
+		_, err := p.Token()
+		if err == os.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	panic("unreachable")
+}
+
+// formatterArg returns the argument of a formatter from the name it is 
+// called with, like "72" for "wrap:72", or "" if there is none.
+func formatterArg(formatter string) string {
+	if i := strings.Index(formatter, ":"); i >= 0 {
+		return formatter[i+1:]
+	}
+	return ""
+}
+
+// intArg returns the argument of a formatter as a positive integer, or def 
+// if there is no valid argument.
+func intArg(formatter string, def int) int {
+	n, err := strconv.Atoi(formatterArg(formatter))
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
+
 // Returns a byte slice of the (first) field value.
 func getBytes(data ...interface{}) (b []byte) {
 	ok := false
@@ -0,0 +1,72 @@
+// neste template engine: template groups
+
+package neste
+
+import (
+	"fmt"
+	"os"
+)
+
+// Group is a named set of templates in a template manager.
+// The templates of a group are stored in the manager with their identifiers
+// or filenames prefixed with the name of the group and a slash, so that
+// the template files of a group are in a subdirectory of the base directory
+// named after the group. Templates in different groups may thus have the
+// same names.
+// Templates in a group resolve their includes and extends within the group
+// first, and then in the whole template manager. Groups share the
+// formatters and settings of their template manager.
+type Group struct {
+	m    *Manager
+	name string
+}
+
+// Name returns the name of the group.
+func (g *Group) Name() string {
+	return g.name
+}
+
+// Add is like Manager.Add, but adds the template to the group.
+func (g *Group) Add(s string, id string) (*Template, os.Error) {
+	return g.m.Add(s, g.key(id))
+}
+
+// AddFile is like Manager.AddFile, but adds the template file in
+// the directory of the group to the group.
+func (g *Group) AddFile(filename string) (*Template, os.Error) {
+	return g.m.AddFile(g.key(filename))
+}
+
+// Get returns a template of the group with the given identifier
+// or nil if it doesn't exist.
+func (g *Group) Get(id string) *Template {
+	return g.m.Get(g.key(id))
+}
+
+// GetFile returns a template file of the group with the given filename
+// or nil if it doesn't exist.
+func (g *Group) GetFile(filename string) *Template {
+	return g.m.GetFile(g.key(filename))
+}
+
+// Lookup returns a template with the given identifier or filename in
+// the group, or in the template manager if the group has none.
+// Ok is false if there is no such template.
+func (g *Group) Lookup(name string) (t *Template, ok bool) {
+	return g.m.lookupIn(g.name, name)
+}
+
+// Render looks up a template like Lookup and renders it with the given data.
+// If any errors occur, output will be empty string "" and err will be non-nil.
+func (g *Group) Render(name string, data interface{}) (string, os.Error) {
+	t, ok := g.Lookup(name)
+	if !ok {
+		return "", fmt.Errorf("neste: no template %s in group %s", name, g.name)
+	}
+	return t.Render(data)
+}
+
+// key returns the name of a template of the group in the template manager.
+func (g *Group) key(name string) string {
+	return g.name + "/" + name
+}
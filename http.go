@@ -0,0 +1,364 @@
+// neste template engine: serving templates over HTTP
+
+package neste
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"fmt"
+	"http"
+	"io"
+	"os"
+	"path"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Handler returns an HTTP handler that executes the template with the given 
+// identifier or filename, with the data returned by dataFn for the request. 
+// A nil dataFn executes the template with nil data.
+// The template is executed with ExecuteHTTP, so that if looking up the 
+// template, calling dataFn or executing the template fails, the error is 
+// logged with the logger of the template manager, and an Internal Server 
+// Error response is sent instead of a partial page. See SetLogger.
+// Under RecoverHandler, the error page of RecoverHandler is sent instead.
+// The template is looked up on every request, so that templates added or 
+// reloaded later are served.
+func (m *Manager) Handler(name string,
+dataFn func(*http.Request) (interface{}, os.Error)) http.Handler {
+	return http.HandlerFunc(m.HandlerFunc(name, dataFn))
+}
+
+// HandlerFunc is like Handler, but returns a function that can be passed 
+// to http.HandleFunc.
+func (m *Manager) HandlerFunc(name string,
+dataFn func(*http.Request) (interface{}, os.Error)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		err := m.serve(w, req, name, dataFn)
+		if rw, ok := w.(*recoverWriter); ok && err != nil {
+			// Let RecoverHandler send the error page.
+			rw.err = err
+			return
+		}
+		if err != nil {
+			m.logf(LogError, "neste: %s: %s", name, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError)
+		}
+	}
+}
+
+// ErrorPage is the data of error pages rendered by RecoverHandler.
+type ErrorPage struct {
+	Status  int         // HTTP status code
+	Message string      // Status text
+	Error   interface{} // Panic value or error, in development mode only
+	Stack   string      // Stack trace of a panic, in development mode only
+}
+
+// RecoverHandler returns an HTTP handler that serves requests with next, 
+// and if next panics or the template of a Manager.Handler fails, responds 
+// with the error template rendered with an *ErrorPage instead.
+// The panic value or error, and the stack trace of a panic, are included in 
+// the ErrorPage only in development mode (dev is true). Either way they are 
+// logged with the logger of the template manager. If the error template 
+// can't be rendered, a plain text error is sent instead. Nothing is sent if 
+// next has already started the response.
+func (m *Manager) RecoverHandler(next http.Handler, errorTemplate string, dev bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rw := &recoverWriter{ResponseWriter: w}
+		defer func() {
+			if v := recover(); v != nil {
+				m.logf(LogError, "neste: panic serving %s: %v", req.URL.Path, v)
+				m.serveError(rw, errorTemplate, dev, v, string(debug.Stack()))
+			}
+		}()
+
+		next.ServeHTTP(rw, req)
+		if rw.err != nil {
+			m.logf(LogError, "neste: error serving %s: %s", req.URL.Path, rw.err)
+			m.serveError(rw, errorTemplate, dev, rw.err, "")
+		}
+	})
+}
+
+// GetFileForURL returns the template file served at the given URL path, 
+// whose filename is the cleaned path after the prefix set with 
+// SetBaseURLPrefix, or nil if there is no such template file. Paths 
+// without the prefix, or referring outside the base directory after it, 
+// like "/templates/../../etc/passwd", have no template files.
+func (m *Manager) GetFileForURL(urlPath string) *Template {
+	if !strings.HasPrefix(urlPath, m.urlPrefix+"/") {
+		return nil
+	}
+	return m.GetFile(path.Clean(urlPath[len(m.urlPrefix)+1:]))
+}
+
+// ExecuteHTTP executes the template with the given data into a buffer, and 
+// then writes it as the response to w with the given status code and 
+// Content-Type, setting Content-Length to the size of the output.
+// If any errors occur when executing, nothing is written to w and err will 
+// be non-nil, so that the caller can send an error page instead.
+func (t *Template) ExecuteHTTP(w http.ResponseWriter, status int, contentType string,
+data interface{}) (err os.Error) {
+	buf := new(bytes.Buffer)
+	err = t.Execute(buf, data)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	_, err = w.Write(buf.Bytes())
+	return
+}
+
+// serve executes the template of a handler for a request into w.
+func (m *Manager) serve(w http.ResponseWriter, req *http.Request, name string,
+dataFn func(*http.Request) (interface{}, os.Error)) (err os.Error) {
+	t, ok := m.Lookup(name)
+	if !ok {
+		return os.NewError("template not found")
+	}
+
+	var data interface{}
+	if dataFn != nil {
+		data, err = dataFn(req)
+		if err != nil {
+			return
+		}
+	}
+
+	return t.ExecuteHTTP(w, http.StatusOK, "text/html; charset=utf-8", data)
+}
+
+// ExecuteGzip executes the template with the given data into w, compressed 
+// with gzip if the request r accepts it. Content-Encoding is then set to gzip, 
+// and Vary to Accept-Encoding in any case. Content-Type is set to HTML, 
+// unless already set.
+// The output is written as it is generated, so that if any errors occur, 
+// err will be non-nil and the response is incomplete. The gzip stream is 
+// closed even then.
+func (t *Template) ExecuteGzip(w http.ResponseWriter, r *http.Request,
+data interface{}) (err os.Error) {
+	w.Header().Set("Vary", "Accept-Encoding")
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	if !acceptsGzip(r) {
+		return t.Execute(w, data)
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	gz, err := gzip.NewWriter(w)
+	if err != nil {
+		return
+	}
+	defer func() {
+		cerr := gz.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+
+	return t.Execute(gz, data)
+}
+
+// acceptsGzip returns true if the Accept-Encoding header of the request r 
+// allows gzip encoding.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",", -1) {
+		params := strings.Split(enc, ";", -1)
+		coding := strings.TrimSpace(params[0])
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.Replace(param, " ", "", -1)
+			if strings.HasPrefix(param, "q=") && strings.Trim(param[2:], "0.") == "" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Stage is a part of a page rendered by ExecuteProgressive: the template 
+// with the identifier or filename Name, executed with the data returned by 
+// Data. A nil Data executes the template with nil data.
+type Stage struct {
+	Name string
+	Data func() (interface{}, os.Error)
+}
+
+// ExecuteProgressive renders the stages in order and writes each of them to 
+// w as soon as it is rendered, flushing w after each stage if it implements 
+// http.Flusher. This way the output of the first stages, such as the header 
+// and navigation of a page, is sent while the data of the later stages is 
+// still being computed. Content-Type is set to HTML, unless already set.
+// If any errors occur, err will be non-nil and the failed stage is not 
+// written. If some stages were written already, the error can only be 
+// reported in the response itself, by writing the fragment set with 
+// SetStageErrorFragment after them.
+func (m *Manager) ExecuteProgressive(w http.ResponseWriter, stages []Stage) (err os.Error) {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+
+	flusher, _ := w.(http.Flusher)
+	for i, stage := range stages {
+		buf := new(bytes.Buffer)
+		err = m.executeStage(buf, stage)
+		if err != nil {
+			if i > 0 {
+				io.WriteString(w, m.stageError)
+			}
+			return fmt.Errorf("neste: stage %s: %s", stage.Name, err)
+		}
+
+		_, err = w.Write(buf.Bytes())
+		if err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	return
+}
+
+// executeStage executes the template of a stage of ExecuteProgressive.
+func (m *Manager) executeStage(w io.Writer, stage Stage) (err os.Error) {
+	t, ok := m.Lookup(stage.Name)
+	if !ok {
+		return os.NewError("template not found")
+	}
+
+	var data interface{}
+	if stage.Data != nil {
+		data, err = stage.Data()
+		if err != nil {
+			return
+		}
+	}
+	return t.Execute(w, data)
+}
+
+// httpTimeFormat is the format of times in HTTP headers.
+const httpTimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// ServeConditional writes the template as the response to the request r 
+// like Manager.Handler, with an ETag and, for template files, a Last-Modified 
+// header. If the request's If-None-Match or If-Modified-Since header shows 
+// that the client has the current output, the response is 304 Not Modified 
+// without a body, and the template isn't executed.
+// The ETag is computed from the source of the template and dataVersion, 
+// which should describe the version of the data, so that different data 
+// gives different ETags. The Last-Modified time is the modified time of the 
+// template file, or of any template it extends if later. When the template 
+// is reloaded, they change with it.
+// If any errors occur, nothing is written to w and err will be non-nil.
+func (t *Template) ServeConditional(w http.ResponseWriter, r *http.Request, data interface{},
+dataVersion string) (err os.Error) {
+	if reloading, _ := t.m.reloadMode(); (t.fi != nil || t.parent != nil) && reloading {
+		err = t.Reload()
+		if err != nil {
+			return
+		}
+	}
+
+	t.m.mu.RLock()
+	src, mtime := t.source, t.modTime()/1e9
+	t.m.mu.RUnlock()
+	hash := sha1.New()
+	fmt.Fprintf(hash, "%s\x00%d\x00%s", src, mtime, dataVersion)
+	etag := fmt.Sprintf(`"%x"`, hash.Sum())
+
+	w.Header().Set("ETag", etag)
+	if mtime > 0 {
+		w.Header().Set("Last-Modified", time.SecondsToUTC(mtime).Format(httpTimeFormat))
+	}
+	if notModified(r, etag, mtime) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	err = t.ExecuteHTTP(w, http.StatusOK, "text/html; charset=utf-8", data)
+	if err != nil {
+		w.Header().Del("ETag")
+		w.Header().Del("Last-Modified")
+	}
+	return
+}
+
+// notModified returns true if the validators of the request r show that 
+// the client has the output with the given ETag and modified time in seconds, 
+// 0 if unknown. If-None-Match takes priority over If-Modified-Since.
+func notModified(r *http.Request, etag string, mtime int64) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, tag := range strings.Split(match, ",", -1) {
+			tag = strings.TrimSpace(tag)
+			if tag == etag || tag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+
+	if since := r.Header.Get("If-Modified-Since"); since != "" && mtime > 0 {
+		t, err := time.Parse(httpTimeFormat, since)
+		return err == nil && mtime <= t.Seconds()
+	}
+	return false
+}
+
+// recoverWriter is the response writer of RecoverHandler. It records 
+// whether the response has been started, and the error of a Manager.Handler.
+type recoverWriter struct {
+	http.ResponseWriter
+	started bool
+	err     os.Error
+}
+
+func (w *recoverWriter) WriteHeader(status int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recoverWriter) Write(b []byte) (int, os.Error) {
+	w.started = true
+	return w.ResponseWriter.Write(b)
+}
+
+// serveError responds with the error template for the panic value or 
+// error v of RecoverHandler.
+func (m *Manager) serveError(w *recoverWriter, errorTemplate string, dev bool, v interface{},
+stack string) {
+	if w.started {
+		return
+	}
+
+	page := &ErrorPage{
+		Status:  http.StatusInternalServerError,
+		Message: http.StatusText(http.StatusInternalServerError)}
+	if dev {
+		page.Error = v
+		page.Stack = stack
+	}
+
+	if t, ok := m.Lookup(errorTemplate); ok {
+		err := t.ExecuteHTTP(w.ResponseWriter, page.Status, "text/html; charset=utf-8", page)
+		if err == nil {
+			return
+		}
+		m.logf(LogError, "neste: %s: %s", errorTemplate, err)
+	} else {
+		m.logf(LogError, "neste: %s: template not found", errorTemplate)
+	}
+	http.Error(w.ResponseWriter, page.Message, page.Status)
+}
@@ -0,0 +1,331 @@
+package neste
+
+import (
+	. "launchpad.net/gocheck"
+	"compress/gzip"
+	"fmt"
+	"http"
+	"http/httptest"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// serveRecorded serves a GET request for path with h and returns 
+// the recorded response.
+func serveRecorded(c *C, h http.Handler, path string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", "http://example.com"+path, nil)
+	c.Assert(err, IsNil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func (s *S) TestHandler(c *C) {
+	tm := New(baseDir, nil)
+	tm.MustAdd("<h1>{Title}</h1>", "page")
+	dataFn := func(req *http.Request) (interface{}, os.Error) {
+		return map[string]string{"Title": req.URL.Path}, nil
+	}
+
+	rec := serveRecorded(c, tm.Handler("page", dataFn), "/hello")
+	c.Check(rec.Code, Equals, http.StatusOK)
+	c.Check(rec.HeaderMap.Get("Content-Type"), Equals, "text/html; charset=utf-8")
+	c.Check(rec.Body.String(), Equals, "<h1>/hello</h1>")
+
+	tm.MustAdd("<h1>neste</h1>", "static")
+	rec = serveRecorded(c, http.HandlerFunc(tm.HandlerFunc("static", nil)), "/")
+	c.Check(rec.Code, Equals, http.StatusOK)
+	c.Check(rec.Body.String(), Equals, "<h1>neste</h1>")
+}
+
+func (s *S) TestHandlerErrors(c *C) {
+	tm := New(baseDir, nil)
+	tm.MustAdd("<h1>{Title}</h1>", "page")
+	failing := func(req *http.Request) (interface{}, os.Error) {
+		return nil, os.NewError("no data")
+	}
+	noTitle := func(req *http.Request) (interface{}, os.Error) {
+		return &struct{ Name string }{"x"}, nil
+	}
+
+	for _, h := range []http.Handler{
+		tm.Handler("page", failing),
+		tm.Handler("page", noTitle),
+		tm.Handler("missing", nil),
+	} {
+		rec := serveRecorded(c, h, "/")
+		c.Check(rec.Code, Equals, http.StatusInternalServerError)
+		c.Check(strings.Contains(rec.Body.String(), "<h1>"), Equals, false)
+	}
+}
+
+// eventWriter is a response writer recording the calls made to it.
+type eventWriter struct {
+	header http.Header
+	events []string
+}
+
+func (w *eventWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *eventWriter) WriteHeader(status int) {
+	w.events = append(w.events, fmt.Sprintf("status %d %s %s", status,
+		w.header.Get("Content-Type"), w.header.Get("Content-Length")))
+}
+
+func (w *eventWriter) Write(b []byte) (int, os.Error) {
+	w.events = append(w.events, "body "+string(b))
+	return len(b), nil
+}
+
+func (s *S) TestExecuteHTTP(c *C) {
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("<p>{Name}</p>", "p")
+
+	w := &eventWriter{header: make(http.Header)}
+	err := t.ExecuteHTTP(w, http.StatusCreated, "text/xml", map[string]string{"Name": "neste"})
+	c.Assert(err, IsNil)
+	c.Check(w.events, DeepEquals, []string{
+		"status 201 text/xml 12",
+		"body <p>neste</p>",
+	})
+
+	w = &eventWriter{header: make(http.Header)}
+	err = t.ExecuteHTTP(w, http.StatusOK, "text/xml", &struct{ Title string }{})
+	c.Check(err, NotNil)
+	c.Check(w.events, IsNil)
+	c.Check(w.header, DeepEquals, make(http.Header))
+}
+
+func (s *S) TestServeConditional(c *C) {
+	dir := writeTemplates(c, map[string]string{"page.html": "<p>{Name}</p>"})
+	defer os.RemoveAll(dir)
+
+	tm := New(dir, nil)
+	tm.SetReloading(true)
+	t := tm.MustAddFile("page.html")
+	data := map[string]string{"Name": "neste"}
+	serve := func(header, value, dataVersion string) *httptest.ResponseRecorder {
+		h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if header != "" {
+				req.Header.Set(header, value)
+			}
+			c.Check(t.ServeConditional(w, req, data, dataVersion), IsNil)
+		})
+		return serveRecorded(c, h, "/")
+	}
+
+	// First request
+	rec := serve("", "", "v1")
+	c.Check(rec.Code, Equals, http.StatusOK)
+	c.Check(rec.Body.String(), Equals, "<p>neste</p>")
+	etag := rec.HeaderMap.Get("ETag")
+	lastModified := rec.HeaderMap.Get("Last-Modified")
+	c.Check(etag != "", Equals, true)
+	c.Check(lastModified != "", Equals, true)
+
+	// Matching ETag
+	rec = serve("If-None-Match", etag, "v1")
+	c.Check(rec.Code, Equals, http.StatusNotModified)
+	c.Check(rec.Body.Len(), Equals, 0)
+	c.Check(rec.HeaderMap.Get("ETag"), Equals, etag)
+
+	rec = serve("If-None-Match", etag, "v2")
+	c.Check(rec.Code, Equals, http.StatusOK)
+	c.Check(rec.HeaderMap.Get("ETag") != etag, Equals, true)
+
+	// If-Modified-Since
+	rec = serve("If-Modified-Since", lastModified, "v1")
+	c.Check(rec.Code, Equals, http.StatusNotModified)
+	rec = serve("If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT", "v1")
+	c.Check(rec.Code, Equals, http.StatusOK)
+
+	// Stale ETag after touching the file
+	filename := path.Join(dir, "page.html")
+	err := ioutil.WriteFile(filename, []byte("<h1>{Name}</h1>"), 0644)
+	c.Assert(err, IsNil)
+	mtime := getMtime(filename) + 10e9
+	c.Assert(os.Chtimes(filename, mtime, mtime), IsNil)
+
+	rec = serve("If-None-Match", etag, "v1")
+	c.Check(rec.Code, Equals, http.StatusOK)
+	c.Check(rec.Body.String(), Equals, "<h1>neste</h1>")
+	c.Check(rec.HeaderMap.Get("ETag") != etag, Equals, true)
+	rec = serve("If-Modified-Since", lastModified, "v1")
+	c.Check(rec.Code, Equals, http.StatusOK)
+	c.Check(rec.HeaderMap.Get("Last-Modified") != lastModified, Equals, true)
+}
+
+func (s *S) TestExecuteGzip(c *C) {
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("{.repeated section items}<p>{@}</p>\n{.end}", "list")
+	data := map[string]interface{}{"items": strings.Split(strings.Repeat("neste,", 100), ",", -1)}
+	expected, err := t.Render(data)
+	c.Assert(err, IsNil)
+
+	serve := func(acceptEncoding string) *httptest.ResponseRecorder {
+		h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+			c.Check(t.ExecuteGzip(w, req, data), IsNil)
+		})
+		return serveRecorded(c, h, "/")
+	}
+
+	rec := serve("deflate, gzip")
+	c.Check(rec.HeaderMap.Get("Content-Encoding"), Equals, "gzip")
+	c.Check(rec.HeaderMap.Get("Vary"), Equals, "Accept-Encoding")
+	c.Check(rec.HeaderMap.Get("Content-Type"), Equals, "text/html; charset=utf-8")
+	c.Check(rec.Body.Len() < len(expected), Equals, true)
+	gz, err := gzip.NewReader(rec.Body)
+	c.Assert(err, IsNil)
+	output, err := ioutil.ReadAll(gz)
+	c.Assert(err, IsNil)
+	c.Check(string(output), Equals, expected)
+
+	// Clients without gzip support get plain output.
+	for _, acceptEncoding := range []string{"", "deflate", "gzip;q=0"} {
+		rec = serve(acceptEncoding)
+		c.Check(rec.HeaderMap.Get("Content-Encoding"), Equals, "")
+		c.Check(rec.HeaderMap.Get("Vary"), Equals, "Accept-Encoding")
+		c.Check(rec.Body.String(), Equals, expected)
+	}
+}
+
+func (s *S) TestRecoverHandler(c *C) {
+	tm := New(baseDir, nil)
+	tm.MustAdd("<h1>{Status} {Message}</h1>"+
+		"{.section Error}<pre>{@}</pre>{.end}"+
+		"{.section Stack}<pre>stack</pre>{.end}", "error")
+	tm.MustAdd("<h1>{Missing}</h1>", "badError")
+	tm.MustAdd("<h1>{Title}</h1>", "page")
+	tm.MustAdd("<h1>neste</h1>", "static")
+
+	panicking := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Test", "yes")
+		panic("oops")
+	})
+	failing := tm.Handler("page", func(req *http.Request) (interface{}, os.Error) {
+		return nil, os.NewError("no data")
+	})
+
+	// Production
+	rec := serveRecorded(c, tm.RecoverHandler(panicking, "error", false), "/")
+	c.Check(rec.Code, Equals, http.StatusInternalServerError)
+	c.Check(rec.HeaderMap.Get("Content-Type"), Equals, "text/html; charset=utf-8")
+	c.Check(rec.Body.String(), Equals, "<h1>500 Internal Server Error</h1>")
+
+	rec = serveRecorded(c, tm.RecoverHandler(failing, "error", false), "/")
+	c.Check(rec.Code, Equals, http.StatusInternalServerError)
+	c.Check(rec.Body.String(), Equals, "<h1>500 Internal Server Error</h1>")
+
+	// Development
+	rec = serveRecorded(c, tm.RecoverHandler(panicking, "error", true), "/")
+	c.Check(rec.Code, Equals, http.StatusInternalServerError)
+	c.Check(rec.Body.String(), Equals,
+		"<h1>500 Internal Server Error</h1><pre>oops</pre><pre>stack</pre>")
+
+	rec = serveRecorded(c, tm.RecoverHandler(failing, "error", true), "/")
+	c.Check(rec.Body.String(), Equals,
+		"<h1>500 Internal Server Error</h1><pre>no data</pre>")
+
+	// Failing error templates fall back to plain text.
+	for _, name := range []string{"badError", "missing"} {
+		rec = serveRecorded(c, tm.RecoverHandler(panicking, name, true), "/")
+		c.Check(rec.Code, Equals, http.StatusInternalServerError)
+		c.Check(rec.Body.String(), Equals, "Internal Server Error\n")
+	}
+
+	// Successful requests pass through.
+	ok := tm.Handler("static", nil)
+	rec = serveRecorded(c, tm.RecoverHandler(ok, "error", true), "/")
+	c.Check(rec.Code, Equals, http.StatusOK)
+	c.Check(rec.Body.String(), Equals, "<h1>neste</h1>")
+}
+
+// flushRecorder is a ResponseRecorder recording the body at each flush.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed []string
+}
+
+func (r *flushRecorder) Flush() {
+	r.flushed = append(r.flushed, r.Body.String())
+}
+
+func (s *S) TestExecuteProgressive(c *C) {
+	tm := New(baseDir, nil)
+	tm.MustAdd("<head>{title}</head>", "head")
+	tm.MustAdd("<body>{body}</body>", "body")
+	tm.MustAdd("<footer></footer>", "footer")
+
+	rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	var flushedBeforeBody []string
+	err := tm.ExecuteProgressive(rec, []Stage{
+		{"head", func() (interface{}, os.Error) {
+			return map[string]string{"title": "Title"}, nil
+		}},
+		{"body", func() (interface{}, os.Error) {
+			// The earlier stages are sent before the data of later ones.
+			flushedBeforeBody = append(flushedBeforeBody, rec.flushed...)
+			return map[string]string{"body": "Body"}, nil
+		}},
+		{"footer", nil},
+	})
+	c.Assert(err, IsNil)
+	c.Check(flushedBeforeBody, DeepEquals, []string{"<head>Title</head>"})
+	c.Check(rec.flushed, DeepEquals, []string{
+		"<head>Title</head>",
+		"<head>Title</head><body>Body</body>",
+		"<head>Title</head><body>Body</body><footer></footer>"})
+	c.Check(rec.HeaderMap.Get("Content-Type"), Equals, "text/html; charset=utf-8")
+
+	// Errors after the first stage are reported in the response.
+	tm.SetStageErrorFragment("<p>Error</p>")
+	failing := func() (interface{}, os.Error) { return nil, os.NewError("no data") }
+
+	rec = &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	err = tm.ExecuteProgressive(rec, []Stage{{"head", failing}, {"footer", nil}})
+	c.Check(err, ErrorMatches, "neste: stage head: no data")
+	c.Check(rec.Body.String(), Equals, "")
+
+	rec = &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	err = tm.ExecuteProgressive(rec, []Stage{{"footer", nil}, {"body", failing}, {"footer", nil}})
+	c.Check(err, ErrorMatches, "neste: stage body: no data")
+	c.Check(rec.Body.String(), Equals, "<footer></footer><p>Error</p>")
+
+	rec = &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	err = tm.ExecuteProgressive(rec, []Stage{{"footer", nil}, {"missing", nil}})
+	c.Check(err, ErrorMatches, "neste: stage missing: template not found")
+	c.Check(rec.Body.String(), Equals, "<footer></footer><p>Error</p>")
+}
+
+func (s *S) TestGetFileForURL(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"base/index.html":     "index",
+		"base/blog/post.html": "post",
+		"secret.html":         "secret"})
+	defer os.RemoveAll(dir)
+
+	tm := New(path.Join(dir, "base"), nil)
+	tm.MustAddFile("index.html")
+	tPost := tm.MustAddFile("blog/post.html")
+	_, err := tm.AddFileOutsideBaseDir("../secret.html")
+	c.Assert(err, IsNil)
+
+	c.Check(tm.GetFileForURL("/blog/post.html"), Equals, tPost)
+	tm.SetBaseURLPrefix("/templates/")
+	c.Check(tm.GetFileForURL("/templates/blog/post.html"), Equals, tPost)
+	c.Check(tm.GetFileForURL("/templates/blog/../blog/post.html"), Equals, tPost)
+	c.Check(tm.GetFileForURL("/blog/post.html"), IsNil)
+	c.Check(tm.GetFileForURL("/templatesblog/post.html"), IsNil)
+	c.Check(tm.GetFileForURL("/templates/missing.html"), IsNil)
+
+	// Paths outside the base directory
+	c.Check(tm.GetFileForURL("/templates/../secret.html"), IsNil)
+	c.Check(tm.GetFileForURL("/templates/blog/../../secret.html"), IsNil)
+	c.Check(tm.GetFileForURL("/templates/../../etc/passwd"), IsNil)
+	c.Check(tm.GetFileForURL("/templates//etc/passwd"), IsNil)
+}
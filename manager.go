@@ -2,46 +2,276 @@ package neste
 
 import (
 	"template"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"json"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Manager is a type that represents a template manager.
 type Manager struct {
-	fmap      template.FormatterMap
-	baseDir   string
-	tStrings  map[string]*Template // Templates for strings
-	tFiles    map[string]*Template // Templates for files
-	ldelim    string
-	rdelim    string
-	reloading bool
+	fmap              template.FormatterMap
+	baseDir           string
+	tStrings          map[string]*Template // Templates for strings
+	tFiles            map[string]*Template // Templates for files
+	ldelim            string
+	rdelim            string
+	reloading         bool
+	reloadStrategy    ReloadStrategy
+	watchInterval     int64        // Polling interval of background reloading in nanoseconds
+	stopWatch         chan bool    // Closed to stop background reloading
+	mu                sync.RWMutex // Guards the templates and the reloading mode
+	maxSize           int64        // Maximum template file size in bytes, 0 if unlimited
+	timeout           int64        // Template file read timeout in nanoseconds, 0 if none
+	cacheDuration     int64        // Time after which template files are reparsed, 0 if never
+	minReloadInterval int64        // Minimum time between checks for modifications
+	strict            bool
+	clock             func() *time.Time                        // Returns the current time
+	dateFormat        string                                   // Default layout for formatting times
+	catalogs          map[string]map[string]*template.Template // Messages by locale
+	locale            string                                   // Default locale
+	autoEscape        bool
+	frozen            bool
+	readOnly          bool
+	groups            map[string]*Group
+	partials          map[string]*Template // Partials by their bare names
+	partialDir        string
+	overwrite         bool // Whether InheritFormatters overwrites formatters
+	notFound          func(name string) func(io.Writer, string, ...interface{})
+	outputExts        map[string]string // Output file extensions for RenderAll
+	stageError        string            // Written when a stage of ExecuteProgressive fails
+	templateExts      []string          // Extensions tried by GetFile
+	text              bool              // Whether created with NewText
+	outputMode        int
+	logger            func(level int, format string, args ...interface{})
+	traceBegin        func(name string) interface{}
+	traceEnd          func(name string, token interface{}, err os.Error, bytes int, ns int64)
+	engines           map[string]Engine                          // Engines of template files by filename
+	plurals           map[string]map[string][]*template.Template // Plural messages by locale
+	rules             map[string]func(n int) int                 // Plural rules by locale
+	assets            map[string]string                          // Asset URLs by logical name
+	manifestPath      string                                     // Path of the asset manifest
+	staticPrefix      string                                     // URL prefix of static assets
+	urlPrefix         string                                     // URL path prefix of template files
+	symlinks          SymlinkPolicy
+	parallelism       int // Number of goroutines parsing added directories
+}
+
+// Log levels of the messages logged by template managers. See SetLogger.
+const (
+	LogDebug = iota
+	LogInfo
+	LogWarning
+	LogError
+)
+
+// ReloadStrategy is a type for the strategies of reloading template files.
+// See SetReloadStrategy.
+type ReloadStrategy int
+
+// Reload strategies
+const (
+	ReloadNone       ReloadStrategy = iota // Template files are not reloaded
+	ReloadEager                            // Reloaded when executed
+	ReloadLazy                             // Reloaded when executed at the top level
+	ReloadBackground                       // Reloaded by polling in the background
+)
+
+// SymlinkPolicy is a type for the policies of handling symbolic links 
+// when adding directories. See SetSymlinkPolicy.
+type SymlinkPolicy int
+
+// Symlink policies
+const (
+	SymlinkFollow SymlinkPolicy = iota // Symbolic links are followed
+	SymlinkSkip                        // Symbolic links are skipped
+	SymlinkError                       // Symbolic links are errors
+)
+
+// Output modes of template managers. See SetOutputMode.
+const (
+	ModeHTML = iota
+	ModeXML
+)
+
+// Ref is a type for referring to a template by its identifier or filename 
+// in the data of a RenderNested plan.
+type Ref string
+
+// ErrFrozen is the error returned when adding templates to a frozen 
+// template manager, and logged when removing templates from it. 
+// See Freeze.
+var ErrFrozen = os.NewError("neste: template manager is frozen")
+
+// ErrReadOnly is the error returned when adding templates to a read-only 
+// template manager, and logged when removing templates from it. 
+// See SetReadOnly.
+var ErrReadOnly = os.NewError("neste: template manager is read-only")
+
+// JSONError is the error returned by RenderWithJSON for data that isn't 
+// valid JSON, as opposed to errors of the template.
+type JSONError struct {
+	Filename string   // Name of the JSON file, "" for readers
+	Line     int      // Line of the syntax error, 0 if unknown
+	Err      os.Error // Error of the json package
+}
+
+func (e *JSONError) String() string {
+	name := e.Filename
+	if name == "" {
+		name = "JSON data"
+	}
+	if e.Line > 0 {
+		return fmt.Sprintf("neste: %s:%d: %s", name, e.Line, e.Err)
+	}
+	return fmt.Sprintf("neste: %s: %s", name, e.Err)
+}
+
+// FileError is the error returned when a template file can't be read or 
+// parsed, when adding or reloading it for example.
+type FileError struct {
+	Op       string   // "stat", "read" or "parse"
+	Filename string   // Filename of the template file
+	Path     string   // Absolute path of the template file
+	Err      os.Error // Error of the operation
+}
+
+func (e *FileError) String() string {
+	msg := e.Err.String()
+	if strings.HasPrefix(msg, "neste: ") {
+		msg = msg[len("neste: "):]
+	}
+	return fmt.Sprintf("neste: %s: %s %s: %s", e.Filename, e.Op, e.Path, msg)
+}
+
+// UnsafePathError is the error returned for template filenames that are 
+// absolute or refer outside the base directory.
+type UnsafePathError struct {
+	Filename string
+}
+
+func (e *UnsafePathError) String() string {
+	return fmt.Sprintf("neste: template filename %q is outside the base directory", e.Filename)
+}
+
+// RenderErrors is the error returned by RenderAll when some of the 
+// templates fail. It maps template names to their errors.
+type RenderErrors map[string]os.Error
+
+func (e RenderErrors) String() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.SortStrings(names)
+
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("%s: %s", name, e[name])
+	}
+	return "neste: rendering failed: " + strings.Join(msgs, "; ")
+}
+
+// openFile opens the named file for reading.
+var openFile = func(name string) (io.ReadCloser, os.Error) {
+	return os.Open(name)
 }
 
 // Returns a new template manager with base directory baseDir 
 // for template files.
 func New(baseDir string, fmap template.FormatterMap) *Manager {
+	return newManager(baseDir, fmap, builtinFormatters)
+}
+
+// NewText returns a new template manager for plain text output, like CSV 
+// files and plain text email, with base directory baseDir for template files.
+// Instead of the HTML oriented built-in formatters, its templates have 
+// formatters for text, such as csv, wrap, ljust and rjust. The html 
+// formatter of the template package is not available either, and automatic 
+// escaping can't be enabled.
+func NewText(baseDir string, fmap template.FormatterMap) *Manager {
+	m := newManager(baseDir, fmap, textFormatters)
+	m.text = true
+	return m
+}
+
+// newManager returns a new template manager with the given built-in 
+// formatters.
+func newManager(baseDir string, fmap, builtins template.FormatterMap) *Manager {
 	// Add each built-in formatter unless there's 
 	// a user given formatter with same name already.
 	if fmap != nil {
-		for k, v := range builtinFormatters {
+		for k, v := range builtins {
 			_, present := fmap[k]
 			if !present {
 				fmap[k] = v
 			}
 		}
 	} else {
-		fmap = builtinFormatters
+		// Copy the built-in formatters, so that adding formatters to 
+		// the manager doesn't affect other managers.
+		fmap = make(template.FormatterMap, len(builtins))
+		for k, v := range builtins {
+			fmap[k] = v
+		}
 	}
 
 	return &Manager{
-		baseDir:   baseDir,
-		tStrings:  make(map[string]*Template),
-		tFiles:    make(map[string]*Template),
-		fmap:      fmap,
-		ldelim:    "{",
-		rdelim:    "}",
-		reloading: false}
+		baseDir:      baseDir,
+		tStrings:     make(map[string]*Template),
+		tFiles:       make(map[string]*Template),
+		engines:      make(map[string]Engine),
+		fmap:         fmap,
+		ldelim:       "{",
+		rdelim:       "}",
+		reloading:    false,
+		clock:        time.LocalTime,
+		dateFormat:   "2006-01-02",
+		staticPrefix: "/static/"}
+}
+
+// NewFromDir returns a new template manager with base directory dir, 
+// and all files in it and its subdirectories added as template files.
+// If any template fails to parse, the manager is returned with 
+// the templates added before it, and err is non-nil. See AddDir.
+func NewFromDir(dir string, fmap template.FormatterMap) (m *Manager, err os.Error) {
+	m = New(dir, fmap)
+	err = m.AddDir("")
+	return
+}
+
+// NewFromMap returns a new template manager with the templates of 
+// the given map of identifiers to template strings added to it.
+// The manager has no base directory for template files.
+// The templates are added in the order of their identifiers. If any of them 
+// fails to parse, the manager is returned with the templates added 
+// before it, and err is non-nil.
+func NewFromMap(templates map[string]string, fmap template.FormatterMap) (m *Manager,
+err os.Error) {
+	m = New("", fmap)
+
+	ids := make([]string, 0, len(templates))
+	for id := range templates {
+		ids = append(ids, id)
+	}
+	sort.SortStrings(ids)
+
+	for _, id := range ids {
+		_, err = m.Add(templates[id], id)
+		if err != nil {
+			return m, fmt.Errorf("neste: %s: %s", id, err)
+		}
+	}
+	return m, nil
 }
 
 // Add adds a given template string s to the template manager 
@@ -51,180 +281,2353 @@ func (m *Manager) Add(s string, id string) (*Template, os.Error) {
 	return m.add(s, id, false)
 }
 
+// AddAbsFile adds the template file at the absolute path fpath to the 
+// template manager with the filename key, for template files outside the 
+// base directory, like a footer shared by several applications. The 
+// template is reloaded from fpath like other template files.
+// Adding a template file with the filename of a template file added from 
+// another path fails, whichever of them is added first.
+// If any errors occur, returned error will be non-nil.
+func (m *Manager) AddAbsFile(fpath, key string) (*Template, os.Error) {
+	if !path.IsAbs(fpath) {
+		return nil, fmt.Errorf("neste: template file path %s is not absolute", fpath)
+	}
+	return m.addFileAt(key, path.Clean(fpath), false)
+}
+
+// AddBytes is like Add, but takes the identifier first and the template 
+// source as a byte slice, for templates that are already in memory, eg. 
+// read from a database.
+func (m *Manager) AddBytes(id string, content []byte) (*Template, os.Error) {
+	return m.add(string(content), id, false)
+}
+
+// AddDir adds all files in the given directory and their subdirectories 
+// to the template manager, like AddFile. Files in partials directories are 
+// added before the others, see SetPartialsDir.
+// If any errors occur, err will be non-nil. This includes the directory 
+// not existing, which is reported with its absolute path. Adding stops at 
+// the first template that can't be parsed, and the templates added before 
+// it remain.
+func (m *Manager) AddDir(dir string) (err os.Error) {
+	root, err := m.openDir(dir)
+	if err != nil {
+		return
+	}
+
+	v := &dirAdder{m: m, root: root}
+	filepath.Walk(root, v, nil)
+	v.add()
+	return v.err
+}
+
+// AddDirAll is like AddDir, but doesn't stop at templates that can't be 
+// parsed. It returns the errors of all templates that couldn't be added, 
+// prefixed with their filenames, or nil if all of them were added.
+func (m *Manager) AddDirAll(dir string) (errs []os.Error) {
+	root, err := m.openDir(dir)
+	if err != nil {
+		return []os.Error{err}
+	}
+
+	v := &dirAdder{m: m, root: root, all: true}
+	filepath.Walk(root, v, nil)
+	v.add()
+	return v.errs
+}
+
 // AddFile adds a given template file to the template manager.
+// The filename must be relative to the base directory and not refer 
+// outside it, like "../secret.html" does, or err will be an 
+// *UnsafePathError. See AddFileOutsideBaseDir.
 // If any errors occur, returned error will be non-nil. 
 func (m *Manager) AddFile(filename string) (*Template, os.Error) {
+	err := checkFilename(filename)
+	if err != nil {
+		return nil, err
+	}
 	return m.addFile(filename, false)
 }
 
-// Removes all templates from the template manager.
-// Useful for clearing out cached templates.
-// Clear returns true if one or more templates were removed, otherwise false.
-func (m *Manager) Clear() bool {
-	tlen := len(m.tStrings) + len(m.tFiles)
-	m.tStrings = make(map[string]*Template)
-	m.tFiles = make(map[string]*Template)
-	return tlen > 0
+// AddFileOutsideBaseDir is like AddFile, but allows filenames referring 
+// outside the base directory, like "../shared/footer.html". It should be 
+// used only with filenames that don't come from untrusted input.
+func (m *Manager) AddFileOutsideBaseDir(filename string) (*Template, os.Error) {
+	fpath := path.Join(m.baseDir, slashFilename(filename))
+	return m.addFileAt(filename, filepath.FromSlash(fpath), false)
 }
 
-// Returns a template with the given identifier or nil if it doesn't exist.
-func (m *Manager) Get(s string) *Template {
-	return m.tStrings[s]
+// AddFormatterAlias adds a formatter named alias, which is the same 
+// formatter as the existing one, like "esc" for "html".
+// Like other formatters, aliases must be added before the templates using 
+// them. If there is no formatter named existing, err will be non-nil.
+func (m *Manager) AddFormatterAlias(alias, existing string) (err os.Error) {
+	fn, present := m.fmap[existing]
+	if !present {
+		fn, present = templateFormatters[existing]
+	}
+	if !present {
+		return fmt.Errorf("neste: unknown formatter: %q", existing)
+	}
+	m.fmap[alias] = fn
+	return
 }
 
-// Returns a template with the given filename or nil if it doesn't exist.
-func (m *Manager) GetFile(filename string) *Template {
-	return m.tFiles[filename]
+// Apply updates the template manager to have the same templates as other.
+// Templates added from strings are reparsed from the sources in other, and 
+// replace the templates of m at once, only if all of them could be parsed.
+// Template files are added and removed to match other, and the remaining 
+// ones are reloaded from disk if they have been modified.
+// If any errors occur, err will be non-nil.
+func (m *Manager) Apply(other *Manager) (err os.Error) {
+	err = m.writable()
+	if err != nil {
+		return
+	}
+
+	// The sources of other's string templates, and whether its template 
+	// files are defined in other template files.
+	other.mu.RLock()
+	otherSources := make(map[string]string, len(other.tStrings))
+	for id, ot := range other.tStrings {
+		otherSources[id] = ot.source
+	}
+	otherFiles := make(map[string]bool, len(other.tFiles))
+	for filename, ot := range other.tFiles {
+		otherFiles[filename] = ot.parent != nil
+	}
+	other.mu.RUnlock()
+
+	tStrings := make(map[string]*Template, len(otherSources))
+	for id, src := range otherSources {
+		m.mu.RLock()
+		t, present := m.tStrings[id]
+		unchanged := present && t.source == src
+		m.mu.RUnlock()
+		if unchanged {
+			tStrings[id] = t
+			continue
+		}
+
+		var tt Executer
+		tt, err = m.parse(src, id, make(map[string]int64))
+		if err != nil {
+			return fmt.Errorf("neste: %s: %s", id, err)
+		}
+		tStrings[id] = &Template{
+			m:      m,
+			name:   id,
+			source: src,
+			cache:  tt,
+			email:  m.parseEmail(id, src)}
+	}
+	m.mu.Lock()
+	m.tStrings = tStrings
+	m.mu.Unlock()
+
+	for _, filename := range m.allFilenames() {
+		if _, present := otherFiles[filename]; !present {
+			m.RemoveFile(filename)
+		}
+	}
+	for filename, defined := range otherFiles {
+		if defined {
+			// Defined templates are added with their template files.
+			continue
+		}
+		m.mu.RLock()
+		t, present := m.tFiles[filename]
+		m.mu.RUnlock()
+		if present {
+			err = t.Reload()
+		} else {
+			_, err = m.addFile(filename, false)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
 }
 
-// MustAdd is like Add, but panics, if template can't be parsed. 
-func (m *Manager) MustAdd(s string, id string) *Template {
-	t, _ := m.add(s, id, true)
-	return t
+// AllFilenames returns the filenames of all template files in the template 
+// manager in sorted order, except for partials.
+func (m *Manager) AllFilenames() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.filenames()
 }
 
-// MustAddDir calls MustAddFile for all files in the given directory and their 
-// subdirectories to the template manager.
-// Panic occurs if any template can't be parsed. 
-func (m *Manager) MustAddDir(dir string) {
-	filepath.Walk(path.Join(m.baseDir, dir), m, nil)
+// filenames is like AllFilenames, but the caller holds the lock.
+func (m *Manager) filenames() []string {
+	filenames := make([]string, 0, len(m.tFiles))
+	for filename, t := range m.tFiles {
+		if t.partial == "" {
+			filenames = append(filenames, filename)
+		}
+	}
+	sort.SortStrings(filenames)
+	return filenames
 }
 
-// MustAddFile is like AddFile, but panics, if template can't be parsed. 
-func (m *Manager) MustAddFile(filename string) *Template {
-	t, _ := m.addFile(filename, true)
-	return t
+// AllIDs returns the identifiers of all templates added from strings to the 
+// template manager in sorted order.
+func (m *Manager) AllIDs() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.ids()
 }
 
-// Removes a template with the given identifier from the template manager.
-// Useful for clearing out cached templates.
-// It's safe to remove a non-existing template.
-// Remove returns true if a template was removed, otherwise false.
-func (m *Manager) Remove(s string) bool {
-	_, present := m.tStrings[s]
-	m.tStrings[s] = nil, false
-	return present
+// ids is like AllIDs, but the caller holds the lock.
+func (m *Manager) ids() []string {
+	ids := make([]string, 0, len(m.tStrings))
+	for id := range m.tStrings {
+		ids = append(ids, id)
+	}
+	sort.SortStrings(ids)
+	return ids
 }
 
-// Removes a template with the given filename from the template manager.
+// Removes all templates from the template manager.
 // Useful for clearing out cached templates.
-// It's safe to remove a non-existing template.
-// Remove returns true if a template was removed, otherwise false.
-func (m *Manager) RemoveFile(filename string) bool {
-	_, present := m.tFiles[filename]
-	m.tFiles[filename] = nil, false
-	return present
+// Clear returns true if one or more templates were removed, otherwise false.
+// Nothing is removed from a frozen or read-only template manager, and the 
+// error is logged.
+func (m *Manager) Clear() bool {
+	if !m.removable() {
+		return false
+	}
+	m.mu.Lock()
+	tlen := len(m.tStrings) + len(m.tFiles)
+	m.tStrings = make(map[string]*Template)
+	m.tFiles = make(map[string]*Template)
+	m.engines = make(map[string]Engine)
+	m.mu.Unlock()
+	m.logf(LogInfo, "neste: cleared %d templates", tlen)
+	return tlen > 0
 }
 
-// SetReloading sets the template file reloading mode.
-// When reloading mode is enabled, calls to GetFile method will trigger 
-// reparsing of the given template file if its modified time has changed.
-// Reloading is disabled (false) by default.
-func (m *Manager) SetReloading(reloading bool) {
-	m.reloading = reloading
-}
+// Compress normalizes the sources of all templates added from strings and 
+// reparses them. Line endings are converted to "\n" and trailing white space 
+// is removed from each line.
+// If any errors occur, err will be non-nil and the failed template is left
+// as it was.
+func (m *Manager) Compress() os.Error {
+	for _, t := range m.GetAll() {
+		m.mu.RLock()
+		old := t.source
+		m.mu.RUnlock()
+		src := compactSource(old)
+		if src == old {
+			continue
+		}
 
-// SetDelims sets the left and right delimiters for operations 
-// in the template for template parsing.
-func (m *Manager) SetDelims(left, right string) {
-	m.ldelim = left
-	m.rdelim = right
+		tt, err := m.parse(src, t.name, make(map[string]int64))
+		if err != nil {
+			return fmt.Errorf("neste: %s: %s", t.name, err)
+		}
+		email := m.parseEmail(t.name, src)
+		m.mu.Lock()
+		t.source = src
+		t.cache = tt
+		t.email = email
+		m.mu.Unlock()
+	}
+	return nil
 }
 
+// Copy returns an independent copy of the template manager, with the same 
+// configuration and templates. The formatter map is copied, and all 
+// templates are reparsed from their sources, so that the copy shares no 
+// state with the original. Templates extending other template files read 
+// them again. Loaded message catalogs are shared with the original.
+// Panic occurs if any template can't be reparsed, which can happen only if 
+// the files it extends have changed since it was parsed.
+func (m *Manager) Copy() *Manager {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	c := new(Manager)
+	c.assign(m)
+	c.stopWatch = nil
+	c.fmap = make(template.FormatterMap, len(m.fmap))
+	for k, v := range m.fmap {
+		c.fmap[k] = v
+	}
+	c.groups = make(map[string]*Group, len(m.groups))
+	for name := range m.groups {
+		c.groups[name] = &Group{c, name}
+	}
+	c.partials = make(map[string]*Template, len(m.partials))
+	c.tStrings = make(map[string]*Template, len(m.tStrings))
+	c.tFiles = make(map[string]*Template, len(m.tFiles))
+	c.engines = make(map[string]Engine, len(m.engines))
+	for filename, engine := range m.engines {
+		c.engines[filename] = engine
+	}
+	if m.catalogs != nil {
+		c.catalogs = make(map[string]map[string]*template.Template, len(m.catalogs))
+		for locale, catalog := range m.catalogs {
+			c.catalogs[locale] = catalog
+		}
+	}
+	if m.plurals != nil {
+		c.plurals = make(map[string]map[string][]*template.Template, len(m.plurals))
+		for locale, catalog := range m.plurals {
+			c.plurals[locale] = catalog
+		}
+	}
+	if m.rules != nil {
+		c.rules = make(map[string]func(n int) int, len(m.rules))
+		for locale, rule := range m.rules {
+			c.rules[locale] = rule
+		}
+	}
 
-// Unexported methods
+	for id, t := range m.tStrings {
+		c.add(t.source, id, true)
+	}
 
-// Add adds a given template string to the template manager.
-// If any errors occur, err will be non-nil. 
-func (m *Manager) add(s string, id string, mustParse bool) (t *Template,
-err os.Error) {
-	tt := template.New(m.fmap)
-	tt.SetDelims(m.ldelim, m.rdelim)
+	for filename, t := range m.tFiles {
+		if t.parent != nil {
+			// Defined templates are copied with their template files.
+			continue
+		}
 
-	// Parse the template.
-	if mustParse {
-		err := tt.Parse(s)
+		deps := make(map[string]int64)
+		tt, err := c.parseSource(t.source, filename, deps)
 		if err != nil {
 			panic(err)
 		}
-	} else {
-		err := tt.Parse(s)
+		defines, err := c.parseDefines(t.source, filename)
 		if err != nil {
-			return
+			panic(err)
+		}
+
+		fi := *t.fi
+		fi.deps = deps
+		ct := &Template{
+			m:      c,
+			name:   filename,
+			source: t.source,
+			cache:  tt,
+			fi:     &fi,
+			email:  c.parseEmail(filename, t.source)}
+		c.mu.Lock()
+		c.tFiles[filename] = ct
+		c.setDefines(ct, defines)
+		if t.partial != "" {
+			ct.partial = t.partial
+			c.partials[t.partial] = ct
 		}
+		c.mu.Unlock()
 	}
 
-	t = &Template{
-		m:     m,
-		cache: tt}
+	if c.reloadStrategy == ReloadBackground {
+		c.startWatch()
+	}
+	return c
+}
 
-	// Add template to the manager.
-	m.tStrings[id] = t
+// assign sets all fields of the template manager except its mutex to 
+// those of o.
+func (m *Manager) assign(o *Manager) {
+	m.fmap = o.fmap
+	m.baseDir = o.baseDir
+	m.tStrings = o.tStrings
+	m.tFiles = o.tFiles
+	m.ldelim = o.ldelim
+	m.rdelim = o.rdelim
+	m.reloading = o.reloading
+	m.reloadStrategy = o.reloadStrategy
+	m.watchInterval = o.watchInterval
+	m.stopWatch = o.stopWatch
+	m.maxSize = o.maxSize
+	m.timeout = o.timeout
+	m.cacheDuration = o.cacheDuration
+	m.minReloadInterval = o.minReloadInterval
+	m.strict = o.strict
+	m.clock = o.clock
+	m.dateFormat = o.dateFormat
+	m.catalogs = o.catalogs
+	m.locale = o.locale
+	m.autoEscape = o.autoEscape
+	m.frozen = o.frozen
+	m.readOnly = o.readOnly
+	m.groups = o.groups
+	m.partials = o.partials
+	m.partialDir = o.partialDir
+	m.overwrite = o.overwrite
+	m.notFound = o.notFound
+	m.outputExts = o.outputExts
+	m.stageError = o.stageError
+	m.templateExts = o.templateExts
+	m.text = o.text
+	m.outputMode = o.outputMode
+	m.logger = o.logger
+	m.traceBegin = o.traceBegin
+	m.traceEnd = o.traceEnd
+	m.engines = o.engines
+	m.plurals = o.plurals
+	m.rules = o.rules
+	m.assets = o.assets
+	m.manifestPath = o.manifestPath
+	m.staticPrefix = o.staticPrefix
+	m.urlPrefix = o.urlPrefix
+	m.symlinks = o.symlinks
+	m.parallelism = o.parallelism
+}
+
+// Diff compares the templates of the template manager with those of other.
+// It returns the names of the templates that are in other but not in m 
+// (added), in m but not in other (removed), and in both but with different 
+// sources (changed), in sorted order. The names are like in TemplateNames.
+func (m *Manager) Diff(other *Manager) (added, removed, changed []string) {
+	sources := m.sources()
+	otherSources := other.sources()
+
+	for _, name := range other.TemplateNames() {
+		src, present := sources[name]
+		if !present {
+			added = append(added, name)
+		} else if src != otherSources[name] {
+			changed = append(changed, name)
+		}
+	}
+
+	for _, name := range m.TemplateNames() {
+		if _, present := otherSources[name]; !present {
+			removed = append(removed, name)
+		}
+	}
 	return
 }
 
-// AddFile adds a given template file to the template manager.
-// If any errors occur, err will be non-nil. 
-func (m *Manager) addFile(filename string, mustParse bool) (t *Template,
-err os.Error) {
-	var tt *template.Template
+// ExecuteInLayout renders the content template and executes the layout 
+// template with the result, generating output to wr.
+// The output of the content template, rendered with contentData, is added 
+// to a copy of layoutData under the key slot before executing the layout 
+// template. Templates are looked up by their identifiers or filenames.
+// If any errors occur, err will be non-nil and tells which of the templates 
+// failed.
+func (m *Manager) ExecuteInLayout(wr io.Writer, layout, content string,
+layoutData map[string]interface{}, contentData interface{}, slot string) os.Error {
+	tLayout, ok := m.Lookup(layout)
+	if !ok {
+		return fmt.Errorf("neste: layout %s: no such template", layout)
+	}
+	tContent, ok := m.Lookup(content)
+	if !ok {
+		return fmt.Errorf("neste: content %s: no such template", content)
+	}
 
-	// Parse template file.
-	path := path.Join(m.baseDir, filename)
-	tt, err = m.parsett(path, mustParse)
+	s, err := tContent.Render(contentData)
 	if err != nil {
-		return
+		return fmt.Errorf("neste: content %s: %s", content, err)
 	}
 
-	t = &Template{
-		m:     m,
-		cache: tt,
-		fi: &templateFileInfo{
-			filename:  filename,
-			mtime:     getMtime(path),
-			mustParse: mustParse}}
+	data := make(map[string]interface{}, len(layoutData)+1)
+	for k, v := range layoutData {
+		data[k] = v
+	}
+	data[slot] = s
 
-	// Add template to the manager.
-	m.tFiles[filename] = t
+	err = tLayout.Execute(wr, data)
+	if err != nil {
+		return fmt.Errorf("neste: layout %s: %s", layout, err)
+	}
+	return nil
+}
 
-	return
+// Returns a template with the given identifier or nil if it doesn't exist.
+func (m *Manager) Get(s string) *Template {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.tStrings[s]
 }
 
-// parsett returns a *template.Template for the given file.
-func (m *Manager) parsett(path string, mustParse bool) (tt *template.Template,
-err os.Error) {
-	tt = template.New(m.fmap)
-	tt.SetDelims(m.ldelim, m.rdelim)
+// Freeze freezes the template manager, so that no templates can be added 
+// or removed, for example after the startup of a server. Adding templates 
+// to a frozen manager fails with ErrFrozen, and the Must variants of the 
+// adding methods panic. The removing methods, Remove, RemoveFile, Clear, 
+// PurgeStale and Reset, remove nothing and log ErrFrozen, as they have no 
+// error result to return it in. Template files are still reloaded in 
+// reloading mode.
+func (m *Manager) Freeze() {
+	m.mu.Lock()
+	m.frozen = true
+	m.mu.Unlock()
+}
 
-	// Parse template file.
-	if mustParse {
-		err = tt.ParseFile(path)
-		if err != nil {
-			panic(err)
+// GetAll returns all templates added from strings to the template manager,
+// sorted by their identifiers.
+func (m *Manager) GetAll() []*Template {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := m.ids()
+	templates := make([]*Template, len(ids))
+	for i, id := range ids {
+		templates[i] = m.tStrings[id]
+	}
+	return templates
+}
+
+// GetAllFiles returns all template files in the template manager,
+// sorted by their filenames.
+func (m *Manager) GetAllFiles() []*Template {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	filenames := m.filenames()
+	templates := make([]*Template, len(filenames))
+	for i, filename := range filenames {
+		templates[i] = m.tFiles[filename]
+	}
+	return templates
+}
+
+// Returns a template with the given filename or nil if it doesn't exist.
+// If there is no template with the exact filename, the template extensions 
+// set with SetTemplateExtensions are appended to it in order.
+// GetFile doesn't reload the template in reloading mode; executing it does.
+// Filenames referring outside the base directory, like "../secret.html", 
+// are never found, even if added with AddFileOutsideBaseDir.
+func (m *Manager) GetFile(filename string) *Template {
+	if checkFilename(filename) != nil {
+		return nil
+	}
+	filename = slashFilename(filename)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if t, present := m.tFiles[filename]; present {
+		return t
+	}
+	for _, ext := range m.templateExts {
+		if t, present := m.tFiles[filename+ext]; present {
+			return t
 		}
-	} else {
-		err = tt.ParseFile(path)
+	}
+	return nil
+}
+
+// Group returns the group of templates with the given name, creating it 
+// if it doesn't exist. See Group.
+func (m *Manager) Group(name string) *Group {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, present := m.groups[name]
+	if !present {
+		if m.groups == nil {
+			m.groups = make(map[string]*Group)
+		}
+		g = &Group{m, name}
+		m.groups[name] = g
+	}
+	return g
+}
+
+// HealthCheck verifies that the files of all template files in the template 
+// manager exist and are readable. The templates are not reparsed.
+// If any file can't be read, the returned error will be non-nil and contain
+// the filename of the template.
+func (m *Manager) HealthCheck() os.Error {
+	for _, t := range m.templateFiles() {
+		f, err := os.Open(t.fi.path)
 		if err != nil {
-			return
+			return fmt.Errorf("neste: template file %s is not readable: %s", t.name, err)
 		}
+		f.Close()
 	}
+	return nil
+}
 
-	return
+// InheritFormatters adds the formatters of other to the template manager.
+// Formatters with the same names as existing formatters of the manager are 
+// skipped, unless overwriting is enabled with SetOverwriteFormatters.
+// Formatters must be added before the templates using them.
+func (m *Manager) InheritFormatters(other *Manager) {
+	for name, fn := range other.fmap {
+		if _, present := m.fmap[name]; !present || m.overwrite {
+			m.fmap[name] = fn
+		}
+	}
 }
 
-func (m *Manager) VisitDir(path_ string, f *os.FileInfo) bool {
-	return true
+// Lookup returns a template with the given identifier or filename.
+// Templates added from strings take priority over template files.
+// Ok is false if there is no such template.
+func (m *Manager) Lookup(name string) (t *Template, ok bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if t, ok = m.tStrings[name]; ok {
+		return
+	}
+	t, ok = m.tFiles[slashFilename(name)]
+	return
 }
 
+// LoadCatalog loads a message catalog for translating the {trans "text"} 
+// directives of templates to the given locale. The catalog maps source 
+// texts to their translations. Translations may contain placeholders, 
+// like {name}, which are substituted with the data when executing.
+// A catalog replaces any previously loaded catalog for the same locale.
+// If any of the translations can't be parsed, err will be non-nil 
+// and the catalog is not loaded.
+func (m *Manager) LoadCatalog(locale string, messages map[string]string) (err os.Error) {
+	catalog := make(map[string]*template.Template, len(messages))
+	for text, translation := range messages {
+		catalog[text], err = m.parseMessage(translation)
+		if err != nil {
+			return fmt.Errorf("neste: catalog %s: %q: %s", locale, text, err)
+		}
+	}
 
-func (m *Manager) VisitFile(path_ string, f *os.FileInfo) {
-	// remove base dir from the given path
-	if path_[len(m.baseDir)] == filepath.Separator {
-		path_ = path_[len(m.baseDir)+1:]
-	} else {
-		path_ = path_[len(m.baseDir):]
+	if m.catalogs == nil {
+		m.catalogs = make(map[string]map[string]*template.Template)
 	}
+	m.catalogs[locale] = catalog
+	return
+}
+
+// LoadPluralCatalog loads a catalog of plural messages for translating the 
+// {plural Count "form" ...} directives of templates to the given locale. 
+// The catalog maps the first source form of each message to its 
+// translated forms, in the order of the indexes returned by the plural 
+// rule of the locale (see SetPluralRule). Like in LoadCatalog, the forms 
+// may contain placeholders.
+// A catalog replaces any previously loaded plural catalog for the same 
+// locale. If any of the forms can't be parsed, err will be non-nil and the 
+// catalog is not loaded.
+func (m *Manager) LoadPluralCatalog(locale string, messages map[string][]string) (err os.Error) {
+	catalog := make(map[string][]*template.Template, len(messages))
+	for text, forms := range messages {
+		if len(forms) == 0 {
+			return fmt.Errorf("neste: plural catalog %s: %q: no forms", locale, text)
+		}
+		catalog[text] = make([]*template.Template, len(forms))
+		for i, form := range forms {
+			catalog[text][i], err = m.parseMessage(form)
+			if err != nil {
+				return fmt.Errorf("neste: plural catalog %s: %q: %s", locale, text, err)
+			}
+		}
+	}
+
+	if m.plurals == nil {
+		m.plurals = make(map[string]map[string][]*template.Template)
+	}
+	m.plurals[locale] = catalog
+	return
+}
+
+// LoadAssetManifest loads the asset manifest for the static formatter from 
+// the JSON file at path. The manifest is a JSON object mapping the logical 
+// names of static assets to their hashed names or names with query 
+// versions, like {"app.css": "app.3f2a1c.css", "logo.png": "logo.png?v=2"}. 
+// A manifest replaces any previously loaded manifest. See also 
+// ReloadAssetManifest.
+// If the file can't be read or decoded, err will be non-nil and the 
+// previous manifest is kept.
+func (m *Manager) LoadAssetManifest(path string) (err os.Error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var assets map[string]string
+	err = json.Unmarshal(b, &assets)
+	if err != nil {
+		return fmt.Errorf("neste: asset manifest %s: %s", path, err)
+	}
+
+	m.mu.Lock()
+	m.assets = assets
+	m.manifestPath = path
+	m.mu.Unlock()
+	return
+}
+
+// PluralEnglish is the plural rule of English and many other languages, 
+// with one form for 1 (0) and another for other counts (1).
+func PluralEnglish(n int) int {
+	if n == 1 {
+		return 0
+	}
+	return 1
+}
+
+// PluralSlavic is the plural rule of Russian, Ukrainian and Belarusian, 
+// with forms for counts ending in 1 but not 11 (0), counts ending in 2-4 
+// but not 12-14 (1) and other counts (2), like in 
+// "21 файл", "3 файла" and "5 файлов".
+func PluralSlavic(n int) int {
+	switch {
+	case n%10 == 1 && n%100 != 11:
+		return 0
+	case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+		return 1
+	}
+	return 2
+}
+
+// PluralPolish is the plural rule of Polish, which is like PluralSlavic, 
+// except that only 1 has the first form (0), like in 
+// "1 plik", "3 pliki", "5 plików" and "21 plików".
+func PluralPolish(n int) int {
+	if n == 1 {
+		return 0
+	}
+	if n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14) {
+		return 1
+	}
+	return 2
+}
+
+// pluralRules are the built-in plural rules by language.
+var pluralRules = map[string]func(n int) int{
+	"en": PluralEnglish,
+	"be": PluralSlavic,
+	"pl": PluralPolish,
+	"ru": PluralSlavic,
+	"uk": PluralSlavic}
+
+// pluralRule returns the plural rule of the given locale. See SetPluralRule.
+func (m *Manager) pluralRule(locale string) func(n int) int {
+	lang := locale
+	if i := strings.IndexAny(locale, "_-"); i >= 0 {
+		lang = locale[:i]
+	}
+	for _, rules := range []map[string]func(n int) int{m.rules, pluralRules} {
+		if rule, present := rules[locale]; present {
+			return rule
+		}
+		if rule, present := rules[lang]; present {
+			return rule
+		}
+	}
+	return PluralEnglish
+}
+
+// MustAdd is like Add, but panics, if template can't be parsed. 
+func (m *Manager) MustAdd(s string, id string) *Template {
+	t, _ := m.add(s, id, true)
+	return t
+}
+
+// MustAddDir calls MustAddFile for all files in the given directory and their 
+// subdirectories to the template manager.
+// Panic occurs if any template can't be parsed, if the directory doesn't 
+// exist, or if there are no template files in it, so that a mistyped or 
+// undeployed directory is noticed at once. The panics for the directory 
+// name its absolute path.
+func (m *Manager) MustAddDir(dir string) {
+	root, err := m.openDir(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	v := &dirAdder{m: m, root: root, mustParse: true}
+	filepath.Walk(root, v, nil)
+	v.add()
+	if v.err != nil {
+		panic(v.err)
+	}
+	if v.added == 0 {
+		panic(fmt.Errorf("neste: template directory %s has no template files", absPath(root)))
+	}
+}
+
+// MustAddFile is like AddFile, but panics, if template can't be parsed. 
+func (m *Manager) MustAddFile(filename string) *Template {
+	err := checkFilename(filename)
+	if err != nil {
+		panic(err)
+	}
+	t, _ := m.addFile(filename, true)
+	return t
+}
+
+// MustGet is like Get, but panics if the template doesn't exist.
+func (m *Manager) MustGet(s string) *Template {
+	t := m.Get(s)
+	if t == nil {
+		panic("neste: no template with identifier " + s)
+	}
+	return t
+}
+
+// MustGetFile is like GetFile, but panics if the template doesn't exist.
+func (m *Manager) MustGetFile(filename string) *Template {
+	err := checkFilename(filename)
+	if err != nil {
+		panic(err)
+	}
+	t := m.GetFile(filename)
+	if t == nil {
+		panic("neste: no template file " + filename)
+	}
+	return t
+}
+
+// Partials returns the bare names of all partials in the template manager 
+// in sorted order. See SetPartialsDir.
+func (m *Manager) Partials() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	names := make([]string, 0, len(m.partials))
+	for name := range m.partials {
+		names = append(names, name)
+	}
+	sort.SortStrings(names)
+	return names
+}
+
+// PurgeStale removes all template files that have been modified since 
+// they were parsed from the template manager without reloading them, so 
+// that they can be added again when they are needed. It returns the number 
+// of template files removed. See StaleFiles.
+// Nothing is removed from a frozen or read-only template manager, and the 
+// error is logged.
+func (m *Manager) PurgeStale() int {
+	if !m.removable() {
+		return 0
+	}
+	filenames := m.StaleFiles()
+	for _, filename := range filenames {
+		m.RemoveFile(filename)
+	}
+	return len(filenames)
+}
+
+// ReadinessCheck reparses all template files in the template manager
+// without updating the templates, to verify that they are valid.
+// If any errors occur, the returned error will be non-nil and list the errors
+// of all failed template files.
+func (m *Manager) ReadinessCheck() os.Error {
+	var errs []string
+	for _, t := range m.templateFiles() {
+		_, _, _, err := m.parsett(t.name, t.fi.path, false)
+		if err != nil {
+			errs = append(errs, err.String())
+		}
+	}
+
+	if len(errs) > 0 {
+		return os.NewError("neste: template files are not valid: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Removes a template with the given identifier from the template manager.
+// Useful for clearing out cached templates.
+// It's safe to remove a non-existing template.
+// Remove returns true if a template was removed, otherwise false.
+// Nothing is removed from a frozen or read-only template manager, and the 
+// error is logged.
+func (m *Manager) Remove(s string) bool {
+	if !m.removable() {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, present := m.tStrings[s]
+	m.tStrings[s] = nil, false
+	return present
+}
+
+// Removes a template with the given filename from the template manager.
+// Useful for clearing out cached templates.
+// It's safe to remove a non-existing template.
+// Remove returns true if a template was removed, otherwise false.
+// Nothing is removed from a frozen or read-only template manager, and the 
+// error is logged.
+func (m *Manager) RemoveFile(filename string) bool {
+	if !m.removable() {
+		return false
+	}
+	filename = slashFilename(filename)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, present := m.tFiles[filename]
+	if present {
+		for _, d := range t.defines {
+			m.tFiles[d.name] = nil, false
+		}
+		if t.partial != "" && m.partials[t.partial] == t {
+			m.partials[t.partial] = nil, false
+		}
+	}
+	m.tFiles[filename] = nil, false
+	m.engines[filename] = nil, false
+	return present
+}
+
+// Reset removes all templates from the template manager and restores 
+// its configuration, such as delimiters, reloading mode and locale, 
+// to the defaults set by New. The base directory and formatters are kept.
+// Nothing is removed from a frozen or read-only template manager, and the 
+// error is logged.
+func (m *Manager) Reset() {
+	if !m.removable() {
+		return
+	}
+	m.SetReloadStrategy(ReloadNone)
+	var d *Manager
+	if m.text {
+		d = NewText(m.baseDir, m.fmap)
+	} else {
+		d = New(m.baseDir, m.fmap)
+	}
+	m.mu.Lock()
+	m.assign(d)
+	m.mu.Unlock()
+}
+
+// ReloadAssetManifest reloads the asset manifest from the file it was 
+// last loaded from with LoadAssetManifest, for example after the assets 
+// have been rebuilt.
+// If no manifest has been loaded or it can't be reloaded, err will be 
+// non-nil and the previous manifest is kept.
+func (m *Manager) ReloadAssetManifest() os.Error {
+	if m.manifestPath == "" {
+		return os.NewError("neste: no asset manifest loaded")
+	}
+	return m.LoadAssetManifest(m.manifestPath)
+}
+
+// RenderAll renders the templates in plan, which maps template identifiers 
+// or filenames to their data, and writes their output to files in outDir 
+// at the same relative paths, creating directories as needed. The file 
+// extensions can be changed with SetOutputExtensions. Each file is written 
+// to a temporary file first and then renamed, so that it is replaced at once.
+// A template failing doesn't stop the others from being rendered. 
+// The paths of the written files are returned in the order of the template 
+// names. If any templates fail, err will be a RenderErrors holding their 
+// errors.
+func (m *Manager) RenderAll(outDir string, plan map[string]interface{}) (written []string,
+err os.Error) {
+	names := make([]string, 0, len(plan))
+	for name := range plan {
+		names = append(names, name)
+	}
+	sort.SortStrings(names)
+
+	errs := make(RenderErrors)
+	for _, name := range names {
+		filename, err := m.renderFile(outDir, name, plan[name])
+		if err != nil {
+			errs[name] = err
+			continue
+		}
+		written = append(written, filename)
+	}
+
+	if len(errs) > 0 {
+		err = errs
+	}
+	return
+}
+
+// RenderNested renders a tree of nested templates in one call and 
+// returns the output of the root template as a string.
+// Plan maps template identifiers or filenames to their data. Ref values in 
+// data of type map[string]interface{} are replaced by the output of the 
+// referred template, which is rendered first with its own data from plan 
+// (nil if it has none). Each template is rendered only once.
+// If any errors occur, such as a template referring to itself directly or 
+// indirectly, output will be empty string "" and err will be non-nil. 
+func (m *Manager) RenderNested(root string, plan map[string]interface{}) (string, os.Error) {
+	return m.renderPlan(root, plan, make(map[string]string), nil)
+}
+
+// RenderInLayout is like ExecuteInLayout, but returns the output as a string.
+// If any errors occur, output will be empty string "" and err will be non-nil. 
+func (m *Manager) RenderInLayout(layout, content string,
+layoutData map[string]interface{}, contentData interface{}, slot string) (s string,
+err os.Error) {
+	buf := new(bytes.Buffer)
+	err = m.ExecuteInLayout(buf, layout, content, layoutData, contentData, slot)
+	if err != nil {
+		return
+	}
+
+	s = string(buf.Bytes())
+	return
+}
+
+// RenderWithJSON renders the template with the given identifier or filename 
+// with the data decoded from the JSON file at jsonPath, which must hold 
+// a JSON object. Integral numbers are decoded as int64 values, so that 
+// they are formatted without fractions.
+// If the JSON data is invalid, err will be a *JSONError. If any other 
+// errors occur, output will be empty string "" and err will be non-nil.
+func (m *Manager) RenderWithJSON(name, jsonPath string) (string, os.Error) {
+	b, err := ioutil.ReadFile(jsonPath)
+	if err != nil {
+		return "", err
+	}
+	return m.renderJSON(name, jsonPath, b)
+}
+
+// RenderWithJSONReader is like RenderWithJSON, but reads the JSON data from r.
+func (m *Manager) RenderWithJSONReader(name string, r io.Reader) (string, os.Error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return m.renderJSON(name, "", b)
+}
+
+// SetAutoEscape sets the automatic escaping mode.
+// In automatic escaping mode, variables without formatters, like {name}, 
+// are escaped according to their position in the markup: as if they were 
+// written like {name|html} in text, {name|attr} in attribute values, 
+// {name|urlAttr} at the beginning of URL attributes like href, and 
+// {name|js} in JavaScript strings. Variables in positions that aren't 
+// recognized are HTML escaped. The output of formatters is escaped too, 
+// like in {name|capFirst}, unless the variable is marked as safe, like 
+// {name|safe}, or ends with an escaping formatter, such as html, attr, js 
+// or json. Automatic escaping can be turned off for a part of a template 
+// with {autoescape off}...{end}, or on with {autoescape on}...{end}.
+// The mode applies to templates added after setting it.
+// Automatic escaping is disabled (false) by default, and always for 
+// template managers created with NewText.
+func (m *Manager) SetAutoEscape(autoEscape bool) {
+	m.autoEscape = autoEscape && !m.text
+}
+
+// SetBaseURLPrefix sets the URL path prefix that GetFileForURL strips 
+// from URL paths to get the filenames of template files, like "/templates" 
+// for serving the template file "blog/post.html" at 
+// "/templates/blog/post.html". The prefix is empty by default.
+func (m *Manager) SetBaseURLPrefix(prefix string) {
+	m.urlPrefix = strings.TrimRight(prefix, "/")
+}
+
+// SetCacheDuration sets the time in nanoseconds after which parsed 
+// template files expire. Executing an expired template file reparses it, 
+// even if its modified time hasn't changed, for example when the files 
+// are updated through a proxy that doesn't preserve modified times:
+//
+//	m.SetCacheDuration(5 * 60e9) // Reparse every five minutes
+//
+// Like modified template files in reloading mode, only the template files 
+// executed at the top level are reparsed in the lazy reload strategy 
+// (see SetReloadStrategy).
+// Template files don't expire (0) by default.
+func (m *Manager) SetCacheDuration(ns int64) {
+	m.cacheDuration = ns
+}
+
+// SetClock sets the function used for getting the current time 
+// in templates, for example by the now directive.
+// It is time.LocalTime by default.
+func (m *Manager) SetClock(clock func() *time.Time) {
+	m.clock = clock
+}
+
+// SetDateFormat sets the default layout for formatting times in templates, 
+// used when a directive is given no layout of its own.
+// The layout is like in time.Time.Format. It is "2006-01-02" by default.
+func (m *Manager) SetDateFormat(layout string) {
+	m.dateFormat = layout
+}
+
+// SetLocale sets the default locale for translating templates.
+// See LoadCatalog and Template.ExecuteLocalized.
+func (m *Manager) SetLocale(locale string) {
+	m.locale = locale
+}
+
+// SetPluralRule sets the plural rule of the given locale. The rule returns 
+// the index of the plural form used for the count n, like 0 for "1 file" 
+// and 1 for "2 files" in English. Locales are matched exactly, and then by 
+// their language, so that a rule for "pl" applies to "pl_PL" too.
+// Rules for English (en) and some Slavic languages (pl, ru, uk, be) are 
+// built in, and English is used for other locales. See PluralEnglish.
+func (m *Manager) SetPluralRule(locale string, rule func(n int) int) {
+	if m.rules == nil {
+		m.rules = make(map[string]func(n int) int)
+	}
+	m.rules[locale] = rule
+}
+
+// SetMinReloadInterval sets the minimum time in nanoseconds between 
+// checking a template file for modifications when it is executed in 
+// reloading mode. Executing a template file sooner after the previous 
+// check doesn't check it again, saving the system calls for reading its 
+// modified time under heavy load. Reload always checks the template file.
+// Template files are checked every time they are executed (0) by default.
+func (m *Manager) SetMinReloadInterval(ns int64) {
+	m.minReloadInterval = ns
+}
+
+// SetOutputMode sets the output mode of templates, ModeHTML or ModeXML.
+// In the XML mode, variables are escaped with the xml formatter in 
+// automatic escaping mode, wherever they are, instead of the HTML 
+// formatters. See SetAutoEscape and XMLFormatter.
+// The mode applies to templates added after setting it.
+// The mode is ModeHTML by default.
+func (m *Manager) SetOutputMode(mode int) {
+	m.outputMode = mode
+}
+
+// SetOverwriteFormatters sets whether InheritFormatters overwrites 
+// existing formatters with the formatters of the other manager.
+// Overwriting is disabled (false) by default.
+func (m *Manager) SetOverwriteFormatters(overwrite bool) {
+	m.overwrite = overwrite
+}
+
+// SetFormatterNotFoundHandler sets a handler for formatters that are not 
+// registered in the template manager. When parsing a template that uses an 
+// unknown formatter, the handler is called with its name, and the formatter 
+// it returns is used for the template. If the handler returns nil, parsing 
+// fails as usual. A nil handler removes the handler.
+// Formatters returned by the handler are not added to the template manager, 
+// so the handler is called again for other templates using them.
+func (m *Manager) SetFormatterNotFoundHandler(fn func(name string) func(io.Writer, string, ...interface{})) {
+	m.notFound = fn
+}
+
+// SetOutputExtensions sets the extensions of the files written by RenderAll. 
+// Exts maps template file extensions to output file extensions, like 
+// {".tmpl": ".html"}. Other extensions are left unchanged, as they are 
+// by default.
+func (m *Manager) SetOutputExtensions(exts map[string]string) {
+	m.outputExts = make(map[string]string, len(exts))
+	for ext, outExt := range exts {
+		m.outputExts[ext] = outExt
+	}
+}
+
+// SetParallelism sets the number of goroutines that AddDir, AddDirAll and 
+// MustAddDir read and parse template files with. The templates are still 
+// added, and errors reported, in the order of the files in the directory. 
+// By default (0), the number is runtime.GOMAXPROCS.
+func (m *Manager) SetParallelism(n int) {
+	m.parallelism = n
+}
+
+// SetPartialsDir sets the partials directory and adds all files in it and 
+// its subdirectories to the template manager as partials.
+// Partials are template files that can be included and extended by their 
+// bare names, which are their filenames relative to the partials directory 
+// without extensions, like "nav" for "_partials/nav.html". Other templates 
+// with the same names take priority over partials. Partials are left out 
+// of AllFilenames, GetAllFiles and TemplateNames.
+// Files in directories whose names begin with "_", like "_partials", are 
+// always added as partials by AddDir and NewFromDir. The partials of 
+// a directory are added before its other files, so that those can extend 
+// them. If several partials have the same bare name, the one added last, 
+// in the lexical order of the filenames, replaces the others with 
+// a warning.
+// If any errors occur, err will be non-nil.
+func (m *Manager) SetPartialsDir(dir string) os.Error {
+	m.partialDir = dir
+	return m.AddDir(dir)
+}
+
+// SetReadOnly sets the read-only mode, in which no templates can be added 
+// to or removed from the template manager, like in a frozen manager. 
+// Unlike Freeze, it is meant for configuring managers that are never 
+// modified, such as ones created with NewFromDir for production.
+// Adding templates to a read-only manager fails with ErrReadOnly, and the 
+// removing methods, like RemoveFile, PurgeStale and Reset, remove nothing 
+// and log ErrReadOnly.
+// Read-only mode is disabled (false) by default.
+func (m *Manager) SetReadOnly(readOnly bool) {
+	m.mu.Lock()
+	m.readOnly = readOnly
+	m.mu.Unlock()
+}
+
+// SetReloading sets the template file reloading mode.
+// When reloading mode is enabled, executing a template file, with Execute, 
+// Render or the other executing methods, will trigger reparsing of the 
+// template file if its modified time has changed. GetFile doesn't reparse 
+// template files. See also ExecuteFresh.
+// Reloading is disabled (false) by default. The mode may be changed while 
+// templates are being executed by other goroutines.
+// SetReloading(true) is the same as SetReloadStrategy(ReloadEager), and 
+// SetReloading(false) as SetReloadStrategy(ReloadNone).
+func (m *Manager) SetReloading(reloading bool) {
+	if reloading {
+		m.SetReloadStrategy(ReloadEager)
+	} else {
+		m.SetReloadStrategy(ReloadNone)
+	}
+}
+
+// SetReloadStrategy sets the strategy of reloading template files whose 
+// modified times have changed.
+// With ReloadEager, template files are reloaded when they are executed, 
+// including when they are rendered as nested templates of other templates. 
+// With ReloadLazy, they are reloaded only when executed at the top level, 
+// by calling Execute or Render for example. With ReloadBackground, all 
+// template files are checked and reloaded by a goroutine at the interval 
+// set with Watch, one second by default, and executing doesn't reload them. 
+// The goroutine is stopped by setting another strategy. With ReloadNone, 
+// template files are reloaded only by Reload, which is the default.
+func (m *Manager) SetReloadStrategy(strategy ReloadStrategy) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopWatch != nil {
+		close(m.stopWatch)
+		m.stopWatch = nil
+	}
+
+	m.reloadStrategy = strategy
+	m.reloading = strategy == ReloadEager || strategy == ReloadLazy
+	if strategy == ReloadBackground {
+		m.startWatch()
+	}
+}
+
+// reloadMode returns the reloading mode and the reload strategy of the 
+// template manager, which may be set while templates are executed.
+func (m *Manager) reloadMode() (reloading bool, strategy ReloadStrategy) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.reloading, m.reloadStrategy
+}
+
+// Watch sets the reload strategy to ReloadBackground, checking the 
+// template files for changes at the given interval in nanoseconds.
+func (m *Manager) Watch(interval int64) {
+	m.mu.Lock()
+	m.watchInterval = interval
+	m.mu.Unlock()
+	m.SetReloadStrategy(ReloadBackground)
+}
+
+// startWatch starts the goroutine of background reloading.
+func (m *Manager) startWatch() {
+	interval := m.watchInterval
+	if interval <= 0 {
+		interval = 1e9
+	}
+	stop := make(chan bool)
+	m.stopWatch = stop
+
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+				m.reloadAll()
+			}
+		}
+	}()
+}
+
+// reloadAll reloads all modified template files. Errors are only logged.
+func (m *Manager) reloadAll() {
+	m.mu.RLock()
+	files := make([]*Template, 0, len(m.tFiles))
+	for _, t := range m.tFiles {
+		if t.parent == nil {
+			files = append(files, t)
+		}
+	}
+	m.mu.RUnlock()
+
+	for _, t := range files {
+		func() {
+			// Templates added with MustAddFile panic on errors.
+			defer func() { recover() }()
+			t.Reload()
+		}()
+	}
+}
+
+// SetLogger sets the function that template managers log events with, 
+// such as template files being reloaded or failing to parse. Level is one 
+// of LogDebug, LogInfo, LogWarning and LogError, and format and args are like in 
+// fmt.Printf. Nothing is logged with a nil logger, which is the default.
+// The logger may be called from several goroutines at once, such as when 
+// templates are executed concurrently or the files of an added directory 
+// are parsed, so it must be safe for concurrent use.
+func (m *Manager) SetLogger(logger func(level int, format string, args ...interface{})) {
+	m.logger = logger
+}
+
+// SetStageErrorFragment sets the fragment that ExecuteProgressive writes 
+// when a stage fails after the first stages have been written, such as 
+// an error message or a script redirecting to an error page. 
+// It is empty by default.
+func (m *Manager) SetStageErrorFragment(fragment string) {
+	m.stageError = fragment
+}
+
+// SetStaticPrefix sets the URL prefix of the asset URLs written by the 
+// static formatter, like "https://cdn.example.com/". 
+// It is "/static/" by default.
+func (m *Manager) SetStaticPrefix(prefix string) {
+	m.staticPrefix = prefix
+}
+
+// SetSymlinkPolicy sets how AddDir, AddDirAll and MustAddDir handle 
+// symbolic links in the directories they add. With SymlinkFollow, linked 
+// files are added, and linked directories are added like subdirectories, 
+// except for links to directories containing them, which would loop. 
+// With SymlinkSkip, symbolic links are skipped, and with SymlinkError, 
+// they are errors like template files that can't be read.
+// Symbolic links are followed (SymlinkFollow) by default.
+func (m *Manager) SetSymlinkPolicy(policy SymlinkPolicy) {
+	m.symlinks = policy
+}
+
+// SetTemplateExtensions sets the extensions GetFile tries in order for 
+// filenames without a template, like [".html", ".neste"] for finding 
+// "index.html" or "index.neste" by "index". There are none by default.
+func (m *Manager) SetTemplateExtensions(exts []string) {
+	m.templateExts = make([]string, len(exts))
+	copy(m.templateExts, exts)
+}
+
+// SetTraceHooks sets functions that are called when executing templates, 
+// for timing or tracing them. Begin is called with the identifier or filename 
+// of the template before executing it, and end after it, with the value 
+// returned by begin, the error of the execution, and the number of bytes 
+// written and nanoseconds taken. They are called for templates nested and 
+// included in other templates too. Either of them may be nil.
+func (m *Manager) SetTraceHooks(begin func(name string) interface{},
+end func(name string, token interface{}, err os.Error, bytes int, ns int64)) {
+	m.traceBegin = begin
+	m.traceEnd = end
+}
+
+// SetMaxFileSize sets the maximum size of template files in bytes.
+// Template files larger than this are rejected with an error 
+// without reading them.
+// The size is unlimited (0) by default.
+func (m *Manager) SetMaxFileSize(bytes int64) {
+	m.maxSize = bytes
+}
+
+// SetReadTimeout sets the timeout in nanoseconds for reading template files.
+// If reading a template file takes longer than this, for example on a slow
+// network filesystem, the read is abandoned and an error is returned.
+// There is no timeout (0) by default.
+func (m *Manager) SetReadTimeout(ns int64) {
+	m.timeout = ns
+}
+
+// SetStrict sets the strict mode.
+// In strict mode, data referred to by neste's directives, such as 
+// include ... with, must exist or executing the template fails.
+// Strict mode is disabled (false) by default.
+func (m *Manager) SetStrict(strict bool) {
+	m.strict = strict
+}
+
+// SetDelims sets the left and right delimiters for operations 
+// in the template for template parsing.
+func (m *Manager) SetDelims(left, right string) {
+	m.ldelim = left
+	m.rdelim = right
+}
+
+// StaleFiles returns the filenames of all template files in the template 
+// manager that have been modified since they were parsed, in sorted order. 
+// The templates aren't reloaded. See Template.IsStale.
+func (m *Manager) StaleFiles() []string {
+	// Defined templates are stale with their template files.
+	var filenames []string
+	for _, t := range m.templateFiles() {
+		if t.IsStale() {
+			filenames = append(filenames, t.name)
+		}
+	}
+	return filenames
+}
+
+// TemplateNames returns the names of all templates in the template manager 
+// in sorted order. The names of template files are their filenames prefixed 
+// with "file:" and the names of other templates are their identifiers.
+func (m *Manager) TemplateNames() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	names := m.ids()
+	for _, filename := range m.filenames() {
+		names = append(names, "file:"+filename)
+	}
+	sort.SortStrings(names)
+	return names
+}
+
+// TotalSize returns the total size in bytes of the sources of all templates 
+// in the template manager.
+func (m *Manager) TotalSize() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var size int64
+	for _, t := range m.tStrings {
+		size += int64(len(t.source))
+	}
+	for _, t := range m.tFiles {
+		// Defined templates are part of their template files.
+		if t.parent == nil {
+			size += int64(len(t.source))
+		}
+	}
+	return size
+}
+
+// Unfreeze unfreezes a template manager frozen with Freeze.
+func (m *Manager) Unfreeze() {
+	m.mu.Lock()
+	m.frozen = false
+	m.mu.Unlock()
+}
+
+// WithFunc adds a formatter with the given name to the template manager 
+// and returns the manager, so that calls can be chained:
+//
+//	m := neste.New(dir, nil).WithFunc("markdown", markdown).WithFunc("slug", slug)
+//
+// The formatter fn is either a function with the signature of formatters, 
+// func(w io.Writer, formatter string, data ...interface{}), or a function 
+// taking and returning a string, func(s string) string, which is given 
+// the value formatted as with the default formatter.
+// Formatters must be added before the templates using them.
+// Panic occurs if fn is of any other type.
+func (m *Manager) WithFunc(name string, fn interface{}) *Manager {
+	switch fn := fn.(type) {
+	case func(io.Writer, string, ...interface{}):
+		m.fmap[name] = fn
+	case func(string) string:
+		m.fmap[name] = func(w io.Writer, formatter string, data ...interface{}) {
+			io.WriteString(w, fn(string(getBytes(data...))))
+		}
+	default:
+		panic(fmt.Sprintf("neste: formatter %s has invalid type %T", name, fn))
+	}
+	return m
+}
+
+
+// Unexported methods
+
+// static is the static formatter of the template manager. It writes the 
+// URL of the asset named by the value, which is the static prefix followed 
+// by the name of the asset in the asset manifest. Assets not in the 
+// manifest are logged and written with their logical names.
+func (m *Manager) static(w io.Writer, formatter string, data ...interface{}) {
+	name := string(getBytes(data...))
+	m.mu.RLock()
+	asset, present := m.assets[name]
+	m.mu.RUnlock()
+	if !present {
+		m.logf(LogWarning, "neste: asset %s not in the asset manifest", name)
+		asset = name
+	}
+	io.WriteString(w, m.staticPrefix+asset)
+}
+
+// renderPlan renders the named template of a RenderNested plan after the 
+// templates it refers to. Rendered holds the output of already rendered 
+// templates and visiting the chain of templates being rendered.
+func (m *Manager) renderPlan(name string, plan map[string]interface{},
+rendered map[string]string, visiting []string) (string, os.Error) {
+	if s, present := rendered[name]; present {
+		return s, nil
+	}
+
+	visiting = append(visiting, name)
+	for _, v := range visiting[:len(visiting)-1] {
+		if v == name {
+			return "", fmt.Errorf("neste: template reference cycle: %s",
+				strings.Join(visiting, " -> "))
+		}
+	}
+
+	t, ok := m.Lookup(name)
+	if !ok {
+		return "", fmt.Errorf("neste: no such template: %s", name)
+	}
+
+	data := plan[name]
+	if dmap, ok := data.(map[string]interface{}); ok {
+		resolved := make(map[string]interface{}, len(dmap))
+		for k, v := range dmap {
+			if ref, ok := v.(Ref); ok {
+				var err os.Error
+				v, err = m.renderPlan(string(ref), plan, rendered, visiting)
+				if err != nil {
+					return "", err
+				}
+			}
+			resolved[k] = v
+		}
+		data = resolved
+	}
+
+	s, err := t.Render(data)
+	if err != nil {
+		return "", fmt.Errorf("neste: %s: %s", name, err)
+	}
+	rendered[name] = s
+	return s, nil
+}
+
+// Add adds a given template string to the template manager.
+// If any errors occur, err will be non-nil. 
+func (m *Manager) add(s string, id string, mustParse bool) (t *Template,
+err os.Error) {
+	err = m.writable()
+	if err != nil {
+		if mustParse {
+			panic(err)
+		}
+		return
+	}
+
+	var tt Executer
+
+	// Parse the template.
+	tt, err = m.parse(s, id, make(map[string]int64))
+	if err != nil {
+		if mustParse {
+			panic(err)
+		}
+		return
+	}
+
+	t = &Template{
+		m:      m,
+		name:   id,
+		source: s,
+		cache:  tt,
+		email:  m.parseEmail(id, s)}
+
+	// Add template to the manager.
+	m.mu.Lock()
+	m.tStrings[id] = t
+	m.mu.Unlock()
+	if p, present := m.lookupPartial(id); present {
+		m.logf(LogWarning, "neste: template %s hides the partial %s of %s",
+			id, id, p.name)
+	}
+	return
+}
+
+// AddFile adds a given template file to the template manager.
+// The file must be in the base directory.
+// If any errors occur, err will be non-nil. 
+func (m *Manager) addFile(filename string, mustParse bool) (t *Template,
+err os.Error) {
+	fpath, err := m.filePath(filename)
+	if err != nil {
+		if mustParse {
+			panic(err)
+		}
+		return
+	}
+	return m.addFileAt(filename, fpath, mustParse)
+}
+
+// filePath returns the path of the template file filename in the base 
+// directory, or an *UnsafePathError if it is outside the base directory.
+func (m *Manager) filePath(filename string) (string, os.Error) {
+	fpath := path.Join(m.baseDir, slashFilename(filename))
+	if !inDir(m.baseDir, fpath) {
+		return "", &UnsafePathError{filename}
+	}
+	return filepath.FromSlash(fpath), nil
+}
+
+// addFileAt adds the template file at fpath to the template manager with 
+// the given filename, which is normalized to forward slashes.
+// If any errors occur, err will be non-nil. 
+func (m *Manager) addFileAt(filename, fpath string, mustParse bool) (t *Template,
+err os.Error) {
+	filename = slashFilename(filename)
+	err = m.addable(filename, fpath)
+	if err == nil {
+		f := m.parseFile(filename, fpath)
+		err = f.err
+		if err == nil {
+			t = m.insertFile(f, mustParse)
+		}
+	}
+	if err != nil && mustParse {
+		panic(err)
+	}
+	return
+}
+
+// addable returns an error if the template file at fpath can't be added to 
+// the template manager with the given filename, because the manager is 
+// read-only or frozen or has a template file with the filename from 
+// another path.
+func (m *Manager) addable(filename, fpath string) os.Error {
+	err := m.writable()
+	if err != nil {
+		return err
+	}
+	m.mu.RLock()
+	old, present := m.tFiles[filename]
+	m.mu.RUnlock()
+	if present && old.fi != nil && old.fi.path != fpath {
+		return fmt.Errorf("neste: template file %s is already added from %s",
+			filename, old.fi.path)
+	}
+	return nil
+}
+
+// parsedFile is a template file parsed for adding it to a template manager.
+type parsedFile struct {
+	filename string
+	path     string
+	tt       Executer
+	src      string
+	deps     map[string]int64
+	defines  map[string]*Template
+	email    *emailParts
+	mtime    int64
+	err      os.Error
+}
+
+// parseFile reads and parses the template file filename at fpath without 
+// adding it to the template manager, so that files can be parsed 
+// concurrently.
+func (m *Manager) parseFile(filename, fpath string) *parsedFile {
+	f := &parsedFile{filename: filename, path: fpath}
+	f.tt, f.src, f.deps, f.err = m.parsett(filename, fpath, false)
+	if f.err != nil {
+		return f
+	}
+
+	// Parse the templates defined in the file.
+	f.defines, f.err = m.parseDefines(f.src, filename)
+	if f.err != nil {
+		f.err = m.fileError("parse", filename, fpath, f.err)
+		return f
+	}
+	f.email = m.parseEmail(filename, f.src)
+	f.mtime = getMtime(fpath)
+	return f
+}
+
+// parseFiles parses the template files files concurrently, with as many 
+// goroutines as set with SetParallelism. Files with errors already are 
+// skipped.
+func (m *Manager) parseFiles(files []*parsedFile) {
+	n := m.parallelism
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	jobs := make(chan *parsedFile, len(files))
+	for _, f := range files {
+		if f.err == nil {
+			jobs <- f
+		}
+	}
+	close(jobs)
+	if n > len(jobs) {
+		n = len(jobs)
+	}
+
+	done := make(chan bool)
+	for i := 0; i < n; i++ {
+		go func() {
+			for f := range jobs {
+				*f = *m.parseFile(f.filename, f.path)
+			}
+			done <- true
+		}()
+	}
+	for i := 0; i < n; i++ {
+		<-done
+	}
+}
+
+// insertFile adds the parsed template file f to the template manager.
+func (m *Manager) insertFile(f *parsedFile, mustParse bool) *Template {
+	t := &Template{
+		m:      m,
+		name:   f.filename,
+		source: f.src,
+		cache:  f.tt,
+		email:  f.email,
+		fi: &templateFileInfo{
+			filename:  f.filename,
+			path:      f.path,
+			mtime:     f.mtime,
+			parsed:    time.Nanoseconds(),
+			deps:      f.deps,
+			mustParse: mustParse}}
+
+	// Add template to the manager.
+	m.mu.Lock()
+	m.tFiles[f.filename] = t
+	m.setDefines(t, f.defines)
+	m.mu.Unlock()
+	m.logf(LogDebug, "neste: added %s", f.filename)
+	if p, present := m.lookupPartial(f.filename); present {
+		m.logf(LogWarning, "neste: template %s hides the partial %s of %s",
+			f.filename, f.filename, p.name)
+	}
+
+	return t
+}
+
+// parse preprocesses and parses the source of the template with the given 
+// name. Files read during preprocessing are recorded in deps.
+func (m *Manager) parse(s, name string, deps map[string]int64) (tt Executer,
+err os.Error) {
+	var fmap template.FormatterMap
+	var limited bool
+	s, fmap, limited, err = m.preprocess(s, name, deps)
+	if err != nil {
+		return
+	}
+
+	// Use the formatters of the manager as they are, 
+	// unless directives need formatters of their own.
+	if len(fmap) == 0 {
+		fmap = m.fmap
+	} else {
+		for k, v := range m.fmap {
+			if _, present := fmap[k]; !present {
+				fmap[k] = v
+			}
+		}
+	}
+
+	t := template.New(fmap)
+	t.SetDelims(m.ldelim, m.rdelim)
+	err = t.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if limited {
+		return limitedTemplate{t}, nil
+	}
+	return t, nil
+}
+
+// logf logs a message with the logger of the template manager, if any.
+func (m *Manager) logf(level int, format string, args ...interface{}) {
+	if m.logger != nil {
+		m.logger(level, format, args...)
+	}
+}
+
+// renderFile renders the named template with data for RenderAll and 
+// writes the output to its file in outDir, whose path it returns.
+func (m *Manager) renderFile(outDir, name string, data interface{}) (filename string,
+err os.Error) {
+	t, ok := m.Lookup(name)
+	if !ok {
+		return "", fmt.Errorf("neste: no such template: %s", name)
+	}
+
+	rel := path.Clean(name)
+	if isOutside(rel) {
+		return "", fmt.Errorf("neste: output path outside output directory: %s", name)
+	}
+	ext := path.Ext(rel)
+	if outExt, present := m.outputExts[ext]; present {
+		rel = rel[:len(rel)-len(ext)] + outExt
+	}
+	filename = path.Join(outDir, rel)
+
+	s, err := t.Render(data)
+	if err != nil {
+		return "", err
+	}
+
+	dir := path.Dir(filename)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(dir, ".neste")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(s)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return
+}
+
+// renderJSON renders the named template with the JSON data b read from 
+// the named file.
+func (m *Manager) renderJSON(name, filename string, b []byte) (string, os.Error) {
+	t, ok := m.Lookup(name)
+	if !ok {
+		return "", fmt.Errorf("neste: no such template: %s", name)
+	}
+
+	var data map[string]interface{}
+	err := json.Unmarshal(b, &data)
+	if err != nil {
+		jerr := &JSONError{Filename: filename, Err: err}
+		if serr, ok := err.(*json.SyntaxError); ok && serr.Offset <= int64(len(b)) {
+			jerr.Line = 1 + bytes.Count(b[:serr.Offset], []byte{'\n'})
+		}
+		return "", jerr
+	}
+
+	jsonIntegers(data)
+	return t.Render(data)
+}
+
+// jsonIntegers replaces the integral float64 numbers in decoded JSON data 
+// with int64 numbers, in place.
+func jsonIntegers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, elem := range v {
+			v[k] = jsonIntegers(elem)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = jsonIntegers(elem)
+		}
+	case float64:
+		if v == float64(int64(v)) && v > -1<<53 && v < 1<<53 {
+			return int64(v)
+		}
+	}
+	return v
+}
+
+// sources returns the sources of all templates in the template manager 
+// by their names, like in TemplateNames.
+func (m *Manager) sources() map[string]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	sources := make(map[string]string, len(m.tStrings)+len(m.tFiles))
+	for id, t := range m.tStrings {
+		sources[id] = t.source
+	}
+	for filename, t := range m.tFiles {
+		sources["file:"+filename] = t.source
+	}
+	return sources
+}
+
+// allFilenames is like AllFilenames, but includes partials.
+func (m *Manager) allFilenames() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	filenames := make([]string, 0, len(m.tFiles))
+	for filename := range m.tFiles {
+		filenames = append(filenames, filename)
+	}
+	sort.SortStrings(filenames)
+	return filenames
+}
+
+// templateFiles returns the template files in the template manager, 
+// sorted by their filenames, without the templates defined in them.
+func (m *Manager) templateFiles() []*Template {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	filenames := make([]string, 0, len(m.tFiles))
+	for filename, t := range m.tFiles {
+		if t.parent == nil {
+			filenames = append(filenames, filename)
+		}
+	}
+	sort.SortStrings(filenames)
+	files := make([]*Template, len(filenames))
+	for i, filename := range filenames {
+		files[i] = m.tFiles[filename]
+	}
+	return files
+}
+
+// groupOf returns the name of the group of the template with the given name, 
+// or "" if the template is not in a group.
+func (m *Manager) groupOf(name string) string {
+	i := strings.Index(name, "/")
+	if i < 0 {
+		return ""
+	}
+	if _, present := m.groups[name[:i]]; !present {
+		return ""
+	}
+	return name[:i]
+}
+
+// lookupIn is like Lookup, but looks up the template in the given group 
+// first, unless group is "", and in the partials last.
+func (m *Manager) lookupIn(group, name string) (t *Template, ok bool) {
+	if group != "" {
+		t, ok = m.Lookup(group + "/" + name)
+		if ok {
+			return
+		}
+	}
+	t, ok = m.Lookup(name)
+	if !ok {
+		t, ok = m.lookupPartial(name)
+	}
+	return
+}
+
+// lookupPartial returns the partial with the given bare name.
+func (m *Manager) lookupPartial(name string) (t *Template, ok bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	t, ok = m.partials[name]
+	return
+}
+
+// writable returns ErrReadOnly or ErrFrozen if templates can't be added to 
+// or removed from the template manager, otherwise nil.
+func (m *Manager) writable() os.Error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.readOnly {
+		return ErrReadOnly
+	}
+	if m.frozen {
+		return ErrFrozen
+	}
+	return nil
+}
+
+// removable returns true if templates can be removed from the template 
+// manager, or logs the error and returns false if it is frozen or read-only.
+func (m *Manager) removable() bool {
+	if err := m.writable(); err != nil {
+		m.logf(LogError, "neste: removing templates failed: %s", err)
+		return false
+	}
+	return true
+}
+
+// parseDefines parses the templates defined in the source of a template file.
+// The returned templates are not added to the template manager.
+func (m *Manager) parseDefines(src, filename string) (defines map[string]*Template,
+err os.Error) {
+	if m.engineOf(filename) != nil {
+		// Other engines don't support the define directive.
+		return
+	}
+
+	_, bodies, err := m.splitDefines(src)
+	if err != nil {
+		return
+	}
+
+	defines = make(map[string]*Template, len(bodies))
+	for name, body := range bodies {
+		var tt Executer
+		tt, err = m.parse(body, filename+"#"+name, make(map[string]int64))
+		if err != nil {
+			return nil, fmt.Errorf("neste: define %s: %s", name, err)
+		}
+		defines[name] = &Template{
+			m:      m,
+			source: body,
+			cache:  tt,
+			email:  m.parseEmail(filename+"#"+name, body)}
+	}
+	return
+}
+
+// setDefines replaces the templates defined in the template file t with 
+// the given ones, and adds them to the template manager as 
+// "filename#name". Templates with the same names as before are updated 
+// in place, so that they stay valid for their users.
+func (m *Manager) setDefines(t *Template, defines map[string]*Template) {
+	for name, old := range t.defines {
+		if _, present := defines[name]; !present {
+			m.tFiles[old.name] = nil, false
+		}
+	}
+
+	for name, d := range defines {
+		if old, present := t.defines[name]; present {
+			old.source = d.source
+			old.cache = d.cache
+			old.email = d.email
+			defines[name] = old
+			continue
+		}
+		d.name = t.name + "#" + name
+		d.parent = t
+		m.tFiles[d.name] = d
+	}
+	t.defines = defines
+}
+
+// parseMessage parses a translated message, which may contain 
+// placeholders but no directives.
+func (m *Manager) parseMessage(s string) (tt *template.Template, err os.Error) {
+	tt = template.New(m.fmap)
+	tt.SetDelims(m.ldelim, m.rdelim)
+	err = tt.Parse(s)
+	return
+}
+
+// parseSource parses the source s of the given template file with the 
+// engine of the file, or preprocesses and parses it like parse if the file 
+// has no engine.
+func (m *Manager) parseSource(s, filename string, deps map[string]int64) (Executer,
+os.Error) {
+	if engine := m.engineOf(filename); engine != nil {
+		return engine.Parse(filename, s)
+	}
+	return m.parse(s, filename, deps)
+}
+
+// engineOf returns the engine of the template file filename, or nil if it 
+// is parsed by neste.
+func (m *Manager) engineOf(filename string) Engine {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.engines[filename]
+}
+
+// parsett returns the parsed template and the source for the template file 
+// filename at fpath and the modified times of the other files it depends on.
+func (m *Manager) parsett(filename, fpath string, mustParse bool) (tt Executer,
+src string, deps map[string]int64, err os.Error) {
+	var b []byte
+
+	// Parse template file.
+	b, err = m.readFile(fpath)
+	if err != nil {
+		op := "read"
+		if e, ok := err.(*os.PathError); ok && e.Op == "stat" {
+			op = "stat"
+		}
+		err = m.fileError(op, filename, fpath, err)
+	} else {
+		src = string(b)
+		deps = make(map[string]int64)
+		tt, err = m.parseSource(src, filename, deps)
+		if err != nil {
+			err = m.fileError("parse", filename, fpath, err)
+		}
+	}
+
+	if err != nil && mustParse {
+		panic(err)
+	}
+	return
+}
+
+// fileError returns err of the operation op on the template file filename 
+// at fpath as a *FileError.
+func (m *Manager) fileError(op, filename, fpath string, err os.Error) os.Error {
+	return &FileError{op, filename, absPath(fpath), err}
+}
+
+// compactSource returns the template source s with "\n" line endings and 
+// without trailing white space on its lines.
+func compactSource(s string) string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	s = strings.Replace(s, "\r", "\n", -1)
+
+	lines := strings.Split(s, "\n", -1)
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// readFile returns the contents of the given template file.
+func (m *Manager) readFile(path string) ([]byte, os.Error) {
+	// Check the size of the template file before reading it.
+	if m.maxSize > 0 {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if fi.Size > m.maxSize {
+			return nil, fmt.Errorf("neste: template file %s is too large "+
+				"(%d bytes, maximum is %d)", path, fi.Size, m.maxSize)
+		}
+	}
+
+	f, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if m.timeout <= 0 {
+		return ioutil.ReadAll(f)
+	}
+
+	// Read in a separate goroutine, so that we can give up on it.
+	// Closing the file on return unblocks the abandoned read.
+	type result struct {
+		b   []byte
+		err os.Error
+	}
+	done := make(chan result, 1)
+	go func() {
+		b, err := ioutil.ReadAll(f)
+		done <- result{b, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.b, r.err
+	case <-time.After(m.timeout):
+	}
+	return nil, fmt.Errorf("neste: reading template file %s timed out", path)
+}
+
+func (m *Manager) VisitDir(path_ string, f *os.FileInfo) bool {
+	return true
+}
+
+
+func (m *Manager) VisitFile(path_ string, f *os.FileInfo) {
+	m.addDirFile(m.relFilename(path_), true)
+}
+
+// dirPath returns the path of the directory dir of the base directory, 
+// for walking it. The current directory is "." instead of "".
+func (m *Manager) dirPath(dir string) string {
+	root := path.Join(m.baseDir, dir)
+	if root == "" {
+		return "."
+	}
+	return root
+}
+
+// openDir returns the path of the directory dir of the base directory 
+// like dirPath, or an error naming its absolute path if it can't be 
+// opened.
+func (m *Manager) openDir(dir string) (root string, err os.Error) {
+	root = m.dirPath(dir)
+	_, err = os.Stat(root)
+	if err != nil {
+		return "", fmt.Errorf("neste: can't open template directory %s: %s", absPath(root), err)
+	}
+	return
+}
+
+// relFilename returns the template filename for a path of a file 
+// in the base directory, with forward slashes like the filenames given 
+// to AddFile. The base directory may end with a separator, or be "" or "." 
+// for the current directory.
+func (m *Manager) relFilename(path_ string) string {
+	base, path_ := filepath.Clean(m.baseDir), filepath.Clean(path_)
+	if base != "." {
+		if !strings.HasSuffix(base, string(filepath.Separator)) {
+			base += string(filepath.Separator)
+		}
+		if strings.HasPrefix(path_, base) {
+			path_ = path_[len(base):]
+		}
+	}
+	return filepath.ToSlash(path_)
+}
+
+// addDirFile adds a template file found in a directory, as a partial if 
+// the file is in a partials directory.
+func (m *Manager) addDirFile(filename string, mustParse bool) (t *Template, err os.Error) {
+	t, err = m.addFile(filename, mustParse)
+	if err != nil {
+		return
+	}
+	m.setPartial(t)
+	return
+}
+
+// setPartial adds the template file t as a partial, if it is in 
+// a partials directory.
+func (m *Manager) setPartial(t *Template) {
+	dir := m.partialsDirOf(t.name)
+	if dir == "" {
+		return
+	}
+	name := t.name[len(dir)+1:]
+	partial := name[:len(name)-len(path.Ext(name))]
+	if old, present := m.lookupPartial(partial); present && old != t {
+		m.logf(LogWarning, "neste: partial %s of %s replaces the one of %s",
+			partial, t.name, old.name)
+	}
+	if _, ok := m.Lookup(partial); ok {
+		m.logf(LogWarning, "neste: partial %s of %s is hidden by the template %s",
+			partial, t.name, partial)
+	}
+
+	m.mu.Lock()
+	t.partial = partial
+	if m.partials == nil {
+		m.partials = make(map[string]*Template)
+	}
+	m.partials[partial] = t
+	m.mu.Unlock()
+}
+
+// partialsDirOf returns the partials directory containing the template file 
+// filename, or "" if it's not in one.
+func (m *Manager) partialsDirOf(filename string) string {
+	if m.partialDir != "" && strings.HasPrefix(filename, m.partialDir+"/") {
+		return m.partialDir
+	}
+
+	dirs := strings.Split(filename, "/", -1)
+	for i, dir := range dirs[:len(dirs)-1] {
+		if strings.HasPrefix(dir, "_") {
+			return strings.Join(dirs[:i+1], "/")
+		}
+	}
+	return ""
+}
+
+// dirAdder is a filepath.Visitor collecting the files it visits, and 
+// adding them to a template manager with add. It stops adding files after 
+// the first error, unless all is set, in which case it collects the errors 
+// in errs. With mustParse, the files are added like with MustAddFile. 
+// Symbolic links are handled by the symlink policy of the manager.
+type dirAdder struct {
+	m         *Manager
+	root      string // Directory being added
+	files     []*parsedFile
+	err       os.Error
+	all       bool
+	errs      []os.Error
+	mustParse bool
+	added     int // Number of files added
+}
+
+func (v *dirAdder) VisitDir(path_ string, f *os.FileInfo) bool {
+	return true
+}
+
+func (v *dirAdder) VisitFile(path_ string, f *os.FileInfo) {
+	filename := v.m.relFilename(path_)
+	file := &parsedFile{filename: filename}
+	v.files = append(v.files, file)
+	if f.IsSymlink() {
+		switch v.m.symlinks {
+		case SymlinkSkip:
+			v.files = v.files[:len(v.files)-1]
+			return
+		case SymlinkError:
+			file.err = v.m.fileError("stat", filename, path_,
+				os.NewError("symbolic links are not allowed"))
+			return
+		}
+		target, err := os.Stat(path_)
+		if err != nil {
+			file.err = v.m.fileError("stat", filename, path_, err)
+			return
+		}
+		if target.IsDirectory() {
+			v.files = v.files[:len(v.files)-1]
+			v.walkLink(path_, target)
+			return
+		}
+	}
+	file.path, file.err = v.m.filePath(filename)
+}
+
+// add parses the collected files concurrently and adds them to the template 
+// manager, the files in partials directories first, so that the other files 
+// can extend the partials wherever they were visited. Otherwise the files 
+// are added in the order they were visited in.
+func (v *dirAdder) add() {
+	var partials, others []*parsedFile
+	for _, f := range v.files {
+		if v.m.partialsDirOf(f.filename) != "" {
+			partials = append(partials, f)
+		} else {
+			others = append(others, f)
+		}
+	}
+	if v.addFiles(partials) {
+		v.addFiles(others)
+	}
+}
+
+// addFiles parses the files concurrently and adds them to the template 
+// manager in order. It returns false if adding stopped at an error.
+func (v *dirAdder) addFiles(files []*parsedFile) bool {
+	v.m.parseFiles(files)
+	for _, f := range files {
+		err := f.err
+		if err == nil {
+			err = v.m.addable(f.filename, f.path)
+		}
+		if err != nil {
+			v.fail(f.filename, err)
+			if !v.all {
+				return false
+			}
+			continue
+		}
+		v.m.setPartial(v.m.insertFile(f, v.mustParse))
+		v.added++
+	}
+	return true
+}
+
+// fail records the error err of adding the template file filename.
+func (v *dirAdder) fail(filename string, err os.Error) {
+	v.m.logf(LogError, "neste: adding %s failed: %s", filename, err)
+	if v.all {
+		if _, ok := err.(*FileError); !ok {
+			err = fmt.Errorf("neste: %s: %s", filename, err)
+		}
+		v.errs = append(v.errs, err)
+	} else {
+		v.err = err
+	}
+}
+
+// walkLink walks the directory target that the symbolic link at path_ 
+// refers to, unless it is a directory containing the link, which would 
+// make the walk loop.
+func (v *dirAdder) walkLink(path_ string, target *os.FileInfo) {
+	for dir := path.Dir(path_); ; dir = path.Dir(dir) {
+		fi, err := os.Stat(dir)
+		if err == nil && fi.Dev == target.Dev && fi.Ino == target.Ino {
+			v.m.logf(LogInfo, "neste: skipped %s, a symbolic link to %s", path_, dir)
+			return
+		}
+		if dir == v.root || dir == "." || dir == "/" {
+			break
+		}
+	}
+
+	f, err := os.Open(path_)
+	if err != nil {
+		v.readError(path_, err)
+		return
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		v.readError(path_, err)
+		return
+	}
+	sort.SortStrings(names)
+	for _, name := range names {
+		filepath.Walk(path.Join(path_, name), v, nil)
+	}
+}
 
-	m.MustAddFile(path_)
+// readError records the error err of reading the linked directory at path_.
+func (v *dirAdder) readError(path_ string, err os.Error) {
+	filename := v.m.relFilename(path_)
+	v.files = append(v.files, &parsedFile{filename: filename,
+		err: v.m.fileError("read", filename, path_, err)})
 }
 
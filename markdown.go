@@ -0,0 +1,113 @@
+// +build markdown
+
+// neste template engine: Markdown formatter
+//
+// The markdown formatter is opt-in. Build with MARKDOWN=1 to include it.
+
+package neste
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+	"template"
+)
+
+func init() {
+	builtinFormatters["markdown"] = MarkdownFormatter
+}
+
+/*
+Renders the value from Markdown to HTML. Supported are ATX headings 
+("# Title"), paragraphs separated by blank lines, **bold**, *emphasis*, 
+`code` and [links](http://example.com). Any HTML in the value is escaped, 
+and links with other schemes than http, https and mailto are left out.
+
+Example:
+
+	{body|markdown}
+
+If body is "# neste\n\nA **fast** template engine.", the output will be 
+"<h1>neste</h1>\n<p>A <strong>fast</strong> template engine.</p>\n".
+*/
+func MarkdownFormatter(w io.Writer, formatter string, data ...interface{}) {
+	var para []string
+	flush := func() {
+		if len(para) > 0 {
+			io.WriteString(w, "<p>"+markdownInline(strings.Join(para, "\n"))+"</p>\n")
+			para = nil
+		}
+	}
+
+	src := strings.Replace(string(getBytes(data...)), "\r\n", "\n", -1)
+	for _, line := range strings.Split(src, "\n", -1) {
+		line = strings.TrimRight(line, " \t")
+		level := 0
+		for level < len(line) && level < 6 && line[level] == '#' {
+			level++
+		}
+
+		switch {
+		case line == "":
+			flush()
+		case level > 0 && (level == len(line) || line[level] == ' '):
+			flush()
+			tag := string('0' + level)
+			text := strings.TrimSpace(strings.TrimRight(line[level:], "#"))
+			io.WriteString(w, "<h"+tag+">"+markdownInline(text)+"</h"+tag+">\n")
+		default:
+			para = append(para, strings.TrimSpace(line))
+		}
+	}
+	flush()
+}
+
+var (
+	markdownCode   = regexp.MustCompile("`[^`]+`")
+	markdownLink   = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	markdownStrong = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	markdownEm     = regexp.MustCompile(`\*([^*]+)\*`)
+)
+
+// markdownInline renders the inline elements of Markdown text to HTML.
+func markdownInline(s string) string {
+	var buf bytes.Buffer
+	last := 0
+	for _, loc := range markdownCode.FindAllStringIndex(s, -1) {
+		buf.WriteString(markdownSpans(s[last:loc[0]]))
+		buf.WriteString("<code>")
+		template.HTMLEscape(&buf, []byte(s[loc[0]+1:loc[1]-1]))
+		buf.WriteString("</code>")
+		last = loc[1]
+	}
+	buf.WriteString(markdownSpans(s[last:]))
+	return buf.String()
+}
+
+// markdownSpans renders links, bold and emphasis in Markdown text outside 
+// code spans to HTML.
+func markdownSpans(s string) string {
+	var buf bytes.Buffer
+	template.HTMLEscape(&buf, []byte(s))
+	s = buf.String()
+
+	s = markdownLink.ReplaceAllStringFunc(s, func(m string) string {
+		sub := markdownLink.FindStringSubmatch(m)
+		url := sub[2]
+		if i := strings.Index(url, ":"); i >= 0 && !strings.Contains(url[:i], "/") {
+			scheme := strings.ToLower(url[:i])
+			if scheme != "http" && scheme != "https" && scheme != "mailto" {
+				return sub[1]
+			}
+		}
+		return `<a href="` + url + `">` + sub[1] + "</a>"
+	})
+	s = markdownStrong.ReplaceAllStringFunc(s, func(m string) string {
+		return "<strong>" + m[2:len(m)-2] + "</strong>"
+	})
+	s = markdownEm.ReplaceAllStringFunc(s, func(m string) string {
+		return "<em>" + m[1:len(m)-1] + "</em>"
+	})
+	return s
+}
@@ -0,0 +1,34 @@
+// +build markdown
+
+package neste
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+func (s *S) TestMarkdownFormatter(c *C) {
+	if _, present := builtinFormatters["markdown"]; !present {
+		c.Skip("built without MARKDOWN=1")
+	}
+
+	tests := []struct{ src, html string }{
+		{"# neste", "<h1>neste</h1>\n"},
+		{"### Templates ###", "<h3>Templates</h3>\n"},
+		{"#hashtag", "<p>#hashtag</p>\n"},
+		{"A **fast** and *simple*\nengine.\n\nUse `{x|html}`.",
+			"<p>A <strong>fast</strong> and <em>simple</em>\nengine.</p>\n" +
+				"<p>Use <code>{x|html}</code>.</p>\n"},
+		{"See [neste](https://github.com/fzzbt/neste?a=1&b=2).",
+			`<p>See <a href="https://github.com/fzzbt/neste?a=1&amp;b=2">neste</a>.</p>` + "\n"},
+		{"[click](javascript:alert(1)) <script>",
+			"<p>click) &lt;script&gt;</p>\n"},
+	}
+
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("{body|markdown}", "markdown")
+	for _, test := range tests {
+		output, err := t.Render(map[string]string{"body": test.src})
+		c.Assert(err, IsNil)
+		c.Check(output, Equals, test.html)
+	}
+}
@@ -6,16 +6,110 @@
 	nested template files by naming and managing all templates and also allowing
 	generating output from them directly as strings.
 
-	neste also includes many useful built-in formatters.
+	neste also includes many useful built-in formatters. Some of them take 
+	an argument, which is given after a colon, like {body|wrap:72}.
 */
 package neste
 
 import (
 	"os"
+	"path"
+	"strings"
+	"time"
 )
 
-// getMtime returns modified time of the given file.
+// lstat returns the information of the named file without following 
+// symbolic links.
+var lstat = os.Lstat
+
+// getMtime returns modified time of the given file, or 0 if it can't be 
+// read.
 func getMtime(path string) int64 {
-	fi, _ := os.Lstat(path)
+	var fi *os.FileInfo
+	retry(func() (err os.Error) {
+		fi, err = lstat(path)
+		return
+	})
+	if fi == nil {
+		return 0
+	}
 	return fi.Mtime_ns
 }
+
+// retryDelays are the delays in nanoseconds before retrying interrupted 
+// file operations.
+var retryDelays = []int64{1e6, 2e6, 4e6}
+
+// retry calls fn, and calls it again after each of retryDelays as long as 
+// it fails with EINTR or EBUSY. It returns the error of the last call.
+func retry(fn func() os.Error) (err os.Error) {
+	for i := 0; ; i++ {
+		err = fn()
+		if !isInterrupted(err) || i == len(retryDelays) {
+			return
+		}
+		time.Sleep(retryDelays[i])
+	}
+	panic("unreachable")
+}
+
+// isInterrupted returns true if err is EINTR or EBUSY, possibly as the 
+// error of a *FileError or a *os.PathError.
+func isInterrupted(err os.Error) bool {
+	if e, ok := err.(*FileError); ok {
+		err = e.Err
+	}
+	if e, ok := err.(*os.PathError); ok {
+		err = e.Error
+	}
+	return err == os.EINTR || err == os.EBUSY
+}
+
+// absPath returns the absolute path of the file at p, or p if the working 
+// directory can't be determined.
+func absPath(p string) string {
+	if path.IsAbs(p) {
+		return p
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return p
+	}
+	return path.Join(wd, p)
+}
+
+// isOutside returns true if the cleaned path p is absolute or refers 
+// outside the directory it is relative to.
+func isOutside(p string) bool {
+	return path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../")
+}
+
+// inDir returns true if the cleaned path p is in the directory dir or its 
+// subdirectories.
+func inDir(dir, p string) bool {
+	dir = path.Clean(dir)
+	switch dir {
+	case ".":
+		return !isOutside(p)
+	case "/":
+		return path.IsAbs(p)
+	}
+	return strings.HasPrefix(p, dir+"/")
+}
+
+// slashFilename returns the template filename cleaned and with forward 
+// slashes as separators, which is how filenames are kept in template 
+// managers on every operating system, also if given with backslashes or 
+// like "./a.html".
+func slashFilename(filename string) string {
+	return path.Clean(strings.Replace(filename, "\\", "/", -1))
+}
+
+// checkFilename returns an *UnsafePathError if the template filename 
+// refers outside the base directory.
+func checkFilename(filename string) os.Error {
+	if isOutside(slashFilename(filename)) {
+		return &UnsafePathError{filename}
+	}
+	return nil
+}
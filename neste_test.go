@@ -2,12 +2,20 @@ package neste
 
 import (
 	. "launchpad.net/gocheck"
+	"template"
 	"testing"
 	"bytes"
+	"fmt"
+	"io"
 	"os"
 	"io/ioutil"
 	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+	"utf8"
 )
 
 // Hook up gocheck into the gotest runner.
@@ -31,6 +39,30 @@ const (
 	footerName  = "footer.html"
 )
 
+// Expected output of the nested templates
+const nestingExpected = `<!DOCTYPE HTML>
+<html>
+<head><title>Page Title</title>
+</head>
+<body>
+<div id="brand">neste template engine</div>
+<div id="content">
+<h1>Page Title</h1>
+<p>Example page to demonstrate nested templates.</p>
+<ul>
+<li>Example</li>
+<li>Listing</li>
+<li>Area</li>
+</ul>
+</div>
+<hr/><div id="footer">
+Posted : 25th July 2010 12:15
+</div>
+
+</body>
+</html>
+`
+
 func (s *S) TestAdd(c *C) {
 	tm := New(baseDir, nil)
 
@@ -67,6 +99,74 @@ func (s *S) TestClear(c *C) {
 	c.Assert(len(tm.tFiles), Equals, 0)
 }
 
+func (s *S) TestCopy(c *C) {
+	tm := New(baseDir, template.FormatterMap{})
+	tm.SetStrict(true)
+	t := tm.MustAdd("{name|capFirst}", "name")
+	tm.MustAddFile(path.Join("extends", "page.html"))
+
+	cp := tm.Copy()
+	c.Check(cp.AllIDs(), DeepEquals, tm.AllIDs())
+	c.Check(cp.AllFilenames(), DeepEquals, tm.AllFilenames())
+	c.Check(cp.strict, Equals, true)
+	c.Check(cp.Get("name") != t, Equals, true)
+	c.Check(cp.Get("name").source, Equals, t.source)
+
+	// Changing a formatter of the copy doesn't affect the original.
+	cp.fmap["capFirst"] = func(w io.Writer, formatter string, data ...interface{}) {
+		io.WriteString(w, "changed")
+	}
+	output, err := cp.Get("name").Render(map[string]string{"name": "ann"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "changed")
+
+	output, err = t.Render(map[string]string{"name": "ann"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "Ann")
+
+	expected, err := tm.GetFile(path.Join("extends", "page.html")).Render(map[string]string{})
+	c.Assert(err, IsNil)
+	output, err = cp.GetFile(path.Join("extends", "page.html")).Render(map[string]string{})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, expected)
+}
+
+func (s *S) TestReset(c *C) {
+	fmap := template.FormatterMap{"upper": func(w io.Writer, f string, v ...interface{}) {}}
+	tm := New(baseDir, fmap)
+	tm.MustAdd("{x}", "x")
+	tm.MustAddFile(indexName)
+	tm.SetDelims("<<", ">>")
+	tm.SetReloading(true)
+	tm.SetMaxFileSize(1024)
+	tm.SetReadTimeout(1e9)
+	tm.SetStrict(true)
+	tm.SetClock(func() *time.Time { return &time.Time{Year: 2011} })
+	tm.SetDateFormat("2006")
+	tm.SetLocale("fi")
+	err := tm.LoadCatalog("fi", map[string]string{"a": "b"})
+	c.Assert(err, IsNil)
+
+	tm.Reset()
+	c.Check(len(tm.tStrings), Equals, 0)
+	c.Check(len(tm.tFiles), Equals, 0)
+	c.Check(tm.baseDir, Equals, baseDir)
+	c.Check(tm.fmap["upper"], NotNil)
+	c.Check(tm.ldelim, Equals, "{")
+	c.Check(tm.rdelim, Equals, "}")
+	c.Check(tm.reloading, Equals, false)
+	c.Check(tm.maxSize, Equals, int64(0))
+	c.Check(tm.timeout, Equals, int64(0))
+	c.Check(tm.strict, Equals, false)
+	c.Check(tm.dateFormat, Equals, "2006-01-02")
+	c.Check(tm.locale, Equals, "")
+	c.Check(len(tm.catalogs), Equals, 0)
+
+	output, err := tm.MustAdd("{now 2006}", "now").Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, time.LocalTime().Format("2006"))
+}
+
 func (s *S) TestExecute(c *C) {
 	var data = map[string]string{
 		"head":    "<title>Execute</title>",
@@ -122,6 +222,7 @@ func (s *S) TestFormatters(c *C) {
 {unesc1 unesc2 unesc3|html}
 {unesc1 unesc2 unesc3|e}
 {unslashed|addSlashes}
+{unslashed|addSlashesAll}
 {uncapped|capFirst}
 {uncapped2|capFirst}
 `
@@ -138,6 +239,7 @@ func (s *S) TestFormatters(c *C) {
 &lt;hack&gt;\&amp;hack\&lt;/hack&gt;
 &lt;hack&gt;\&amp;hack\&lt;/hack&gt;
 \"I'm using neste\"
+\"I\'m using neste\"
 Neste
 Ǿxy
 `
@@ -150,30 +252,609 @@ Neste
 	c.Assert(output, Equals, expected)
 }
 
-func (s *S) TestNesting(c *C) {
-	expected :=
-`<!DOCTYPE HTML>
-<html>
-<head><title>Page Title</title>
-</head>
-<body>
-<div id="brand">neste template engine</div>
-<div id="content">
-<h1>Page Title</h1>
-<p>Example page to demonstrate nested templates.</p>
-<ul>
-<li>Example</li>
-<li>Listing</li>
-<li>Area</li>
-</ul>
-</div>
-<hr/><div id="footer">
-Posted : 25th July 2010 12:15
-</div>
+func (s *S) TestJsonEncodeFormatter(c *C) {
+	type user struct {
+		Name string
+		Tags []string
+	}
+	data := map[string]interface{}{
+		"user":  user{"neste", []string{"a", "b"}},
+		"map":   map[string]int{"n": 1},
+		"slice": []interface{}{1, "two", nil},
+		"html":  "</script><!-- & -->",
+		"bad":   make(chan int)}
 
-</body>
-</html>
-`
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("{user|json}\n{map|json}\n{slice|json}\n{html|json}\n{bad|json}", "json")
+	output, err := t.Render(data)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, `{"Name":"neste","Tags":["a","b"]}
+{"n":1}
+[1,"two",null]
+"\u003c/script\u003e\u003c!-- \u0026 --\u003e"
+null`)
+}
+
+func (s *S) TestWrapFormatter(c *C) {
+	tests := []struct{ src, value, wrapped string }{
+		{"{value|wrap:10}", "The quick brown fox jumps over the lazy dog",
+			"The quick\nbrown fox\njumps over\nthe lazy\ndog"},
+		{"{value|wrap:10}", "abcdefghijklmnopqrstuvwxyz and more",
+			"abcdefghij\nklmnopqrst\nuvwxyz and\nmore"},
+		{"{value|wrap:10}", "over the  lazy\n\ndog   and  fox",
+			"over the\nlazy\n\ndog and\nfox"},
+		{"{value|wrap:3}", "äää öööö", "äää\nööö\nö"},
+		{"{value|wrap:72}", "Dear user,\n\nWelcome to neste.\n", "Dear user,\n\nWelcome to neste.\n"},
+		{"{value|wrap}", strings.Repeat("word ", 20),
+			strings.Repeat("word ", 15) + "word\n" + strings.Repeat("word ", 3) + "word"},
+		{"{value|wrap:x}", "short", "short"},
+		{"{value|wrap:5}", "", ""},
+	}
+
+	tm := New(baseDir, nil)
+	for i, test := range tests {
+		t := tm.MustAdd(test.src, "wrap"+string('a'+i))
+		output, err := t.Render(map[string]string{"value": test.value})
+		c.Assert(err, IsNil)
+		c.Check(output, Equals, test.wrapped)
+	}
+
+	_, err := tm.Add("{value|nowrap:10}", "unknown")
+	c.Check(err, NotNil)
+}
+
+func (s *S) TestCountFormatter(c *C) {
+	tests := []struct{ value, counted string }{
+		{"Hello neste world", "Hello neste world (3 words)|3"},
+		{"  spaced\tout \n words ", "  spaced\tout \n words  (3 words)|3"},
+		{"neste", "neste (1 word)|1"},
+		{"", " (0 words)|0"},
+	}
+
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("{value|count}|{value|wordcount}", "count")
+	for _, test := range tests {
+		output, err := t.Render(map[string]string{"value": test.value})
+		c.Assert(err, IsNil)
+		c.Check(output, Equals, test.counted)
+	}
+}
+
+func (s *S) TestEllipsisFormatter(c *C) {
+	tests := []struct{ src, value, output string }{
+		{"{value|ellipsis:10}", "Hello neste world", "Hello nest…"},
+		{"{value|ellipsis:10}", "Hello", "Hello…"},
+		{"{value|ellipsis:10,truncated}", "Hello neste world", "Hello nest…"},
+		{"{value|ellipsis:10,truncated}", "Hello", "Hello"},
+		{"{value|ellipsis:3}", "ääkkönen", "ääk…"},
+		{"{value|ellipsis}", "Hello", "Hello…"},
+	}
+
+	tm := New(baseDir, nil)
+	for i, test := range tests {
+		t := tm.MustAdd(test.src, "ellipsis"+string('a'+i))
+		output, err := t.Render(map[string]string{"value": test.value})
+		c.Assert(err, IsNil)
+		c.Check(output, Equals, test.output)
+	}
+
+	// The ellipsis is a single character.
+	output, err := tm.MustAdd("{value|ellipsis:2}", "rune").Render(map[string]string{"value": "abc"})
+	c.Assert(err, IsNil)
+	c.Check(utf8.RuneCountInString(output), Equals, 3)
+	rune, _ := utf8.DecodeLastRuneInString(output)
+	c.Check(rune, Equals, 0x2026)
+}
+
+func (s *S) TestHTMLUnescapeFormatter(c *C) {
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("{value|htmlunescape}", "unescape")
+	output, err := t.Render(map[string]string{"value": "&lt;b&gt;Tom &amp; Jerry&#39;s&lt;/b&gt; &quot;&#x263a;&quot;"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, `<b>Tom & Jerry's</b> "☺"`)
+
+	t = tm.MustAdd("{value|html|htmlunescape}", "roundtrip")
+	for _, value := range []string{`<a href="x">'Tom' & "Jerry"</a>`, "plain", ""} {
+		output, err = t.Render(map[string]string{"value": value})
+		c.Assert(err, IsNil)
+		c.Check(output, Equals, value)
+	}
+}
+
+func (s *S) TestLineCountFormatter(c *C) {
+	tests := []struct{ value, count string }{
+		{"one line", "1"},
+		{"one\ntwo\nthree", "3"},
+		{"one\ntwo\n", "2"},
+		{"one\n\n", "2"},
+		{"\n", "1"},
+		{"", "0"},
+	}
+
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("{value|linecount}", "linecount")
+	for _, test := range tests {
+		output, err := t.Render(map[string]string{"value": test.value})
+		c.Assert(err, IsNil)
+		c.Check(output, Equals, test.count)
+	}
+}
+
+func (s *S) TestByteSizeFormatter(c *C) {
+	tests := []struct {
+		src    string
+		value  interface{}
+		output string
+	}{
+		{"{value|bytesize}", int64(1536), "1.5 KB"},
+		{"{value|bytesize}", int64(1048576), "1.0 MB"},
+		{"{value|bytesize}", 512, "512 B"},
+		{"{value|bytesize}", int64(5) << 40, "5.0 TB"},
+		{"{value|bytesize:binary}", int64(1536), "1.5 KiB"},
+		{"{value|bytesize:binary}", int64(3) << 30, "3.0 GiB"},
+		{"{value|bytesize:si}", int64(1536), "1.5 KB"},
+		{"{value|bytesize:si}", int64(2500000), "2.5 MB"},
+		{"{value|bytesize}", "big", "big"},
+	}
+
+	tm := New(baseDir, nil)
+	for i, test := range tests {
+		t := tm.MustAdd(test.src, "bytesize"+string('a'+i))
+		output, err := t.Render(map[string]interface{}{"value": test.value})
+		c.Assert(err, IsNil)
+		c.Check(output, Equals, test.output)
+	}
+}
+
+func (s *S) TestURLAttrFormatter(c *C) {
+	tests := []struct{ value, output string }{
+		{"http://example.com/?a=1&b=2", "http://example.com/?a=1&amp;b=2"},
+		{"MAILTO:ann@example.com", "MAILTO:ann@example.com"},
+		{"/posts/1#top", "/posts/1#top"},
+		{"posts?at=1:30", "posts?at=1:30"},
+		{"javascript:alert(1)", "#"},
+		{" Java\tScript:alert(1)", "#"},
+		{"data:text/html,<b>", "#"},
+	}
+
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("{value|urlAttr}", "urlAttr")
+	for _, test := range tests {
+		output, err := t.Render(map[string]string{"value": test.value})
+		c.Assert(err, IsNil)
+		c.Check(output, Equals, test.output)
+	}
+}
+
+func (s *S) TestJSFormatter(c *C) {
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("{value|js}", "js")
+	output, err := t.Render(map[string]string{"value": "it's \"<b>\"\\\n\u2028"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, `it\x27s \x22\x3cb\x3e\x22\\\n\u2028`)
+}
+
+func (s *S) TestPluralizeFormatter(c *C) {
+	tests := []struct {
+		src    string
+		count  interface{}
+		output string
+	}{
+		{"{count|pluralize:item:items}", 0, "items"},
+		{"{count|pluralize:item:items}", 1, "item"},
+		{"{count|pluralize:item:items}", 2, "items"},
+		{"{count|pluralize:item:items}", "many", "items"},
+		{"{count|pluralize:item:items}", 1.5, "items"},
+		{"{count|pluralize:child:children}", int64(1), "child"},
+		{"{count|pluralize:apple}", 3, "apples"},
+		{"item{count|pluralize}", 1, "item"},
+		{"item{count|pluralize}", 2, "items"},
+	}
+
+	tm := New(baseDir, nil)
+	for i, test := range tests {
+		t := tm.MustAdd(test.src, "pluralize"+string('a'+i))
+		output, err := t.Render(map[string]interface{}{"count": test.count})
+		c.Assert(err, IsNil)
+		c.Check(output, Equals, test.output)
+	}
+}
+
+func (s *S) TestOrdinalFormatter(c *C) {
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("{day|ordinal}", "ordinal")
+
+	suffixes := map[int]string{1: "st", 2: "nd", 3: "rd", 21: "st", 22: "nd", 23: "rd", 31: "st"}
+	for day := 1; day <= 31; day++ {
+		suffix, present := suffixes[day]
+		if !present {
+			suffix = "th"
+		}
+		output, err := t.Render(map[string]int{"day": day})
+		c.Assert(err, IsNil)
+		c.Check(output, Equals, strconv.Itoa(day)+suffix)
+	}
+
+	tests := []struct {
+		day    interface{}
+		output string
+	}{
+		{111, "111th"},
+		{112, "112th"},
+		{101, "101st"},
+		{0, "0th"},
+		{-2, "-2nd"},
+		{"first", "first"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		output, err := t.Render(map[string]interface{}{"day": test.day})
+		c.Assert(err, IsNil)
+		c.Check(output, Equals, test.output)
+	}
+}
+
+func (s *S) TestIndentFormatter(c *C) {
+	tests := []struct{ src, value, indented string }{
+		{"{value|indent:4}", "one\n\nthree", "    one\n    \n    three"},
+		{"{value|indent:4,skipblank}", "one\n\nthree", "    one\n\n    three"},
+		{"{value|indent:2}", "a:\n  b: 1\n", "  a:\n    b: 1\n"},
+		{"{value|indent}", "x", "    x"},
+		{"{value|indent:0}", "x\ny", "x\ny"},
+		{"{value|indent:3}", "", ""},
+	}
+
+	tm := New(baseDir, nil)
+	for i, test := range tests {
+		t := tm.MustAdd(test.src, "indent"+string('a'+i))
+		output, err := t.Render(map[string]string{"value": test.value})
+		c.Assert(err, IsNil)
+		c.Check(output, Equals, test.indented)
+	}
+}
+
+func (s *S) TestSanitizeFormatter(c *C) {
+	tests := []struct{ value, sanitized string }{
+		{"john_doe-1.0", "john_doe-1.0"},
+		{"<b>bold</b>", "bboldb"},
+		{`<script>alert("x")</script>`, "scriptalertxscript"},
+		{"Jörg © 2011 ™ → ok\u200b!", "Jörg2011ok"},
+		{"", ""},
+	}
+
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("{value|sanitize}", "sanitize")
+	for _, test := range tests {
+		output, err := t.Render(map[string]string{"value": test.value})
+		c.Assert(err, IsNil)
+		c.Check(output, Equals, test.sanitized)
+	}
+
+	tm.WithFunc("sanitize", NewSanitizeFormatter("@"))
+	t = tm.MustAdd("{value|sanitize}", "email")
+	output, err := t.Render(map[string]string{"value": "<john.doe@example.com>"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "johndoe@examplecom")
+}
+
+func (s *S) TestSlugFormatter(c *C) {
+	tests := []struct{ value, slug string }{
+		{"Hello World", "hello-world"},
+		{"Héllo Wörld", "hello-world"},
+		{"  --Go: Straße & Œuvre!--  ", "go-strasse-oeuvre"},
+		{"Çà   et  là, 2011", "ca-et-la-2011"},
+		{"日本語 text", "text"},
+		{"!@#$%^&*()", ""},
+		{"", ""},
+	}
+
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("{value|slug}", "slug")
+	for _, test := range tests {
+		output, err := t.Render(map[string]string{"value": test.value})
+		c.Assert(err, IsNil)
+		c.Check(output, Equals, test.slug)
+	}
+}
+
+func (s *S) TestRenderAll(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"index.html":         "<h1>{title}</h1>",
+		"docs/intro.tmpl":    "<p>{intro}</p>",
+		"docs/api/list.html": "{.repeated section funcs}{@} {.end}",
+		"broken.html":        "{missing}"})
+	defer os.RemoveAll(dir)
+	outDir := path.Join(dir, "out")
+
+	tm := New(dir, nil)
+	c.Assert(tm.AddDir(dir), IsNil)
+	tm.SetOutputExtensions(map[string]string{".tmpl": ".html"})
+	written, err := tm.RenderAll(outDir, map[string]interface{}{
+		"index.html":         map[string]string{"title": "neste"},
+		"docs/intro.tmpl":    map[string]string{"intro": "Hello"},
+		"docs/api/list.html": map[string][]string{"funcs": []string{"New", "Add"}},
+		"broken.html":        &struct{}{},
+		"missing.html":       nil})
+
+	c.Check(written, DeepEquals, []string{
+		path.Join(outDir, "docs/api/list.html"),
+		path.Join(outDir, "docs/intro.html"),
+		path.Join(outDir, "index.html")})
+	c.Assert(err, NotNil)
+	errs, ok := err.(RenderErrors)
+	c.Assert(ok, Equals, true)
+	c.Check(len(errs), Equals, 2)
+	c.Check(errs["broken.html"], NotNil)
+	c.Check(errs["missing.html"], ErrorMatches, "neste: no such template: missing.html")
+
+	expected := map[string]string{
+		"index.html":         "<h1>neste</h1>",
+		"docs/intro.html":    "<p>Hello</p>",
+		"docs/api/list.html": "New Add "}
+	for filename, content := range expected {
+		b, err := ioutil.ReadFile(path.Join(outDir, filename))
+		c.Assert(err, IsNil)
+		c.Check(string(b), Equals, content)
+	}
+	_, err = os.Stat(path.Join(outDir, "broken.html"))
+	c.Check(err, NotNil)
+
+	// No temporary files are left behind.
+	f, err := os.Open(path.Join(outDir, "docs"))
+	c.Assert(err, IsNil)
+	entries, err := f.Readdirnames(-1)
+	f.Close()
+	c.Assert(err, IsNil)
+	sort.SortStrings(entries)
+	c.Check(entries, DeepEquals, []string{"api", "intro.html"})
+}
+
+func (s *S) TestRenderWithJSON(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"pricing.json": `{
+	"title": "Pricing",
+	"plan": {"name": "Pro", "price": 9.5, "seats": 10},
+	"features": [
+		{"name": "Templates", "count": 100},
+		{"name": "Users", "count": 1e6}
+	]
+}`,
+		"bad.json": "{\n\t\"title\": \"Pricing\",\n\t\"plan\": ]\n}"})
+	defer os.RemoveAll(dir)
+
+	tm := New(baseDir, nil)
+	tm.MustAdd("<h1>{title}</h1>\n"+
+		"{.section plan}{name}: {price} for {seats}{.end}\n"+
+		"{.repeated section features}<li>{name|html} x{count}</li>{.end}", "pricing")
+	expected := "<h1>Pricing</h1>\n" +
+		"Pro: 9.5 for 10\n" +
+		"<li>Templates x100</li><li>Users x1000000</li>"
+
+	output, err := tm.RenderWithJSON("pricing", path.Join(dir, "pricing.json"))
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, expected)
+
+	f, err := os.Open(path.Join(dir, "pricing.json"))
+	c.Assert(err, IsNil)
+	defer f.Close()
+	output, err = tm.RenderWithJSONReader("pricing", f)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, expected)
+
+	_, err = tm.RenderWithJSON("pricing", path.Join(dir, "bad.json"))
+	c.Assert(err, NotNil)
+	jerr, ok := err.(*JSONError)
+	c.Assert(ok, Equals, true)
+	c.Check(jerr.Line, Equals, 3)
+	c.Check(err, ErrorMatches, "neste: .*bad.json:3: .*")
+
+	_, err = tm.RenderWithJSON("pricing", path.Join(dir, "missing.json"))
+	c.Check(err, NotNil)
+	_, err = tm.RenderWithJSON("missing", path.Join(dir, "pricing.json"))
+	c.Check(err, ErrorMatches, "neste: no such template: missing")
+}
+
+func (s *S) TestNewText(c *C) {
+	tm := NewText(baseDir, nil)
+	for _, name := range []string{"html", "e", "attr", "safe"} {
+		_, err := tm.Add("{x|"+name+"}", name)
+		c.Check(err, ErrorMatches, `neste: unknown formatter: "`+name+`"`)
+	}
+	_, err := New(baseDir, nil).Add("{x|csv}", "csv")
+	c.Check(err, ErrorMatches, `neste: unknown formatter: "csv"`)
+
+	tm.SetAutoEscape(true)
+	t := tm.MustAdd("name,price,note\n"+
+		"{.repeated section rows}{name|csv},{price|csv},{note|csv}\n{.end}", "export")
+	output, err := t.Render(map[string]interface{}{"rows": []map[string]interface{}{
+		{"name": "<Tea>", "price": 3.5, "note": `green, "sencha"`},
+		{"name": "Coffee", "price": 4, "note": " strong\nblack"},
+	}})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "name,price,note\n"+
+		"<Tea>,3.5,\"green, \"\"sencha\"\"\"\n"+
+		"Coffee,4,\" strong\nblack\"\n")
+
+	t = tm.MustAdd("[{name|ljust:8}][{price|rjust:6}][{name|ljust:2}]", "justified")
+	output, err = t.Render(map[string]string{"name": "Tea", "price": "3.50"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "[Tea     ][  3.50][Tea]")
+
+	t = tm.MustAdd("{body|wordwrap:10}", "wordwrap")
+	output, err = t.Render(map[string]string{"body": "plain text email"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "plain text\nemail")
+
+	// The formatter sets are kept on reset.
+	tm.Reset()
+	_, err = tm.Add("{x|html}", "html")
+	c.Check(err, NotNil)
+	_, err = tm.Add("{x|csv}", "csv")
+	c.Check(err, IsNil)
+}
+
+func (s *S) TestRenderEmail(c *C) {
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("Subject: Welcome, {name}!\n"+
+		"\n"+
+		"Hello {name},\n"+
+		"\n"+
+		"{.repeated section steps}- {@}\n{.end}\n"+
+		"\n"+
+		"Thanks.\n", "welcome")
+	data := map[string]interface{}{"name": "neste", "steps": []string{"Sign in", "Have fun"}}
+
+	subject, body, err := t.RenderEmail(data)
+	c.Assert(err, IsNil)
+	c.Check(subject, Equals, "Welcome, neste!")
+	c.Check(body, Equals, "Hello neste,\n\n- Sign in\n- Have fun\n\nThanks.\n")
+
+	// The subject is a single line.
+	data["name"] = "neste\nBcc: everyone"
+	subject, _, err = t.RenderEmail(data)
+	c.Assert(err, IsNil)
+	c.Check(subject, Equals, "Welcome, neste")
+
+	// Templates without a header have an empty subject.
+	t = tm.MustAdd("Hello {name}.\n\nBye.", "plain")
+	subject, body, err = t.RenderEmail(map[string]string{"name": "neste"})
+	c.Assert(err, IsNil)
+	c.Check(subject, Equals, "")
+	c.Check(body, Equals, "Hello neste.\n\nBye.")
+
+	// Headers may end with CRLF.
+	t = tm.MustAdd("Subject: Hi {name}\r\n\r\nBye {name}.", "crlf")
+	subject, body, err = t.RenderEmail(map[string]string{"name": "neste"})
+	c.Assert(err, IsNil)
+	c.Check(subject, Equals, "Hi neste")
+	c.Check(body, Equals, "Bye neste.")
+
+	t = tm.MustAdd("Subject: Hi {name}\nBye {name}.", "noblank")
+	subject, body, err = t.RenderEmail(map[string]string{"name": "neste"})
+	c.Check(err, ErrorMatches, "neste: noblank: no blank line after the email header")
+	c.Check(subject, Equals, "")
+	c.Check(body, Equals, "")
+
+	t = tm.MustAdd("Subject: {missing}\n\nBody", "failing")
+	subject, body, err = t.RenderEmail(&struct{}{})
+	c.Check(err, NotNil)
+	c.Check(subject, Equals, "")
+	c.Check(body, Equals, "")
+}
+
+func (s *S) TestSetLogger(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"a.html":     "a",
+		"sub/b.html": "{.section x}"})
+	defer os.RemoveAll(dir)
+
+	type event struct {
+		level int
+		msg   string
+	}
+	var events []event
+	tm := New(dir, nil)
+	tm.SetLogger(func(level int, format string, args ...interface{}) {
+		events = append(events, event{level, fmt.Sprintf(format, args...)})
+	})
+
+	t, err := tm.AddFile("a.html")
+	c.Assert(err, IsNil)
+	err = tm.AddDir("sub")
+	c.Check(err, NotNil)
+	c.Assert(len(events), Equals, 2)
+	c.Check(events[0], Equals, event{LogDebug, "neste: added a.html"})
+	c.Check(events[1].level, Equals, LogError)
+	c.Check(events[1].msg, Matches, "neste: adding sub/b.html failed: .*")
+
+	// Reloading
+	filename := path.Join(dir, "a.html")
+	touch := func(content string) {
+		err := ioutil.WriteFile(filename, []byte(content), 0644)
+		c.Assert(err, IsNil)
+		mtime := getMtime(filename) + 10e9
+		c.Assert(os.Chtimes(filename, mtime, mtime), IsNil)
+	}
+	events = nil
+	touch("b")
+	c.Assert(t.Reload(), IsNil)
+	c.Check(events, DeepEquals, []event{{LogInfo, "neste: reloaded a.html"}})
+
+	events = nil
+	touch("{.end}")
+	c.Check(t.Reload(), NotNil)
+	c.Assert(len(events), Equals, 1)
+	c.Check(events[0].level, Equals, LogError)
+	c.Check(events[0].msg, Matches, "neste: reloading a.html failed: .*")
+
+	// Without a logger, nothing is logged.
+	touch("c")
+	events = nil
+	tm.SetLogger(nil)
+	c.Assert(t.Reload(), IsNil)
+	tm.MustAddFile("a.html")
+	c.Check(events, IsNil)
+}
+
+func (s *S) TestSetTraceHooks(c *C) {
+	tm := New(baseDir, nil)
+	tm.MustAdd("<h1>{title}</h1>", "header")
+	tm.MustAdd("<p>{text}</p>", "footer")
+	tm.MustAdd("{missing}", "failing")
+	page := tm.MustAdd(`{include "header"}{footer}`, "page")
+
+	var events []string
+	tokens := 0
+	tm.SetTraceHooks(func(name string) interface{} {
+		events = append(events, "begin "+name)
+		tokens++
+		return tokens
+	}, func(name string, token interface{}, err os.Error, bytes int, ns int64) {
+		events = append(events, fmt.Sprintf("end %s %v %d %v", name, token, bytes, err != nil))
+		c.Check(ns >= 0, Equals, true)
+	})
+
+	output, err := page.Render(map[string]interface{}{
+		"title":  "neste",
+		"footer": Nested{tm.MustGet("footer"), map[string]string{"text": "bye"}}})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "<h1>neste</h1><p>bye</p>")
+	c.Check(events, DeepEquals, []string{
+		"begin page",
+		"begin footer",
+		"end footer 2 10 false",
+		"begin header",
+		"end header 3 14 false",
+		"end page 1 24 false"})
+
+	// Errors are passed to the end hook.
+	events = nil
+	_, err = tm.MustGet("failing").Render(&struct{}{})
+	c.Check(err, NotNil)
+	c.Check(events, DeepEquals, []string{"begin failing", "end failing 4 0 true"})
+
+	// Output captured by other directives is counted as finally written.
+	events = nil
+	output, err = tm.MustAdd("{spaceless}<div>\n{include \"header\"}\n</div>{endspaceless}"+
+		"{ifequal title \"x\"}{include \"header\"}{end}", "captured").Render(map[string]string{"title": "neste"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "<div><h1>neste</h1></div>")
+	c.Check(events, DeepEquals, []string{
+		"begin captured",
+		"begin header",
+		"end header 6 14 false",
+		"begin header",
+		"end header 7 14 false",
+		"end captured 5 25 false"})
+
+	tm.SetTraceHooks(nil, nil)
+	events = nil
+	_, err = page.Render(map[string]interface{}{"title": "neste", "footer": ""})
+	c.Assert(err, IsNil)
+	c.Check(events, IsNil)
+}
+
+func (s *S) TestNesting(c *C) {
 	var err os.Error
 	var indexData = map[string]string{}
 	var headData = map[string]string{"title": "Page Title"}
@@ -210,68 +891,1781 @@ Posted : 25th July 2010 12:15
 
 	output, err := tIndex.Render(indexData)
 	c.Assert(err, IsNil)
-	c.Assert(output, Equals, expected)
+	c.Assert(output, Equals, nestingExpected)
 }
 
-func (s *S) TestReload(c *C) {
-	rlName := "reloading.neste"
-	rlPath := path.Join(baseDir, rlName)
-	data := "foo"
-	st := []byte("starting template: {@}\n")
-	mt := []byte("modified template: {@}\n")
-	sExpected := "starting template: foo\n"
-	mExpected := "modified template: foo\n"
+func (s *S) TestNewFromDir(c *C) {
+	var err os.Error
+	var indexData = map[string]string{}
+	var listData = map[string]interface{}{"items": &[3]string{"Example", "Listing", "Area"}}
+	var contentData = map[string]string{
+		"title":   "Page Title",
+		"opening": "Example page to demonstrate nested templates."}
 
-	ioutil.WriteFile(rlPath, st, 0644)
-	tm := New(baseDir, nil)
-	t := tm.MustAddFile(rlName)
+	tm, err := NewFromDir(baseDir, nil)
+	c.Assert(err, IsNil)
 
-	output, err := t.Render(data)
+	contentData["list"], err = tm.GetFile(listName).Render(listData)
 	c.Assert(err, IsNil)
-	c.Assert(output, Equals, sExpected)
 
-	// Write changes and reload
-	ioutil.WriteFile(rlPath, mt, 0644)
-	// Attempt to force mtime to change.
-	err = os.Chtimes(rlPath, time.Nanoseconds(), time.Nanoseconds())
+	indexData["head"], err = tm.GetFile(headName).Render(map[string]string{"title": "Page Title"})
 	c.Assert(err, IsNil)
-	
-	err = t.Reload()
+
+	indexData["brand"], err = tm.GetFile(brandName).Render(map[string]string{})
 	c.Assert(err, IsNil)
 
-	output, err = t.Render(data)
+	indexData["content"], err = tm.GetFile(contentName).Render(contentData)
 	c.Assert(err, IsNil)
-	c.Assert(output, Equals, mExpected)
+
+	indexData["footer"], err = tm.GetFile(footerName).Render(map[string]string{"posted": "25th July 2010 12:15"})
+	c.Assert(err, IsNil)
+
+	output, err := tm.GetFile(indexName).Render(indexData)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, nestingExpected)
+
+	// Templates in subdirectories are added too.
+	c.Check(tm.GetFile(path.Join("extends", "page.html")), NotNil)
+
+	_, err = NewFromDir(path.Join(baseDir, "missing"), nil)
+	c.Check(err, NotNil)
 }
 
-func (s *S) TestReloading(c *C) {
-	rlName := "reloading.neste"
-	rlPath := path.Join(baseDir, rlName)
-	data := "foo"
-	st := []byte("starting template: {@}\n")
-	mt := []byte("modified template: {@}\n")
-	sExpected := "starting template: foo\n"
-	mExpected := "modified template: foo\n"
+func (s *S) TestAddDirError(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"a.html":     "{title}",
+		"b.html":     "{.section title}",
+		"sub/c.html": "{title}"})
+	defer os.RemoveAll(dir)
 
-	ioutil.WriteFile(rlPath, st, 0644)
-	tm := New(baseDir, nil)
-	c.Assert(tm.reloading, Equals, false)
-	t := tm.MustAddFile(rlName)
+	tm := New(dir, nil)
+	err := tm.AddDir("")
+	c.Assert(err, NotNil)
+	c.Check(tm.GetFile("a.html"), NotNil)
+	c.Check(tm.GetFile("b.html"), IsNil)
+}
 
-	output, err := t.Render(data)
-	c.Assert(err, IsNil)
-	c.Assert(output, Equals, sExpected)
+func (s *S) TestAddDirAll(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"a.html":     "{title}",
+		"b.html":     "{.section title}",
+		"sub/c.html": "{title}",
+		"sub/d.html": "{title|nosuchformatter}"})
+	defer os.RemoveAll(dir)
 
-	// Write changes
-	ioutil.WriteFile(rlPath, mt, 0644)
-	tm.SetReloading(true)
+	tm := New(dir, nil)
+	errs := tm.AddDirAll("")
+	c.Assert(len(errs), Equals, 2)
+	c.Check(errs[0], ErrorMatches, "neste: b.html: .*")
+	c.Check(errs[1], ErrorMatches, "neste: sub/d.html: .*")
+	c.Check(tm.GetFile("a.html"), NotNil)
+	c.Check(tm.GetFile("sub/c.html"), NotNil)
 
-	// Attempt to force mtime to change.
-	err = os.Chtimes(rlPath, time.Nanoseconds(), time.Nanoseconds())
-	c.Assert(err, IsNil)
+	c.Check(New(dir, nil).AddDirAll("sub/c.html"), IsNil)
+	c.Check(len(New(dir, nil).AddDirAll("missing")), Equals, 1)
+}
 
-	output, err = t.Render(data)
+func (s *S) TestAddDirBaseDirs(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"templates/a.html":     "a",
+		"templates/sub/b.html": "b"})
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
 	c.Assert(err, IsNil)
-	c.Assert(output, Equals, mExpected)
+	defer os.Chdir(wd)
+
+	check := func(baseDir string) {
+		tm := New(baseDir, nil)
+		tm.MustAddDir("")
+		c.Check(tm.AllFilenames(), DeepEquals, []string{"a.html", "sub/b.html"})
+		tm = New(baseDir, nil)
+		c.Check(tm.AddDir("sub"), IsNil)
+		c.Check(tm.AllFilenames(), DeepEquals, []string{"sub/b.html"})
+	}
+
+	c.Assert(os.Chdir(dir), IsNil)
+	check("templates")
+	check("templates/")
+	check("./templates")
+	check(path.Join(dir, "templates"))
+	check(path.Join(dir, "templates") + "/")
+	c.Assert(os.Chdir(path.Join(dir, "templates")), IsNil)
+	check(".")
+	check("")
+}
+
+func (s *S) TestAddDirMissingOrEmpty(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"a.html":          "a",
+		"empty/sub/.keep": ""})
+	defer os.RemoveAll(dir)
+	c.Assert(os.Remove(path.Join(dir, "empty/sub/.keep")), IsNil)
+
+	// Missing directories are errors naming the absolute path.
+	tm := New(dir, nil)
+	err := tm.AddDir("missing")
+	c.Check(err, ErrorMatches, "neste: can't open template directory "+dir+"/missing: .*")
+	v := recoverPanic(func() { tm.MustAddDir("missing") })
+	c.Assert(v, NotNil)
+	c.Check(v.(os.Error), ErrorMatches, "neste: can't open template directory "+dir+"/missing: .*")
+
+	// Directories without template files are errors only for MustAddDir.
+	c.Check(tm.AddDir("empty"), IsNil)
+	v = recoverPanic(func() { tm.MustAddDir("empty") })
+	c.Assert(v, NotNil)
+	c.Check(v.(os.Error), ErrorMatches, "neste: template directory "+dir+"/empty has no template files")
+
+	c.Check(recoverPanic(func() { tm.MustAddDir("") }), IsNil)
+	c.Check(tm.AllFilenames(), DeepEquals, []string{"a.html"})
 }
 
+func (s *S) TestSetSymlinkPolicy(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"a.html":     "a",
+		"sub/b.html": "b"})
+	defer os.RemoveAll(dir)
+	c.Assert(os.Symlink("a.html", path.Join(dir, "c.html")), IsNil)
+	c.Assert(os.Symlink("sub", path.Join(dir, "linked")), IsNil)
+	// Circular links
+	c.Assert(os.Symlink(".", path.Join(dir, "loop")), IsNil)
+	c.Assert(os.Symlink("..", path.Join(dir, "sub/up")), IsNil)
+
+	tm := New(dir, nil)
+	c.Assert(tm.AddDir(""), IsNil)
+	c.Check(tm.AllFilenames(), DeepEquals,
+		[]string{"a.html", "c.html", "linked/b.html", "sub/b.html"})
+
+	tm = New(dir, nil)
+	tm.SetSymlinkPolicy(SymlinkSkip)
+	tm.MustAddDir("")
+	c.Check(tm.AllFilenames(), DeepEquals, []string{"a.html", "sub/b.html"})
+
+	tm = New(dir, nil)
+	tm.SetSymlinkPolicy(SymlinkError)
+	errs := tm.AddDirAll("")
+	c.Assert(len(errs), Equals, 4)
+	c.Check(errs[0], ErrorMatches, "neste: c.html: stat .*/c.html: symbolic links are not allowed")
+	c.Check(errs[1], ErrorMatches, "neste: linked: stat .*")
+	c.Check(errs[2], ErrorMatches, "neste: loop: stat .*")
+	c.Check(errs[3], ErrorMatches, "neste: sub/up: stat .*")
+	c.Check(tm.AllFilenames(), DeepEquals, []string{"a.html", "sub/b.html"})
+
+	tm = New(dir, nil)
+	tm.SetSymlinkPolicy(SymlinkError)
+	v := recoverPanic(func() { tm.MustAddDir("") })
+	c.Assert(v, NotNil)
+	c.Check(v.(os.Error), ErrorMatches, "neste: c.html: stat .*")
+}
+
+// generatedTree returns a tree of n small template files, with partials 
+// and defined templates, for the tests and benchmarks of adding directories.
+func generatedTree(n int) map[string]string {
+	files := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		dir := fmt.Sprintf("section%d/sub%d", i%7, i%3)
+		switch i % 10 {
+		case 0:
+			files[fmt.Sprintf("_partials/p%d.html", i)] = fmt.Sprintf("<span>%d {x}</span>", i)
+		case 1:
+			files[fmt.Sprintf("%s/d%d.html", dir, i)] = fmt.Sprintf(`{define "row"}<tr>%d</tr>{enddefine}rows`, i)
+		case 2:
+			files[fmt.Sprintf("%s/t%d.html", dir, i)] = `{extends "p0"}`
+		default:
+			files[fmt.Sprintf("%s/t%d.html", dir, i)] = fmt.Sprintf("<p>%d {x|html}</p>", i)
+		}
+	}
+	return files
+}
+
+// serialAdder is a filepath.Visitor adding the files it visits to m one by 
+// one, for comparing added directories with adding their files serially.
+type serialAdder struct {
+	m *Manager
+}
+
+func (v serialAdder) VisitDir(path_ string, f *os.FileInfo) bool {
+	return true
+}
+
+func (v serialAdder) VisitFile(path_ string, f *os.FileInfo) {
+	v.m.addDirFile(v.m.relFilename(path_), true)
+}
+
+func (s *S) TestAddDirParallel(c *C) {
+	dir := writeTemplates(c, generatedTree(300))
+	defer os.RemoveAll(dir)
+
+	serial := New(dir, nil)
+	filepath.Walk(dir, serialAdder{serial}, nil)
+	c.Assert(len(serial.AllFilenames()) > 270, Equals, true)
+
+	for _, n := range []int{0, 2, 16} {
+		tm := New(dir, nil)
+		tm.SetParallelism(n)
+		tm.MustAddDir("")
+		c.Check(tm.AllFilenames(), DeepEquals, serial.AllFilenames())
+		c.Check(tm.Partials(), DeepEquals, serial.Partials())
+		for _, filename := range serial.AllFilenames() {
+			t := tm.GetFile(filename)
+			c.Assert(t, NotNil)
+			c.Check(t.source, Equals, serial.GetFile(filename).source)
+			output, err := t.Render(map[string]string{"x": "<x>"})
+			c.Assert(err, IsNil)
+			expected, err := serial.GetFile(filename).Render(map[string]string{"x": "<x>"})
+			c.Assert(err, IsNil)
+			c.Check(output, Equals, expected)
+		}
+	}
+
+	// Partials are added first, so that files visited before them can 
+	// extend them too.
+	dir2 := writeTemplates(c, map[string]string{
+		"0.html":             `{extends "nav"}`,
+		"_partials/nav.html": "<nav>{x}</nav>"})
+	defer os.RemoveAll(dir2)
+	tm := New(dir2, nil)
+	c.Assert(tm.AddDir(""), IsNil)
+	output, err := tm.MustGetFile("0.html").Render(map[string]string{"x": "x"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "<nav>x</nav>")
+}
+
+func (s *S) TestAddDirParallelErrors(c *C) {
+	files := generatedTree(100)
+	files["section1/sub1/bad1.html"] = "{.section x}"
+	files["section3/bad2.html"] = "{x|unknown}"
+	files["section5/sub0/bad3.html"] = "{.end}"
+	dir := writeTemplates(c, files)
+	defer os.RemoveAll(dir)
+
+	for _, n := range []int{1, 4, 32} {
+		// Errors are reported in the order of the files.
+		tm := New(dir, nil)
+		tm.SetParallelism(n)
+		errs := tm.AddDirAll("")
+		c.Assert(len(errs), Equals, 3)
+		c.Check(errs[0], ErrorMatches, "neste: section1/sub1/bad1.html: .*")
+		c.Check(errs[1], ErrorMatches, "neste: section3/bad2.html: .*")
+		c.Check(errs[2], ErrorMatches, "neste: section5/sub0/bad3.html: .*")
+		// Partials aren't listed, but templates defined in the files are.
+		c.Check(len(tm.AllFilenames()), Equals, 100)
+
+		// Adding stops at the first error.
+		tm = New(dir, nil)
+		tm.SetParallelism(n)
+		c.Check(tm.AddDir(""), ErrorMatches, "neste: section1/sub1/bad1.html: .*")
+		c.Check(tm.GetFile("section0/sub0/t42.html"), NotNil)
+		c.Check(tm.GetFile("section1/sub1/t22.html"), IsNil)
+		c.Check(tm.GetFile("section3/sub0/t3.html"), IsNil)
+
+		v := recoverPanic(func() {
+			tm := New(dir, nil)
+			tm.SetParallelism(n)
+			tm.MustAddDir("")
+		})
+		c.Assert(v, NotNil)
+		c.Check(v.(os.Error), ErrorMatches, "neste: section1/sub1/bad1.html: .*")
+	}
+}
+
+func (s *S) TestFileError(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"a.html":     "a",
+		"sub/b.html": "{.section x}"})
+	defer os.RemoveAll(dir)
+
+	tm := New(dir, nil)
+	_, err := tm.AddFile("sub/b.html")
+	c.Check(err, ErrorMatches, "neste: sub/b.html: parse "+dir+"/sub/b.html: .*")
+	e, ok := err.(*FileError)
+	c.Assert(ok, Equals, true)
+	c.Check(e.Op, Equals, "parse")
+	c.Check(e.Filename, Equals, "sub/b.html")
+	c.Check(e.Path, Equals, dir+"/sub/b.html")
+
+	_, err = tm.AddFile("missing.html")
+	c.Check(err, ErrorMatches, "neste: missing.html: read "+dir+"/missing.html: .*")
+	tm.SetMaxFileSize(1024)
+	_, err = tm.AddFile("missing.html")
+	c.Check(err, ErrorMatches, "neste: missing.html: stat "+dir+"/missing.html: .*")
+
+	// Panics
+	v := recoverPanic(func() { New(dir, nil).MustAddDir("") })
+	c.Assert(v, NotNil)
+	c.Check(v.(os.Error), ErrorMatches, "neste: sub/b.html: parse .*")
+	v = recoverPanic(func() { tm.MustAddFile("sub/b.html") })
+	c.Assert(v, NotNil)
+	c.Check(v.(os.Error), ErrorMatches, "neste: sub/b.html: parse .*")
+
+	// Reloading
+	t, err := tm.AddFile("a.html")
+	c.Assert(err, IsNil)
+	touchFile(c, path.Join(dir, "a.html"), "{.end}")
+	err = t.Reload()
+	c.Check(err, ErrorMatches, "neste: a.html: parse "+dir+"/a.html: .*")
+}
+
+func (s *S) TestUnsafeFilenames(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"base/a.html":        "a",
+		"base/..dots/b.html": "b",
+		"base/c..html":       "c",
+		"base/child.html":    `{extends "../secret.html"}`,
+		"secret.html":        "secret"})
+	defer os.RemoveAll(dir)
+
+	tm := New(path.Join(dir, "base"), nil)
+	for _, filename := range []string{"../secret.html", "a/../../secret.html",
+		"..", dir + "/secret.html", "/etc/passwd"} {
+		_, err := tm.AddFile(filename)
+		c.Check(err, ErrorMatches, fmt.Sprintf("neste: template filename %q is outside the base directory", filename))
+		_, ok := err.(*UnsafePathError)
+		c.Check(ok, Equals, true)
+		v := recoverPanic(func() { tm.MustAddFile(filename) })
+		c.Check(v, DeepEquals, &UnsafePathError{filename})
+		v = recoverPanic(func() { tm.MustGetFile(filename) })
+		c.Check(v, DeepEquals, &UnsafePathError{filename})
+		c.Check(tm.GetFile(filename), IsNil)
+	}
+
+	// Filenames that merely contain dots are in the base directory.
+	for _, filename := range []string{"a.html", "./a.html", "..dots/b.html", "c..html", "..dots/../a.html"} {
+		_, err := tm.AddFile(filename)
+		c.Check(err, IsNil)
+		c.Check(tm.GetFile(filename), NotNil)
+	}
+
+	// Filenames are kept cleaned.
+	c.Check(tm.GetFile("./a.html"), Equals, tm.GetFile("a.html"))
+	c.Check(tm.GetFile("..dots/./b.html"), Equals, tm.GetFile("..dots/b.html"))
+	c.Check(tm.RemoveFile("./a.html"), Equals, true)
+	c.Check(tm.GetFile("a.html"), IsNil)
+
+	// Parents of templates must be in the base directory too.
+	_, err := tm.AddFile("child.html")
+	c.Check(err, ErrorMatches, `.*neste: template filename "../secret.html" is outside the base directory`)
+
+	t, err := tm.AddFileOutsideBaseDir("../secret.html")
+	c.Assert(err, IsNil)
+	output, err := t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "secret")
+	c.Check(tm.GetFile("../secret.html"), IsNil)
+}
+
+func (s *S) TestFilenameSeparators(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"partials/nav.html":  "nav",
+		"partials/menu.html": "menu"})
+	defer os.RemoveAll(dir)
+
+	tm := New(dir, nil)
+	tNav, err := tm.AddFile("partials\\nav.html")
+	c.Assert(err, IsNil)
+	tMenu := tm.MustAddFile("partials/menu.html")
+	c.Check(tm.AllFilenames(), DeepEquals, []string{"partials/menu.html", "partials/nav.html"})
+
+	for _, sep := range []string{"/", "\\"} {
+		c.Check(tm.GetFile("partials"+sep+"nav.html"), Equals, tNav)
+		c.Check(tm.MustGetFile("partials"+sep+"menu.html"), Equals, tMenu)
+		t, ok := tm.Lookup("partials" + sep + "nav.html")
+		c.Check(ok, Equals, true)
+		c.Check(t, Equals, tNav)
+	}
+
+	// Reloading uses the path of the file.
+	touchFile(c, path.Join(dir, "partials/nav.html"), "changed")
+	c.Assert(tNav.Reload(), IsNil)
+	output, err := tNav.Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "changed")
+
+	_, err = tm.AddFile("partials\\..\\..\\secret.html")
+	c.Check(err, NotNil)
+	c.Check(tm.RemoveFile("partials\\nav.html"), Equals, true)
+	c.Check(tm.AllFilenames(), DeepEquals, []string{"partials/menu.html"})
+}
+
+func (s *S) TestAddFileTraversal(c *C) {
+	tm := New(baseDir, nil)
+	_, err := tm.AddFile("../etc/passwd")
+	c.Check(err, NotNil)
+	c.Check(tm.GetFile("../etc/passwd"), IsNil)
+
+	// Files are checked to be in the base directory when adding them too.
+	for _, baseDir := range []string{"templates", "templates/", "/tmp", "", "."} {
+		tm := New(baseDir, nil)
+		_, err := tm.addFile("../etc/passwd", false)
+		c.Check(err, DeepEquals, &UnsafePathError{"../etc/passwd"})
+		v := recoverPanic(func() { tm.addFile("a/../../etc/passwd", true) })
+		c.Check(v, DeepEquals, &UnsafePathError{"a/../../etc/passwd"})
+	}
+	c.Check(inDir("templates", "templates/index.html"), Equals, true)
+	c.Check(inDir("templates", "templates2/index.html"), Equals, false)
+	c.Check(inDir("/", "/etc/passwd"), Equals, true)
+}
+
+func (s *S) TestAddAbsFile(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"base/shared/footer.html": "local footer",
+		"shared/footer.html":      "footer {x}"})
+	defer os.RemoveAll(dir)
+	fpath := path.Join(dir, "shared/footer.html")
+
+	tm := New(path.Join(dir, "base"), nil)
+	t, err := tm.AddAbsFile(fpath, "shared/footer.html")
+	c.Assert(err, IsNil)
+	c.Check(tm.GetFile("shared/footer.html"), Equals, t)
+	output, err := t.Render(map[string]string{"x": "x"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "footer x")
+
+	// Reloading
+	touchFile(c, fpath, "changed {x}")
+	c.Check(t.IsStale(), Equals, true)
+	tm.SetReloading(true)
+	output, err = t.Render(map[string]string{"x": "x"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "changed x")
+
+	// Filenames of template files from other paths don't collide silently.
+	_, err = tm.AddFile("shared/footer.html")
+	c.Check(err, ErrorMatches, "neste: template file shared/footer.html is already added from "+fpath)
+	c.Check(tm.GetFile("shared/footer.html"), Equals, t)
+	tm.RemoveFile("shared/footer.html")
+	tm.MustAddFile("shared/footer.html")
+	_, err = tm.AddAbsFile(fpath, "shared/footer.html")
+	c.Check(err, ErrorMatches, "neste: template file shared/footer.html is already added from .*/base/shared/footer.html")
+
+	_, err = tm.AddAbsFile("shared/footer.html", "footer.html")
+	c.Check(err, ErrorMatches, "neste: template file path shared/footer.html is not absolute")
+}
+
+func (s *S) TestSetTemplateExtensions(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"index.html":  "html",
+		"index.neste": "neste",
+		"about.neste": "about",
+		"page":        "exact",
+		"page.html":   "page"})
+	defer os.RemoveAll(dir)
+
+	tm := New(dir, nil)
+	c.Assert(tm.AddDir(""), IsNil)
+	c.Check(tm.GetFile("index"), IsNil)
+
+	tm.SetTemplateExtensions([]string{".html", ".neste"})
+	tests := []struct{ filename, output string }{
+		{"index", "html"},
+		{"about", "about"},
+		{"page", "exact"},
+		{"index.neste", "neste"},
+	}
+	for _, test := range tests {
+		t := tm.GetFile(test.filename)
+		c.Assert(t, NotNil)
+		output, err := t.Render(nil)
+		c.Assert(err, IsNil)
+		c.Check(output, Equals, test.output)
+	}
+	c.Check(tm.GetFile("missing"), IsNil)
+
+	// Extensions are tried in order.
+	tm.SetTemplateExtensions([]string{".neste", ".html"})
+	output, err := tm.GetFile("index").Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "neste")
+}
+
+func (s *S) TestReload(c *C) {
+	rlName := "reloading.neste"
+	rlPath := path.Join(baseDir, rlName)
+	data := "foo"
+	st := []byte("starting template: {@}\n")
+	mt := []byte("modified template: {@}\n")
+	sExpected := "starting template: foo\n"
+	mExpected := "modified template: foo\n"
+
+	ioutil.WriteFile(rlPath, st, 0644)
+	tm := New(baseDir, nil)
+	t := tm.MustAddFile(rlName)
+
+	output, err := t.Render(data)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, sExpected)
+
+	// Write changes and reload
+	ioutil.WriteFile(rlPath, mt, 0644)
+	// Attempt to force mtime to change.
+	err = os.Chtimes(rlPath, time.Nanoseconds(), time.Nanoseconds())
+	c.Assert(err, IsNil)
+	
+	err = t.Reload()
+	c.Assert(err, IsNil)
+
+	output, err = t.Render(data)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, mExpected)
+}
+
+func (s *S) TestReloading(c *C) {
+	rlName := "reloading.neste"
+	rlPath := path.Join(baseDir, rlName)
+	data := "foo"
+	st := []byte("starting template: {@}\n")
+	mt := []byte("modified template: {@}\n")
+	sExpected := "starting template: foo\n"
+	mExpected := "modified template: foo\n"
+
+	ioutil.WriteFile(rlPath, st, 0644)
+	tm := New(baseDir, nil)
+	c.Assert(tm.reloading, Equals, false)
+	t := tm.MustAddFile(rlName)
+
+	output, err := t.Render(data)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, sExpected)
+
+	// Write changes
+	ioutil.WriteFile(rlPath, mt, 0644)
+	tm.SetReloading(true)
+
+	// Attempt to force mtime to change.
+	err = os.Chtimes(rlPath, time.Nanoseconds(), time.Nanoseconds())
+	c.Assert(err, IsNil)
+
+	output, err = t.Render(data)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, mExpected)
+}
+
+
+// touchFile writes src to the file at fpath and sets its modified time 
+// to the future, so that reloading sees the change.
+func touchFile(c *C, fpath, src string) {
+	err := ioutil.WriteFile(fpath, []byte(src), 0644)
+	c.Assert(err, IsNil)
+	mtime := time.Nanoseconds() + 10e9
+	err = os.Chtimes(fpath, mtime, mtime)
+	c.Assert(err, IsNil)
+}
+
+func (s *S) TestIsStale(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"a.html": `a {define "inner"}inner{enddefine}`})
+	defer os.RemoveAll(dir)
+
+	tm := New(dir, nil)
+	t := tm.MustAddFile("a.html")
+	c.Check(t.IsStale(), Equals, false)
+	c.Check(tm.MustAdd("s", "s").IsStale(), Equals, false)
+
+	touchFile(c, path.Join(dir, "a.html"), "changed")
+	c.Check(t.IsStale(), Equals, true)
+	c.Check(tm.GetFile("a.html#inner").IsStale(), Equals, true)
+	// Checking doesn't reload the template.
+	output, err := t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "a ")
+
+	c.Assert(t.Reload(), IsNil)
+	c.Check(t.IsStale(), Equals, false)
+}
+
+func (s *S) TestStaleFiles(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"a.html":     "a",
+		"sub/b.html": `b {define "inner"}inner{enddefine}`,
+		"c.html":     "c"})
+	defer os.RemoveAll(dir)
+
+	tm := New(dir, nil)
+	tm.MustAddDir("")
+	tm.MustAdd("s", "s")
+	c.Check(len(tm.StaleFiles()), Equals, 0)
+
+	touchFile(c, path.Join(dir, "sub/b.html"), "changed")
+	c.Check(tm.StaleFiles(), DeepEquals, []string{"sub/b.html"})
+	touchFile(c, path.Join(dir, "a.html"), "changed")
+	c.Check(tm.StaleFiles(), DeepEquals, []string{"a.html", "sub/b.html"})
+
+	c.Assert(tm.GetFile("a.html").Reload(), IsNil)
+	c.Check(tm.StaleFiles(), DeepEquals, []string{"sub/b.html"})
+}
+
+func (s *S) TestPurgeStale(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"a.html": "a",
+		"b.html": `b {define "inner"}inner{enddefine}`})
+	defer os.RemoveAll(dir)
+
+	tm := New(dir, nil)
+	tm.MustAddDir("")
+	c.Check(tm.PurgeStale(), Equals, 0)
+
+	touchFile(c, path.Join(dir, "b.html"), "changed")
+	c.Check(tm.PurgeStale(), Equals, 1)
+	c.Check(tm.AllFilenames(), DeepEquals, []string{"a.html"})
+
+	// Purged templates can be added again.
+	t := tm.MustAddFile("b.html")
+	output, err := t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "changed")
+}
+
+func (s *S) TestReloadingOnExecute(c *C) {
+	dir := writeTemplates(c, map[string]string{"a.html": "a"})
+	defer os.RemoveAll(dir)
+
+	tm := New(dir, nil)
+	tm.MustAddFile("a.html")
+	tm.SetReloading(true)
+	touchFile(c, path.Join(dir, "a.html"), "changed")
+
+	// Getting the template doesn't reload it, executing it does.
+	t := tm.GetFile("a.html")
+	c.Check(t.source, Equals, "a")
+	output, err := t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "changed")
+}
+
+func (s *S) TestExecuteFresh(c *C) {
+	dir := writeTemplates(c, map[string]string{"a.html": "a"})
+	defer os.RemoveAll(dir)
+
+	tm := New(dir, nil)
+	t := tm.MustAddFile("a.html")
+	touchFile(c, path.Join(dir, "a.html"), "changed")
+
+	output, err := t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "a")
+
+	var buf bytes.Buffer
+	c.Assert(t.ExecuteFresh(&buf, nil), IsNil)
+	c.Check(buf.String(), Equals, "changed")
+
+	// Templates from strings are executed as usual.
+	buf.Reset()
+	c.Assert(tm.MustAdd("{@}", "s").ExecuteFresh(&buf, "s"), IsNil)
+	c.Check(buf.String(), Equals, "s")
+}
+
+func (s *S) TestSetMinReloadInterval(c *C) {
+	dir := writeTemplates(c, map[string]string{"a.html": "a"})
+	defer os.RemoveAll(dir)
+	fpath := path.Join(dir, "a.html")
+
+	tm := New(dir, nil)
+	t := tm.MustAddFile("a.html")
+	tm.SetReloading(true)
+	tm.SetMinReloadInterval(100e6)
+
+	output, err := t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "a")
+
+	// The change isn't noticed until the interval has passed.
+	touchFile(c, fpath, "changed")
+	output, err = t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "a")
+	time.Sleep(150e6)
+	output, err = t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "changed")
+
+	// Reload always checks the file.
+	touchFile(c, fpath, "again")
+	c.Assert(t.Reload(), IsNil)
+	output, err = t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "again")
+}
+
+func (s *S) TestSetReloadingConcurrently(c *C) {
+	dir := writeTemplates(c, map[string]string{"a.html": "a"})
+	defer os.RemoveAll(dir)
+
+	tm := New(dir, nil)
+	t := tm.MustAddFile("a.html")
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			tm.SetReloading(i%2 == 0)
+		}
+		done <- true
+	}()
+	for i := 0; i < 100; i++ {
+		output, err := t.Render(nil)
+		c.Assert(err, IsNil)
+		c.Assert(output, Equals, "a")
+	}
+	<-done
+}
+
+func (s *S) TestReloadStrategy(c *C) {
+	for _, strategy := range []ReloadStrategy{ReloadNone, ReloadEager, ReloadLazy} {
+		dir := writeTemplates(c, map[string]string{
+			"outer.html": "outer {inner}",
+			"inner.html": "inner"})
+		defer os.RemoveAll(dir)
+
+		tm := New(dir, nil)
+		tm.SetReloadStrategy(strategy)
+		outer := tm.MustAddFile("outer.html")
+		inner := tm.MustAddFile("inner.html")
+		data := map[string]interface{}{"inner": inner}
+
+		touchFile(c, path.Join(dir, "inner.html"), "changed")
+
+		// Nested templates are reloaded only in eager mode.
+		output, err := outer.Render(data)
+		c.Assert(err, IsNil)
+		if strategy == ReloadEager {
+			c.Check(output, Equals, "outer changed")
+		} else {
+			c.Check(output, Equals, "outer inner")
+		}
+
+		// Templates executed at the top level are reloaded in both modes.
+		output, err = inner.Render(nil)
+		c.Assert(err, IsNil)
+		if strategy == ReloadNone {
+			c.Check(output, Equals, "inner")
+		} else {
+			c.Check(output, Equals, "changed")
+		}
+	}
+}
+
+func (s *S) TestReloadBackground(c *C) {
+	dir := writeTemplates(c, map[string]string{"a.html": "a"})
+	defer os.RemoveAll(dir)
+
+	tm := New(dir, nil)
+	t := tm.MustAddFile("a.html")
+	tm.Watch(5e6)
+	c.Check(tm.reloading, Equals, false)
+
+	touchFile(c, path.Join(dir, "a.html"), "changed")
+	// Wait for the change to be noticed without executing the template.
+	for i := 0; i < 100 && t.Size() == 1; i++ {
+		time.Sleep(5e6)
+	}
+	output, err := t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "changed")
+
+	// Setting another strategy stops reloading in the background.
+	tm.SetReloadStrategy(ReloadNone)
+	time.Sleep(20e6)
+	touchFile(c, path.Join(dir, "a.html"), "again")
+	time.Sleep(20e6)
+	output, err = t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "changed")
+}
+
+func (s *S) TestSetCacheDuration(c *C) {
+	dir := writeTemplates(c, map[string]string{"a.html": "a"})
+	defer os.RemoveAll(dir)
+	fpath := path.Join(dir, "a.html")
+
+	tm := New(dir, nil)
+	t := tm.MustAddFile("a.html")
+	tm.SetCacheDuration(5e6)
+
+	// Change the file without changing its modified time.
+	mtime := getMtime(fpath)
+	c.Assert(ioutil.WriteFile(fpath, []byte("changed"), 0644), IsNil)
+	c.Assert(os.Chtimes(fpath, mtime, mtime), IsNil)
+
+	// The template is reparsed only after it has expired.
+	t.fi.parsed = time.Nanoseconds()
+	output, err := t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "a")
+	time.Sleep(10e6)
+	output, err = t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "changed")
+
+	// Template files don't expire with a zero duration.
+	tm.SetCacheDuration(0)
+	c.Assert(ioutil.WriteFile(fpath, []byte("again"), 0644), IsNil)
+	c.Assert(os.Chtimes(fpath, mtime, mtime), IsNil)
+	time.Sleep(10e6)
+	output, err = t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "changed")
+}
+
+func (s *S) TestMaxFileSize(c *C) {
+	bigName := "big.neste"
+	bigPath := path.Join(baseDir, bigName)
+	ioutil.WriteFile(bigPath, bytes.Repeat([]byte("x"), 2048), 0644)
+	defer os.Remove(bigPath)
+
+	tm := New(baseDir, nil)
+	tm.SetMaxFileSize(1024)
+
+	_, err := tm.AddFile(bigName)
+	c.Assert(err, ErrorMatches, ".*too large.*")
+	c.Check(tm.GetFile(bigName), IsNil)
+
+	// Files within the limit are still accepted.
+	_, err = tm.AddFile(indexName)
+	c.Assert(err, IsNil)
+
+	// No limit by default.
+	tm = New(baseDir, nil)
+	_, err = tm.AddFile(bigName)
+	c.Assert(err, IsNil)
+}
+
+func (s *S) TestExecuteNested(c *C) {
+	tm := New(baseDir, nil)
+	tOuter := tm.MustAdd("{head}|{footer}|{title}", "outer")
+	tHead := tm.MustAdd("<title>{title}</title>", "head")
+	tFooter := tm.MustAdd("neste template engine", "footer")
+
+	data := map[string]interface{}{
+		"title":  "Outer",
+		"head":   Nested{tHead, map[string]string{"title": "Nested"}},
+		"footer": tFooter}
+
+	output, err := tOuter.Render(data)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "<title>Nested</title>|neste template engine|Outer")
+
+	// The given data must be left intact.
+	c.Check(data["footer"], Equals, tFooter)
+}
+
+func (s *S) TestExecuteNestedCycle(c *C) {
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("{self}", "self")
+
+	data := map[string]interface{}{}
+	data["self"] = Nested{t, data}
+
+	_, err := t.Render(data)
+	c.Assert(err, ErrorMatches, ".*template cycle: self -> self")
+
+	// Cycle through two templates
+	tA := tm.MustAdd("{b}", "a")
+	tB := tm.MustAdd("{a}", "b")
+	dataA := map[string]interface{}{}
+	dataB := map[string]interface{}{"a": Nested{tA, dataA}}
+	dataA["b"] = Nested{tB, dataB}
+
+	_, err = tA.Render(dataA)
+	c.Assert(err, ErrorMatches, ".*template cycle: a -> b -> a")
+
+	// The same template may still be nested several times without a cycle.
+	tBoth := tm.MustAdd("{x}{y}", "both")
+	tLeaf := tm.MustAdd("leaf", "leaf")
+	output, err := tBoth.Render(map[string]interface{}{"x": tLeaf, "y": tLeaf})
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "leafleaf")
+}
+
+type nestedError struct{}
+
+func (s *S) TestExecuteNestedError(c *C) {
+	tm := New(baseDir, nil)
+	tOuter := tm.MustAdd("{child}", "outer")
+	tChild := tm.MustAdd("{missing}", "child")
+
+	_, err := tOuter.Render(map[string]interface{}{
+		"child": Nested{tChild, nestedError{}}})
+	c.Assert(err, ErrorMatches, "neste: outer: nested template child: .*")
+}
+
+func (s *S) TestReadTimeout(c *C) {
+	defer func(f func(string) (io.ReadCloser, os.Error)) { openFile = f }(openFile)
+
+	// Mock a slow filesystem.
+	var delay int64
+	openFile = func(name string) (io.ReadCloser, os.Error) {
+		r, w := io.Pipe()
+		d := delay
+		go func() {
+			time.Sleep(d)
+			w.Write([]byte("slow template"))
+			w.Close()
+		}()
+		return r, nil
+	}
+
+	tm := New(baseDir, nil)
+	tm.SetReadTimeout(50e6)
+
+	delay = 500e6
+	_, err := tm.AddFile(indexName)
+	c.Assert(err, ErrorMatches, ".*timed out.*")
+	c.Check(tm.GetFile(indexName), IsNil)
+
+	delay = 1e6
+	t, err := tm.AddFile(indexName)
+	c.Assert(err, IsNil)
+
+	output, err := t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "slow template")
+}
+
+func (s *S) TestReloadInterrupted(c *C) {
+	defer func(f func(string) (io.ReadCloser, os.Error)) { openFile = f }(openFile)
+	dir := writeTemplates(c, map[string]string{"a.html": "a"})
+	defer os.RemoveAll(dir)
+
+	tm := New(dir, nil)
+	t := tm.MustAddFile("a.html")
+
+	// Mock a filesystem failing the first opens with the given error.
+	var failures, opens int
+	var failure os.Error
+	open := openFile
+	openFile = func(name string) (io.ReadCloser, os.Error) {
+		opens++
+		if opens <= failures {
+			return nil, &os.PathError{"open", name, failure}
+		}
+		return open(name)
+	}
+
+	tests := []struct {
+		failure  os.Error
+		failures int
+		opens    int
+		ok       bool
+	}{
+		{os.EINTR, 1, 2, true},
+		{os.EBUSY, 3, 4, true},
+		{os.EINTR, 4, 4, false},
+		{os.EACCES, 1, 1, false},
+	}
+	for i, test := range tests {
+		failure, failures, opens = test.failure, test.failures, 0
+		src := "changed " + string('a'+i)
+		touchFile(c, path.Join(dir, "a.html"), src)
+
+		err := t.Reload()
+		c.Check(opens, Equals, test.opens)
+		if !test.ok {
+			c.Check(err, NotNil)
+			continue
+		}
+		c.Assert(err, IsNil)
+		output, err := t.Render(nil)
+		c.Assert(err, IsNil)
+		c.Check(output, Equals, src)
+	}
+}
+
+func (s *S) TestRenderNested(c *C) {
+	tm := New(baseDir, nil)
+	tm.MustAddFile(indexName)
+	tm.MustAddFile(headName)
+	tm.MustAddFile(brandName)
+	tm.MustAddFile(contentName)
+	tm.MustAddFile(listName)
+	tm.MustAddFile(footerName)
+
+	plan := map[string]interface{}{
+		indexName: map[string]interface{}{
+			"head":    Ref(headName),
+			"brand":   Ref(brandName),
+			"content": Ref(contentName),
+			"footer":  Ref(footerName)},
+		headName:   map[string]string{"title": "Page Title"},
+		brandName:  map[string]string{},
+		footerName: map[string]string{"posted": "25th July 2010 12:15"},
+		listName:   map[string]interface{}{"items": &[3]string{"Example", "Listing", "Area"}},
+		contentName: map[string]interface{}{
+			"title":   "Page Title",
+			"opening": "Example page to demonstrate nested templates.",
+			"list":    Ref(listName)}}
+
+	output, err := tm.RenderNested(indexName, plan)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, nestingExpected)
+}
+
+func (s *S) TestRenderNestedCycle(c *C) {
+	tm := New(baseDir, nil)
+	tm.MustAdd("{b}", "a")
+	tm.MustAdd("{a}", "b")
+
+	plan := map[string]interface{}{
+		"a": map[string]interface{}{"b": Ref("b")},
+		"b": map[string]interface{}{"a": Ref("a")}}
+
+	_, err := tm.RenderNested("a", plan)
+	c.Assert(err, ErrorMatches, ".*cycle: a -> b -> a")
+}
+
+func (s *S) TestAddBytes(c *C) {
+	src := "<p>{title|e}</p>"
+	data := map[string]string{"title": "<AddBytes>"}
+
+	tm := New(baseDir, nil)
+	tBytes, err := tm.AddBytes("bytes", []byte(src))
+	c.Assert(err, IsNil)
+	c.Check(tm.Get("bytes"), Equals, tBytes)
+	tString := tm.MustAdd(src, "string")
+
+	output, err := tBytes.Render(data)
+	c.Assert(err, IsNil)
+	expected, err := tString.Render(data)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, expected)
+}
+
+type layoutRow struct {
+	Name string
+	Size int64
+}
+
+func (s *S) TestRenderInLayout(c *C) {
+	expected :=
+`<!DOCTYPE HTML>
+<html>
+<head>
+	<title>Index of /tmp</title>
+</head>
+<body>
+	<h1>Index of /tmp</h1>
+	<table>
+	<tr><td>a.txt</td><td>10</td></tr>
+	<tr><td>b.txt</td><td>20</td></tr>
+</table>
+
+</body>
+</html>
+`
+	tm := New(baseDir, nil)
+	tm.MustAddFile("layout/base.html")
+	tm.MustAddFile("layout/index.html")
+
+	layoutData := map[string]interface{}{"Title": "Index of /tmp"}
+	contentData := map[string]interface{}{
+		"FileRows": []layoutRow{{"a.txt", 10}, {"b.txt", 20}}}
+
+	output, err := tm.RenderInLayout("layout/base.html", "layout/index.html",
+		layoutData, contentData, "Content")
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, expected)
+
+	// The given layout data must be left intact.
+	_, present := layoutData["Content"]
+	c.Check(present, Equals, false)
+}
+
+func (s *S) TestRenderInLayoutError(c *C) {
+	tm := New(baseDir, nil)
+	tm.MustAdd("{.section Row}{missing}{.end}", "badLayout")
+	tm.MustAdd("{Title} {Content}", "layout")
+	tm.MustAdd("{missing}", "badContent")
+	tm.MustAdd("content", "content")
+
+	_, err := tm.RenderInLayout("layout", "badContent", nil, layoutRow{}, "Content")
+	c.Assert(err, ErrorMatches, "neste: content badContent: .*")
+
+	layoutData := map[string]interface{}{"Row": layoutRow{}}
+	_, err = tm.RenderInLayout("badLayout", "content", layoutData, nil, "Content")
+	c.Assert(err, ErrorMatches, "neste: layout badLayout: .*")
+
+	_, err = tm.RenderInLayout("missing", "content", nil, nil, "Content")
+	c.Assert(err, ErrorMatches, "neste: layout missing: no such template")
+}
+
+func (s *S) TestSize(c *C) {
+	src := "<p>{title}</p>\n"
+
+	tm := New(baseDir, nil)
+	t := tm.MustAdd(src, "size")
+	c.Check(t.Size(), Equals, len(src))
+
+	t2 := tm.MustAdd(src+src, "size2")
+	c.Check(t2.Size(), Equals, 2*t.Size())
+
+	b, err := ioutil.ReadFile(path.Join(baseDir, indexName))
+	c.Assert(err, IsNil)
+	tIndex := tm.MustAddFile(indexName)
+	c.Check(tIndex.Size(), Equals, len(b))
+}
+
+func (s *S) TestTotalSize(c *C) {
+	tm := New(baseDir, nil)
+	c.Check(tm.TotalSize(), Equals, int64(0))
+
+	tm.MustAdd("12345", "five")
+	tm.MustAdd("1234567890", "ten")
+	c.Check(tm.TotalSize(), Equals, int64(15))
+
+	tIndex := tm.MustAddFile(indexName)
+	c.Check(tm.TotalSize(), Equals, int64(15+tIndex.Size()))
+}
+
+func (s *S) TestCompress(c *C) {
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("<p>  \r\n{title}\t\r\n</p> \r", "compress")
+	clean := tm.MustAdd("clean\n", "clean")
+	tIndex := tm.MustAddFile(indexName)
+	indexSource := tIndex.source
+
+	err := tm.Compress()
+	c.Assert(err, IsNil)
+	c.Check(t.source, Equals, "<p>\n{title}\n</p>\n")
+	c.Check(clean.source, Equals, "clean\n")
+	// Template files are left alone.
+	c.Check(tIndex.source, Equals, indexSource)
+
+	output, err := t.Render(map[string]string{"title": "Compress"})
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "<p>\nCompress\n</p>\n")
+}
+
+func (s *S) TestHealthCheck(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"a.html": "a",
+		"b.html": "b"})
+	defer os.RemoveAll(dir)
+
+	tm := New(dir, nil)
+	tm.MustAddFile("a.html")
+	tm.MustAddFile("b.html")
+	c.Assert(tm.HealthCheck(), IsNil)
+
+	os.Remove(path.Join(dir, "b.html"))
+	err := tm.HealthCheck()
+	c.Assert(err, ErrorMatches, ".*b.html.*")
+}
+
+func (s *S) TestReadinessCheck(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"a.html": "{a}",
+		"b.html": "{b}"})
+	defer os.RemoveAll(dir)
+
+	tm := New(dir, nil)
+	tA := tm.MustAddFile("a.html")
+	tm.MustAddFile("b.html")
+	c.Assert(tm.ReadinessCheck(), IsNil)
+
+	// Introduce a syntax error.
+	ioutil.WriteFile(path.Join(dir, "b.html"), []byte("{.section b}"), 0644)
+	err := tm.ReadinessCheck()
+	c.Assert(err, ErrorMatches, ".*b.html: .*")
+
+	// The templates are left as they were.
+	output, err := tm.GetFile("b.html").Render(map[string]string{"b": "b"})
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "b")
+	c.Check(tm.GetFile("a.html"), Equals, tA)
+}
+
+func (s *S) TestTemplateNames(c *C) {
+	tm := New(baseDir, nil)
+	c.Check(len(tm.TemplateNames()), Equals, 0)
+
+	tm.MustAddFile(indexName)
+	tm.MustAddFile(headName)
+	tm.MustAdd("b", "b")
+	tm.MustAdd("z", "z")
+	tm.MustAdd("index", indexName)
+
+	c.Check(tm.AllIDs(), DeepEquals, []string{"b", indexName, "z"})
+	c.Check(tm.AllFilenames(), DeepEquals, []string{headName, indexName})
+	c.Check(tm.TemplateNames(), DeepEquals,
+		[]string{"b", "file:" + headName, "file:" + indexName, indexName, "z"})
+}
+
+func (s *S) TestDiff(c *C) {
+	tm := New(baseDir, nil)
+	tm.MustAdd("same", "same")
+	tm.MustAdd("old", "changed")
+	tm.MustAdd("removed", "removed")
+	tm.MustAddFile(indexName)
+	tm.MustAddFile(headName)
+
+	other := New(baseDir, nil)
+	other.MustAdd("same", "same")
+	other.MustAdd("new", "changed")
+	other.MustAdd("added", "added")
+	other.MustAdd("file", indexName)
+	other.MustAddFile(indexName)
+	other.MustAddFile(footerName)
+
+	added, removed, changed := tm.Diff(other)
+	c.Check(added, DeepEquals, []string{"added", "file:" + footerName, indexName})
+	c.Check(removed, DeepEquals, []string{"file:" + headName, "removed"})
+	c.Check(changed, DeepEquals, []string{"changed"})
+
+	added, removed, changed = tm.Diff(tm)
+	c.Check(len(added)+len(removed)+len(changed), Equals, 0)
+}
+
+func (s *S) TestApply(c *C) {
+	tm := New(baseDir, nil)
+	tm.MustAdd("same", "same")
+	tm.MustAdd("old: {x}", "changed")
+	tm.MustAdd("removed", "removed")
+	tm.MustAddFile(indexName)
+	tm.MustAddFile(headName)
+	tSame := tm.Get("same")
+
+	other := New(baseDir, nil)
+	other.MustAdd("same", "same")
+	other.MustAdd("new: {x}", "changed")
+	other.MustAdd("added", "added")
+	other.MustAddFile(indexName)
+	other.MustAddFile(footerName)
+
+	added, removed, changed := tm.Diff(other)
+	c.Assert(len(added)+len(removed)+len(changed), Equals, 4)
+
+	err := tm.Apply(other)
+	c.Assert(err, IsNil)
+
+	added, removed, changed = tm.Diff(other)
+	c.Check(len(added)+len(removed)+len(changed), Equals, 0)
+	c.Check(tm.TemplateNames(), DeepEquals, other.TemplateNames())
+	c.Check(tm.Get("same"), Equals, tSame)
+
+	output, err := tm.Get("changed").Render(map[string]string{"x": "y"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "new: y")
+
+	// Nothing is changed if a template can't be parsed.
+	other.Remove("added")
+	other.tStrings["bad"] = &Template{name: "bad", source: "{.section x}"}
+	err = tm.Apply(other)
+	c.Assert(err, ErrorMatches, "neste: bad: .*")
+	c.Check(tm.Get("added"), NotNil)
+	c.Check(tm.Get("bad"), IsNil)
+}
+
+func (s *S) TestLookup(c *C) {
+	tm := New(baseDir, nil)
+	tFile := tm.MustAddFile(indexName)
+	tString := tm.MustAdd("string", "string")
+
+	t, ok := tm.Lookup(indexName)
+	c.Check(ok, Equals, true)
+	c.Check(t, Equals, tFile)
+
+	t, ok = tm.Lookup("string")
+	c.Check(ok, Equals, true)
+	c.Check(t, Equals, tString)
+
+	// Templates added from strings take priority.
+	tShadow := tm.MustAdd("shadow", indexName)
+	t, ok = tm.Lookup(indexName)
+	c.Check(ok, Equals, true)
+	c.Check(t, Equals, tShadow)
+
+	t, ok = tm.Lookup("missing")
+	c.Check(ok, Equals, false)
+	c.Check(t, IsNil)
+}
+
+// recoverPanic calls f and returns the value it panicked with, if any.
+func recoverPanic(f func()) (v interface{}) {
+	defer func() { v = recover() }()
+	f()
+	return
+}
+
+func (s *S) TestMustGet(c *C) {
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("string", "string")
+	tFile := tm.MustAddFile(indexName)
+
+	c.Check(tm.MustGet("string"), Equals, t)
+	c.Check(tm.MustGetFile(indexName), Equals, tFile)
+
+	v := recoverPanic(func() { tm.MustGet("missing") })
+	c.Check(v, Equals, "neste: no template with identifier missing")
+
+	v = recoverPanic(func() { tm.MustGetFile("missing.html") })
+	c.Check(v, Equals, "neste: no template file missing.html")
+}
+
+func (s *S) TestGetAll(c *C) {
+	tm := New(baseDir, nil)
+	c.Check(len(tm.GetAll()), Equals, 0)
+	c.Check(len(tm.GetAllFiles()), Equals, 0)
+
+	tB := tm.MustAdd("b: {x}", "b")
+	tA := tm.MustAdd("a: {x}", "a")
+	tm.MustAddFile(headName)
+	tm.MustAddFile(footerName)
+
+	all := tm.GetAll()
+	c.Assert(len(all), Equals, 2)
+	c.Check(all[0], Equals, tA)
+	c.Check(all[1], Equals, tB)
+
+	for i, t := range all {
+		output, err := t.Render(map[string]string{"x": "y"})
+		c.Assert(err, IsNil)
+		c.Check(output, Equals, tm.AllIDs()[i]+": y")
+	}
+
+	files := tm.GetAllFiles()
+	c.Assert(len(files), Equals, 2)
+	c.Check(files[0], Equals, tm.GetFile(footerName))
+	c.Check(files[1], Equals, tm.GetFile(headName))
+
+	for _, t := range files {
+		_, err := t.Render(map[string]string{})
+		c.Assert(err, IsNil)
+	}
+}
+
+// stringRecorder is a writer recording the strings written with WriteString.
+type stringRecorder struct {
+	bytes.Buffer
+	strings []string
+}
+
+func (w *stringRecorder) WriteString(s string) (int, os.Error) {
+	w.strings = append(w.strings, s)
+	return w.Buffer.WriteString(s)
+}
+
+// writerOnly hides all methods but Write of its writer.
+type writerOnly struct {
+	io.Writer
+}
+
+func (s *S) TestExecuteStringWriter(c *C) {
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("<p>{yield content}{title}{title|str}</p>", "slot")
+	data := map[string]string{"title": "neste"}
+
+	var w stringRecorder
+	err := t.execute(&w, data, &renderContext{slots: map[string]string{"content": "text"}})
+	c.Assert(err, IsNil)
+	c.Check(w.String(), Equals, "<p>textnesteneste</p>")
+	c.Check(w.strings, DeepEquals, []string{"text", "neste", "neste"})
+
+	var buf bytes.Buffer
+	err = t.execute(writerOnly{&buf}, data, &renderContext{slots: map[string]string{"content": "text"}})
+	c.Assert(err, IsNil)
+	c.Check(buf.String(), Equals, "<p>textnesteneste</p>")
+}
+
+// benchmarkSlot executes a template with a large slot to w n times.
+func benchmarkSlot(n int, w io.Writer, buf *bytes.Buffer) {
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("<body>{yield content}</body>", "slot")
+	slots := map[string]string{"content": string(bytes.Repeat([]byte("<p>text</p>\n"), 10000))}
+
+	for i := 0; i < n; i++ {
+		buf.Reset()
+		err := t.execute(w, nil, &renderContext{slots: slots})
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func BenchmarkExecuteStringWriter(b *testing.B) {
+	var buf bytes.Buffer
+	benchmarkSlot(b.N, &buf, &buf)
+}
+
+func BenchmarkExecuteWriter(b *testing.B) {
+	var buf bytes.Buffer
+	benchmarkSlot(b.N, writerOnly{&buf}, &buf)
+}
+
+func BenchmarkAddDir(b *testing.B) {
+	b.StopTimer()
+	dir, err := ioutil.TempDir("", "neste")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, src := range generatedTree(400) {
+		fpath := path.Join(dir, name)
+		err = os.MkdirAll(path.Dir(fpath), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(fpath, []byte(src), 0644)
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		New(dir, nil).MustAddDir("")
+	}
+}
+
+func (s *S) TestNewFromMap(c *C) {
+	tm, err := NewFromMap(map[string]string{
+		"a": "<h1>{title}</h1>",
+		"b": "<p>{body|capFirst}</p>"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(tm.AllIDs(), DeepEquals, []string{"a", "b"})
+
+	output, err := tm.Get("b").Render(map[string]string{"body": "text"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "<p>Text</p>")
+
+	// Templates are added in order until the first invalid one.
+	tm, err = NewFromMap(map[string]string{
+		"a":     "{title}",
+		"bad":   "{.section title}",
+		"c":     "{title}",
+		"worse": "{title|unknown"}, nil)
+	c.Assert(err, ErrorMatches, "neste: bad: .*")
+	c.Assert(tm, NotNil)
+	c.Check(tm.AllIDs(), DeepEquals, []string{"a"})
+}
+
+func (s *S) TestFreeze(c *C) {
+	tm := New(baseDir, nil)
+	tm.MustAdd("a", "a")
+	tm.MustAddFile(indexName)
+	tm.Freeze()
+
+	_, err := tm.Add("b", "b")
+	c.Check(err, Equals, ErrFrozen)
+	_, err = tm.AddFile(headName)
+	c.Check(err, Equals, ErrFrozen)
+	c.Check(tm.Get("b"), IsNil)
+	c.Check(tm.GetFile(headName), IsNil)
+
+	c.Check(recoverPanic(func() { tm.MustAdd("b", "b") }), Equals, ErrFrozen)
+	c.Check(recoverPanic(func() { tm.MustAddFile(headName) }), Equals, ErrFrozen)
+	var logged []string
+	tm.SetLogger(func(level int, format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	})
+	c.Check(tm.Remove("a"), Equals, false)
+	c.Check(tm.RemoveFile(indexName), Equals, false)
+	c.Check(tm.Clear(), Equals, false)
+	c.Check(logged, DeepEquals, []string{
+		"neste: removing templates failed: neste: template manager is frozen",
+		"neste: removing templates failed: neste: template manager is frozen",
+		"neste: removing templates failed: neste: template manager is frozen"})
+	c.Check(tm.TemplateNames(), DeepEquals, []string{"a", "file:" + indexName})
+
+	tm.Unfreeze()
+	_, err = tm.Add("b", "b")
+	c.Check(err, IsNil)
+	c.Check(tm.Remove("a"), Equals, true)
+}
+
+func (s *S) TestGroup(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"admin/header.html":  "Admin header",
+		"public/header.html": "Public header",
+		"shared.html":        "Shared footer",
+		"admin/page.html":    `{include "header.html"}, {include "shared.html"}`,
+		"public/page.html":   `{include "header.html"}, {include "shared.html"}`,
+		"base.html":          "[root {block b}{endblock}]",
+		"admin/base.html":    "[admin {block b}{endblock}]",
+		"admin/child.html":   `{extends "base.html"}{block b}child{endblock}`,
+		"public/child.html":  `{extends "base.html"}{block b}child{endblock}`})
+	defer os.RemoveAll(dir)
+
+	tm := New(dir, nil)
+	admin := tm.Group("admin")
+	public := tm.Group("public")
+	c.Check(tm.Group("admin"), Equals, admin)
+	c.Check(admin.Name(), Equals, "admin")
+
+	for _, g := range []*Group{admin, public} {
+		for _, filename := range []string{"header.html", "page.html", "child.html"} {
+			_, err := g.AddFile(filename)
+			c.Assert(err, IsNil)
+		}
+	}
+	tm.MustAddFile("shared.html")
+
+	c.Check(admin.GetFile("header.html"), Equals, tm.GetFile("admin/header.html"))
+	c.Check(public.GetFile("header.html"), Equals, tm.GetFile("public/header.html"))
+
+	output, err := admin.Render("page.html", nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "Admin header, Shared footer")
+
+	output, err = public.Render("page.html", nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "Public header, Shared footer")
+
+	output, err = admin.Render("child.html", nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "[admin child]")
+
+	output, err = public.Render("child.html", nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "[root child]")
+
+	// Lookup falls back to the template manager.
+	output, err = admin.Render("shared.html", nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "Shared footer")
+
+	_, err = admin.Add("{x}", "string")
+	c.Assert(err, IsNil)
+	c.Check(admin.Get("string"), Equals, tm.Get("admin/string"))
+	c.Check(public.Get("string"), IsNil)
+
+	_, err = public.Render("missing.html", nil)
+	c.Check(err, ErrorMatches, "neste: no template missing.html in group public")
+}
+
+func (s *S) TestSetReadOnly(c *C) {
+	tm, err := NewFromDir(baseDir, nil)
+	c.Assert(err, IsNil)
+	tm.SetReadOnly(true)
+
+	_, err = tm.Add("a", "a")
+	c.Check(err, Equals, ErrReadOnly)
+	_, err = tm.AddFile("missing.html")
+	c.Check(err, Equals, ErrReadOnly)
+	c.Check(recoverPanic(func() { tm.MustAdd("a", "a") }), Equals, ErrReadOnly)
+	var logged []string
+	tm.SetLogger(func(level int, format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	})
+	c.Check(tm.RemoveFile(indexName), Equals, false)
+	c.Check(tm.PurgeStale(), Equals, 0)
+	tm.Reset()
+	c.Check(tm.GetFile(indexName), NotNil)
+	c.Check(logged, DeepEquals, []string{
+		"neste: removing templates failed: neste: template manager is read-only",
+		"neste: removing templates failed: neste: template manager is read-only",
+		"neste: removing templates failed: neste: template manager is read-only"})
+
+	// Freezing doesn't change the reported error.
+	tm.Freeze()
+	tm.Unfreeze()
+	_, err = tm.Add("a", "a")
+	c.Check(err, Equals, ErrReadOnly)
+
+	tm.SetReadOnly(false)
+	_, err = tm.Add("a", "a")
+	c.Check(err, IsNil)
+}
+
+func (s *S) TestPartials(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"_partials/nav.html":       "<nav>{title}</nav>",
+		"_partials/forms/row.html": "<row>",
+		"_layouts/base.html":       "[{block content}{endblock}]",
+		"_more/nav.html":           "<nav>more</nav>",
+		"page.html":                `{include "nav"}{include "forms/row"}`,
+		"child.html":               `{extends "base"}{block content}child{endblock}`,
+		"shared/footer.html":       "<footer>",
+		"footer":                   "regular footer"})
+	defer os.RemoveAll(dir)
+
+	tm, err := NewFromDir(dir, nil)
+	c.Assert(err, IsNil)
+	c.Check(tm.Partials(), DeepEquals, []string{"base", "forms/row", "nav"})
+	c.Check(tm.AllFilenames(), DeepEquals, []string{"child.html", "footer", "page.html", "shared/footer.html"})
+	c.Check(len(tm.GetAllFiles()), Equals, 4)
+
+	output, err := tm.GetFile("page.html").Render(map[string]string{"title": "Home"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "<nav>Home</nav><row>")
+
+	output, err = tm.GetFile("child.html").Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "[child]")
+
+	// Explicitly set partials directory
+	tm = New(dir, nil)
+	var warnings []string
+	tm.SetLogger(func(level int, format string, args ...interface{}) {
+		if level == LogWarning {
+			warnings = append(warnings, fmt.Sprintf(format, args...))
+		}
+	})
+	err = tm.SetPartialsDir("shared")
+	c.Assert(err, IsNil)
+	c.Check(tm.Partials(), DeepEquals, []string{"footer"})
+
+	// Regular templates take priority, with a warning.
+	t := tm.MustAdd(`{include "footer"}`, "page")
+	output, err = t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "<footer>")
+	tm.MustAddFile("footer")
+	output, err = t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "regular footer")
+	c.Check(warnings, DeepEquals, []string{
+		"neste: template footer hides the partial footer of shared/footer.html"})
+
+	tm.RemoveFile("shared/footer.html")
+	c.Check(len(tm.Partials()), Equals, 0)
+
+	// Removing a partial replaced by another keeps the other.
+	tm = New(dir, nil)
+	warnings = nil
+	tm.SetLogger(func(level int, format string, args ...interface{}) {
+		if level == LogWarning {
+			warnings = append(warnings, fmt.Sprintf(format, args...))
+		}
+	})
+	c.Assert(tm.AddDir(""), IsNil)
+	c.Check(warnings, DeepEquals, []string{
+		"neste: partial nav of _partials/nav.html replaces the one of _more/nav.html"})
+	c.Check(tm.RemoveFile("_more/nav.html"), Equals, true)
+	c.Check(tm.Partials(), DeepEquals, []string{"base", "forms/row", "nav"})
+	output, err = tm.GetFile("page.html").Render(map[string]string{"title": "Home"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "<nav>Home</nav><row>")
+}
+
+func (s *S) TestWithFunc(c *C) {
+	upper := func(w io.Writer, formatter string, data ...interface{}) {
+		w.Write(bytes.ToUpper(getBytes(data...)))
+	}
+	slug := func(s string) string {
+		return strings.Replace(strings.ToLower(s), " ", "-", -1)
+	}
+
+	tm := New(baseDir, nil).WithFunc("upper", upper).WithFunc("slug", slug)
+	t := tm.MustAdd("{title|upper} /{title|slug}", "funcs")
+	output, err := t.Render(map[string]string{"title": "Hello World"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "HELLO WORLD /hello-world")
+
+	// Other managers are not affected.
+	_, err = New(baseDir, nil).Add("{title|upper}", "funcs")
+	c.Check(err, NotNil)
+
+	v := recoverPanic(func() { tm.WithFunc("bad", 42) })
+	c.Check(v, Equals, "neste: formatter bad has invalid type int")
+}
+
+func (s *S) TestAddFormatterAlias(c *C) {
+	tm := New(baseDir, nil)
+	c.Assert(tm.AddFormatterAlias("caps", "capFirst"), IsNil)
+	c.Assert(tm.AddFormatterAlias("esc", "html"), IsNil)
+
+	data := map[string]string{"x": "<b>hello</b>"}
+	original, err := tm.MustAdd("{x|capFirst} {x|html}", "original").Render(data)
+	c.Assert(err, IsNil)
+	aliased, err := tm.MustAdd("{x|caps} {x|esc}", "aliased").Render(data)
+	c.Assert(err, IsNil)
+	c.Check(aliased, Equals, original)
+
+	err = tm.AddFormatterAlias("x", "missing")
+	c.Check(err, ErrorMatches, `neste: unknown formatter: "missing"`)
+}
+
+func (s *S) TestFormatterNotFoundHandler(c *C) {
+	var names []string
+	tm := New(baseDir, nil)
+	tm.SetFormatterNotFoundHandler(func(name string) func(io.Writer, string, ...interface{}) {
+		names = append(names, name)
+		if name != "shout" {
+			return nil
+		}
+		return func(w io.Writer, formatter string, data ...interface{}) {
+			w.Write(bytes.ToUpper(getBytes(data...)))
+			io.WriteString(w, "!")
+		}
+	})
+
+	t := tm.MustAdd("{x|shout} {x|html}", "shout")
+	output, err := t.Render(map[string]string{"x": "hi"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "HI! hi")
+	c.Check(names, DeepEquals, []string{"shout"})
+
+	_, err = tm.Add("{x|whisper}", "whisper")
+	c.Check(err, NotNil)
+	c.Check(names, DeepEquals, []string{"shout", "whisper"})
+
+	tm.SetFormatterNotFoundHandler(nil)
+	_, err = tm.Add("{x|shout}", "unhandled")
+	c.Check(err, NotNil)
+}
+
+func (s *S) TestInheritFormatters(c *C) {
+	word := func(s string) func(io.Writer, string, ...interface{}) {
+		return func(w io.Writer, formatter string, data ...interface{}) {
+			io.WriteString(w, s)
+		}
+	}
+
+	plugin := New(baseDir, template.FormatterMap{"plugin": word("plugin"), "shared": word("plugin")})
+	tm := New(baseDir, template.FormatterMap{"shared": word("app")})
+	tm.InheritFormatters(plugin)
+
+	t := tm.MustAdd("{x|plugin} {x|shared} {x|capFirst}", "inherited")
+	output, err := t.Render(map[string]string{"x": "x"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "plugin app X")
+
+	tm.SetOverwriteFormatters(true)
+	tm.InheritFormatters(plugin)
+	t = tm.MustAdd("{x|plugin} {x|shared}", "overwritten")
+	output, err = t.Render(map[string]string{"x": "x"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "plugin plugin")
+}
+
+func (s *S) TestStaticFormatter(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"assets.json": `{"app.css": "app.3f2a1c.css", "app.js": "app.js?v=abc123"}`})
+	defer os.RemoveAll(dir)
+
+	var logged []string
+	tm := New(dir, nil)
+	tm.SetLogger(func(level int, format string, args ...interface{}) {
+		if level == LogWarning {
+			logged = append(logged, fmt.Sprintf(format, args...))
+		}
+	})
+	manifest := path.Join(dir, "assets.json")
+	c.Assert(tm.LoadAssetManifest(manifest), IsNil)
+
+	t := tm.MustAdd("{css|static} {js|static} {logo|static}", "assets")
+	data := map[string]string{"css": "app.css", "js": "app.js", "logo": "logo.png"}
+	output, err := t.Render(data)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "/static/app.3f2a1c.css /static/app.js?v=abc123 /static/logo.png")
+	c.Check(logged, DeepEquals, []string{"neste: asset logo.png not in the asset manifest"})
+
+	// Prefix
+	tm.SetStaticPrefix("https://cdn.example.com/")
+	output, err = t.Render(data)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "https://cdn.example.com/app.3f2a1c.css "+
+		"https://cdn.example.com/app.js?v=abc123 https://cdn.example.com/logo.png")
+
+	// Reloading the manifest
+	tm.SetStaticPrefix("/")
+	touchFile(c, manifest, `{"app.css": "app.9b8e7d.css", "logo.png": "logo.1a2b.png"}`)
+	c.Assert(tm.ReloadAssetManifest(), IsNil)
+	output, err = t.Render(data)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "/app.9b8e7d.css /app.js /logo.1a2b.png")
+
+	// A broken manifest keeps the previous one.
+	touchFile(c, manifest, `{"app.css": `)
+	c.Check(tm.ReloadAssetManifest(), ErrorMatches, "neste: asset manifest .*")
+	output, err = t.Render(data)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "/app.9b8e7d.css /app.js /logo.1a2b.png")
+
+	c.Check(New(dir, nil).ReloadAssetManifest(), ErrorMatches, "neste: no asset manifest loaded")
+}
@@ -0,0 +1,243 @@
+/*
+	The nestetest package provides helpers for testing neste templates.
+
+	RenderGolden compares the output of a template with a golden file, and 
+	WriteFiles writes template files to a temporary directory for tests.
+	Golden files are rewritten with the output instead, if the tests are
+	run with the -update flag:
+
+		gotest -update
+
+	The helpers take a TB, which both *testing.T and *gocheck.C implement.
+*/
+package nestetest
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/fzzbt/neste"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// update is the flag for rewriting golden files with the output.
+var update = flag.Bool("update", false, "rewrite golden files with the output")
+
+// TB is the interface of test states used by the helpers.
+type TB interface {
+	Errorf(format string, args ...interface{})
+	Fatalf(format string, args ...interface{})
+}
+
+// RenderGolden renders tpl with data and compares the output with the
+// contents of the golden file at goldenPath. A mismatch is an error,
+// reported with a diff of the golden file and the output. Failing to render
+// the template or to read the golden file is fatal.
+// With the -update flag, the golden file is written with the output instead.
+func RenderGolden(t TB, tpl *neste.Template, data interface{}, goldenPath string) {
+	output, err := tpl.Render(data)
+	if err != nil {
+		t.Fatalf("nestetest: rendering for %s failed: %s", goldenPath, err)
+		return
+	}
+
+	if *update {
+		err = ioutil.WriteFile(goldenPath, []byte(output), 0644)
+		if err != nil {
+			t.Fatalf("nestetest: updating %s failed: %s", goldenPath, err)
+		}
+		return
+	}
+
+	golden, err := ioutil.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatalf("nestetest: %s (run with -update to create it)", err)
+		return
+	}
+	if string(golden) != output {
+		t.Errorf("nestetest: output differs from %s:\n%s", goldenPath,
+			Diff(goldenPath, "output", string(golden), output))
+	}
+}
+
+// AssertParses adds all template files in the directory dir of the base
+// directory of m to m, and fails listing every template that can't be
+// parsed. The templates that can be parsed are added.
+func AssertParses(t TB, m *neste.Manager, dir string) {
+	errs := m.AddDirAll(dir)
+	if len(errs) == 0 {
+		return
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "nestetest: %d templates in %q failed to parse:", len(errs), dir)
+	for _, err := range errs {
+		fmt.Fprintf(&buf, "\n\t%s", err)
+	}
+	t.Errorf("%s", buf.String())
+}
+
+// WriteFiles writes files, which maps paths relative to the directory to 
+// contents, to a new temporary directory and returns its path, creating 
+// subdirectories as needed. The caller removes the directory, for example 
+// with defer os.RemoveAll(dir).
+func WriteFiles(t TB, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "nestetest")
+	if err != nil {
+		t.Fatalf("nestetest: %s", err)
+		return ""
+	}
+
+	for name, content := range files {
+		fpath := path.Join(dir, name)
+		err = os.MkdirAll(path.Dir(fpath), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(fpath, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatalf("nestetest: %s", err)
+			return dir
+		}
+	}
+	return dir
+}
+
+// context is the number of unchanged lines shown around changes in diffs.
+const context = 3
+
+// Diff returns a unified diff of the lines of a and b, named aName and
+// bName in the header. It returns "" if a and b are equal. A last line 
+// without a line ending is marked with "\ No newline at end of file".
+func Diff(aName, bName, a, b string) string {
+	if a == b {
+		return ""
+	}
+	aLines, bLines := splitLines(a), splitLines(b)
+	ops := diffLines(aLines, bLines)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", aName, bName)
+	for i := 0; i < len(ops); {
+		// Find the next change and the changes following it closely.
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+		end := i + 1
+		for j := end; j < len(ops) && j-end <= 2*context; j++ {
+			if ops[j].kind != ' ' {
+				end = j + 1
+			}
+		}
+
+		start, hunkEnd := i-context, end+context
+		if start < 0 {
+			start = 0
+		}
+		if hunkEnd > len(ops) {
+			hunkEnd = len(ops)
+		}
+		writeHunk(&buf, ops[start:hunkEnd])
+		i = hunkEnd
+	}
+	return buf.String()
+}
+
+// diffOp is a line of a diff: kind is ' ' for unchanged lines, '-' for
+// lines only in the first text and '+' for lines only in the second.
+// aLine and bLine are the numbers of the line in the texts, counted
+// from 1, or the number of the line before for lines not in the text.
+type diffOp struct {
+	kind         byte
+	line         string
+	aLine, bLine int
+}
+
+// diffLines returns the diff of the lines a and b by their longest common
+// subsequence.
+func diffLines(a, b []string) []diffOp {
+	// lcs[i][j] is the length of the longest common subsequence of
+	// a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var ops []diffOp
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i], i + 1, j + 1})
+			i++
+			j++
+		case j == len(b) || i < len(a) && lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', a[i], i + 1, j})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j], i, j + 1})
+			j++
+		}
+	}
+	return ops
+}
+
+// writeHunk writes the lines ops of a diff as a hunk with its header.
+func writeHunk(buf *bytes.Buffer, ops []diffOp) {
+	aStart, bStart, aCount, bCount := 0, 0, 0, 0
+	for _, op := range ops {
+		if op.kind != '+' {
+			if aCount == 0 {
+				aStart = op.aLine
+			}
+			aCount++
+		}
+		if op.kind != '-' {
+			if bCount == 0 {
+				bStart = op.bLine
+			}
+			bCount++
+		}
+	}
+	if aCount == 0 {
+		aStart = ops[0].aLine
+	}
+	if bCount == 0 {
+		bStart = ops[0].bLine
+	}
+
+	fmt.Fprintf(buf, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+	for _, op := range ops {
+		fmt.Fprintf(buf, "%c%s", op.kind, op.line)
+		if !strings.HasSuffix(op.line, "\n") {
+			buf.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// splitLines splits s into lines, keeping their line endings so that a 
+// last line without one differs from the same line with one. A final line 
+// ending doesn't begin another line.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n", -1)
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
@@ -0,0 +1,140 @@
+package nestetest
+
+import (
+	. "launchpad.net/gocheck"
+	"fmt"
+	"github.com/fzzbt/neste"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type S struct{}
+
+var _ = Suite(&S{})
+
+// recorder is a TB recording the failures reported to it.
+type recorder struct {
+	errors []string
+	fatal  string
+}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) Fatalf(format string, args ...interface{}) {
+	r.fatal = fmt.Sprintf(format, args...)
+}
+
+func (s *S) TestRenderGolden(c *C) {
+	dir := WriteFiles(c, map[string]string{
+		"page.html":   "<h1>{title}</h1>\n<p>{body}</p>\n",
+		"page.golden": "<h1>Hello</h1>\n<p>World</p>\n"})
+	defer os.RemoveAll(dir)
+	golden := path.Join(dir, "page.golden")
+
+	tm := neste.New(dir, nil)
+	t := tm.MustAddFile("page.html")
+
+	r := &recorder{}
+	RenderGolden(r, t, map[string]string{"title": "Hello", "body": "World"}, golden)
+	c.Check(r.errors, IsNil)
+	c.Check(r.fatal, Equals, "")
+
+	r = &recorder{}
+	RenderGolden(r, t, map[string]string{"title": "Hello", "body": "Neste"}, golden)
+	c.Assert(len(r.errors), Equals, 1)
+	c.Check(r.errors[0], Equals, "nestetest: output differs from "+golden+":\n"+
+		"--- "+golden+"\n"+
+		"+++ output\n"+
+		"@@ -1,2 +1,2 @@\n"+
+		" <h1>Hello</h1>\n"+
+		"-<p>World</p>\n"+
+		"+<p>Neste</p>\n")
+
+	r = &recorder{}
+	RenderGolden(r, t, map[string]string{"title": "Hello", "body": "World"}, golden+".missing")
+	c.Check(r.errors, IsNil)
+	c.Check(r.fatal, Matches, "nestetest: .* \\(run with -update to create it\\)")
+
+	r = &recorder{}
+	RenderGolden(r, t, map[string]string{"title": "Hello"}, golden)
+	c.Check(r.fatal, Matches, "nestetest: rendering for .* failed: .*")
+}
+
+func (s *S) TestRenderGoldenUpdate(c *C) {
+	dir := WriteFiles(c, map[string]string{"page.html": "<p>{body}</p>\n"})
+	defer os.RemoveAll(dir)
+	golden := path.Join(dir, "page.golden")
+
+	tm := neste.New(dir, nil)
+	t := tm.MustAddFile("page.html")
+
+	*update = true
+	defer func() { *update = false }()
+	r := &recorder{}
+	RenderGolden(r, t, map[string]string{"body": "Updated"}, golden)
+	c.Check(r.errors, IsNil)
+	c.Check(r.fatal, Equals, "")
+
+	b, err := ioutil.ReadFile(golden)
+	c.Assert(err, IsNil)
+	c.Check(string(b), Equals, "<p>Updated</p>\n")
+}
+
+func (s *S) TestAssertParses(c *C) {
+	dir := WriteFiles(c, map[string]string{
+		"a.html": "{title}",
+		"b.html": "{.section title}",
+		"c.html": "{title|nosuchformatter}"})
+	defer os.RemoveAll(dir)
+
+	r := &recorder{}
+	tm := neste.New(dir, nil)
+	AssertParses(r, tm, "")
+	c.Assert(len(r.errors), Equals, 1)
+	c.Check(r.errors[0], Matches, `nestetest: 2 templates in "" failed to parse:\n`+
+		`\tneste: b.html: .*\n\tneste: c.html: .*`)
+	c.Check(tm.GetFile("a.html"), NotNil)
+
+	r = &recorder{}
+	AssertParses(r, neste.New(dir, nil), "a.html")
+	c.Check(r.errors, IsNil)
+}
+
+func (s *S) TestWriteFiles(c *C) {
+	dir := WriteFiles(c, map[string]string{
+		"a.html":     "a",
+		"sub/b.html": "b"})
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{"a.html": "a", "sub/b.html": "b"} {
+		b, err := ioutil.ReadFile(path.Join(dir, name))
+		c.Assert(err, IsNil)
+		c.Check(string(b), Equals, content)
+	}
+}
+
+func (s *S) TestDiff(c *C) {
+	c.Check(Diff("a", "b", "same\n", "same\n"), Equals, "")
+
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n16\n"
+	b := "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n16\nseventeen\n"
+	c.Check(Diff("a", "b", a, b), Equals, "--- a\n+++ b\n"+
+		"@@ -1,6 +1,6 @@\n 1\n 2\n-3\n+three\n 4\n 5\n 6\n"+
+		"@@ -14,3 +14,4 @@\n 14\n 15\n 16\n+seventeen\n")
+
+	c.Check(Diff("a", "b", "", "new\n"), Equals, "--- a\n+++ b\n@@ -0,0 +1,1 @@\n+new\n")
+
+	// Texts differing only by the final line ending.
+	c.Check(Diff("a", "b", "1\n2", "1\n2\n"), Equals, "--- a\n+++ b\n"+
+		"@@ -1,2 +1,2 @@\n 1\n-2\n\\ No newline at end of file\n+2\n")
+	c.Check(Diff("a", "b", "1\nold", "1\nnew"), Equals, "--- a\n+++ b\n"+
+		"@@ -1,2 +1,2 @@\n 1\n-old\n\\ No newline at end of file\n"+
+		"+new\n\\ No newline at end of file\n")
+}
@@ -0,0 +1,2048 @@
+// neste template engine: template preprocessing
+
+package neste
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"template"
+	"unicode"
+)
+
+// action represents a single delimited action in template source.
+type action struct {
+	start int    // Offset of the left delimiter
+	end   int    // Offset just past the right delimiter
+	text  string // Text between the delimiters
+}
+
+// scanActions returns the actions of src delimited by ldelim and rdelim.
+// Like in the template package, an action may not span multiple lines.
+// Delimiters within double quoted strings in actions, like in 
+// {field("Name", "{name}")}, are part of the action text.
+func scanActions(src, ldelim, rdelim string) (actions []action) {
+	for i := 0; i < len(src); {
+		l := strings.Index(src[i:], ldelim)
+		if l < 0 {
+			break
+		}
+		l += i
+		r := closeAction(src[l+len(ldelim):], rdelim)
+		if r < 0 {
+			break
+		}
+		r += l + len(ldelim)
+		text := src[l+len(ldelim) : r]
+		if strings.Contains(text, "\n") {
+			i = l + len(ldelim)
+			continue
+		}
+
+		actions = append(actions, action{l, r + len(rdelim), text})
+		i = r + len(rdelim)
+	}
+	return
+}
+
+// closeAction returns the offset of the right delimiter closing the action 
+// whose text begins s, skipping over quoted strings, or -1 if there is none.
+func closeAction(s, rdelim string) int {
+	for i := 0; i < len(s); i++ {
+		if strings.HasPrefix(s[i:], rdelim) {
+			return i
+		}
+		if s[i] == '"' {
+			if j := quoteEnd(s[i:]); j > 0 {
+				i += j
+			}
+		}
+	}
+	return -1
+}
+
+// quoteEnd returns the offset of the double quote closing the quoted string 
+// at the beginning of s, or -1 if it is not closed on the same line.
+func quoteEnd(s string) int {
+	for i := 1; i < len(s) && s[i] != '\n'; i++ {
+		if s[i] == '\\' {
+			i++
+		} else if s[i] == '"' {
+			return i
+		}
+	}
+	return -1
+}
+
+// directive splits action text into a directive name and its argument.
+func directive(text string) (name, arg string) {
+	text = strings.TrimSpace(text)
+	i := strings.IndexFunc(text, unicode.IsSpace)
+	if i < 0 {
+		return text, ""
+	}
+	return text[:i], strings.TrimSpace(text[i+1:])
+}
+
+// unquote returns the value of a double quoted directive argument.
+func unquote(arg string) (string, os.Error) {
+	s, err := strconv.Unquote(arg)
+	if err != nil || len(arg) == 0 || arg[0] != '"' {
+		return "", fmt.Errorf("neste: expected quoted string, got %s", arg)
+	}
+	return s, nil
+}
+
+// preprocessor holds the state of preprocessing a single template source.
+type preprocessor struct {
+	m      *Manager
+	group  string                // Group of the template, "" if none
+	deps   map[string]int64      // Modified times of the files read
+	fmap   template.FormatterMap // Formatters generated for directives
+	limits int                   // Number of limited repeated sections
+}
+
+// Preprocess applies neste's own directives to the source src of the
+// template with the given name before it is handed to the template package.
+// Files read while preprocessing are recorded in deps with their
+// modified times, so that reloading can detect changes in them.
+// Directives that act during execution are replaced by calls to formatters,
+// which are returned in fmap. Limited is true if the template has limited
+// repeated sections, and must be executed as a limitedTemplate.
+func (m *Manager) preprocess(src, name string, deps map[string]int64) (s string,
+fmap template.FormatterMap, limited bool, err os.Error) {
+	p := &preprocessor{
+		m:     m,
+		group: m.groupOf(name),
+		deps:  deps,
+		fmap:  make(template.FormatterMap)}
+
+	s, _, err = m.splitDefines(src)
+	if err != nil {
+		return
+	}
+
+	s, err = p.expandVerbatim(s)
+	if err != nil {
+		return
+	}
+
+	s, err = p.expandExtends(m.trimSpace(s))
+	if err != nil {
+		return
+	}
+
+	s, err = p.expandMacros(s)
+	if err != nil {
+		return
+	}
+
+	s, err = p.expandBlocks(s)
+	if err != nil {
+		return
+	}
+
+	s, err = p.expandSet(s)
+	if err != nil {
+		return
+	}
+
+	s, err = p.replaceActions(s, p.include)
+	if err != nil {
+		return
+	}
+
+	s, err = p.expandSpaceless(s)
+	if err != nil {
+		return
+	}
+
+	s, err = p.expandLimits(s)
+	if err != nil {
+		return
+	}
+
+	s, err = p.expandCycles(s)
+	if err != nil {
+		return
+	}
+
+	s, err = p.replaceActions(s, p.yield)
+	if err != nil {
+		return
+	}
+
+	s, err = p.replaceActions(s, p.firstOf)
+	if err != nil {
+		return
+	}
+
+	s, err = p.replaceActions(s, p.now)
+	if err != nil {
+		return
+	}
+
+	s, err = p.replaceActions(s, p.trans)
+	if err != nil {
+		return
+	}
+
+	s, err = p.replaceActions(s, p.plural)
+	if err != nil {
+		return
+	}
+
+	err = p.resolveFormatters(s)
+	if err != nil {
+		return
+	}
+
+	if p.limits > 0 {
+		s = wrapLimited(s, m.ldelim, m.rdelim)
+	}
+	return s, p.fmap, p.limits > 0, nil
+}
+
+// replaceActions returns src with its actions replaced by the results of fn.
+// Actions for which fn returns false are left as they are.
+func (p *preprocessor) replaceActions(src string,
+fn func(text string) (string, bool, os.Error)) (string, os.Error) {
+	var buf bytes.Buffer
+	last := 0
+	for _, a := range scanActions(src, p.m.ldelim, p.m.rdelim) {
+		s, ok, err := fn(a.text)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			continue
+		}
+
+		buf.WriteString(src[last:a.start])
+		buf.WriteString(s)
+		last = a.end
+	}
+	buf.WriteString(src[last:])
+
+	return buf.String(), nil
+}
+
+// call registers fn as a formatter for a directive and returns an action
+// calling it with the value of field, "@" for the cursor.
+func (p *preprocessor) call(field string,
+fn func(w *contextWriter, data ...interface{})) string {
+	name := fmt.Sprintf("neste.%d", len(p.fmap))
+	p.fmap[name] = func(w io.Writer, formatter string, data ...interface{}) {
+		fn(w.(*contextWriter), data...)
+	}
+	return p.m.ldelim + field + "|" + name + p.m.rdelim
+}
+
+// templateFormatters are the formatters built into the template package.
+var templateFormatters = template.FormatterMap{
+	"":     template.StringFormatter,
+	"str":  template.StringFormatter,
+	"html": template.HTMLFormatter}
+
+// formatter returns the formatter with the given name, or nil if there is
+// no such formatter. A formatter with an argument, like "wrap:72", is the
+// formatter named before the colon, which is added to fmap by the full name
+// for the template package to find it. The formatter gets the argument from
+// the name it is called with.
+func (p *preprocessor) formatter(name string) func(io.Writer, string, ...interface{}) {
+	if fn, present := p.fmap[name]; present {
+		return fn
+	}
+	if fn, present := p.m.fmap[name]; present {
+		return fn
+	}
+	if name == "static" {
+		// The static formatter uses the asset manifest of the manager.
+		p.fmap[name] = p.m.static
+		return p.m.static
+	}
+	if fn, present := templateFormatters[name]; present && !(p.m.text && name == "html") {
+		return fn
+	}
+	if i := strings.Index(name, ":"); i > 0 {
+		if fn := p.formatter(name[:i]); fn != nil {
+			p.fmap[name] = fn
+			return fn
+		}
+	}
+	if p.m.notFound != nil {
+		if fn := p.m.notFound(name); fn != nil {
+			p.fmap[name] = fn
+			return fn
+		}
+	}
+	return nil
+}
+
+// resolveFormatters looks up the formatters of the variable actions in src,
+// so that formatters with arguments, and the formatters returned by the
+// formatter not found handler of the template manager, are in fmap.
+// Unknown formatters are reported here, as the template package would
+// accept its own html formatter even for text template managers.
+func (p *preprocessor) resolveFormatters(src string) os.Error {
+	for _, a := range scanActions(src, p.m.ldelim, p.m.rdelim) {
+		text := strings.TrimSpace(a.text)
+		if strings.HasPrefix(text, ".") || strings.HasPrefix(text, "#") {
+			continue
+		}
+		for _, name := range strings.Split(text, "|", -1)[1:] {
+			name = strings.TrimSpace(name)
+			if p.formatter(name) == nil {
+				return fmt.Errorf("neste: unknown formatter: %q", name)
+			}
+		}
+	}
+	return nil
+}
+
+// splitFormatters splits action text of the form "field|f1|f2" into the
+// field and the chain of formatters, checking that the formatters exist.
+// The chain consists of the default formatter "" if there are none.
+func (p *preprocessor) splitFormatters(text string) (field string,
+formatters []string, err os.Error) {
+	parts := strings.Split(strings.TrimSpace(text), "|", -1)
+	field = strings.TrimSpace(parts[0])
+	formatters = parts[1:]
+	if len(formatters) == 0 {
+		formatters = []string{""}
+	}
+
+	for i, name := range formatters {
+		formatters[i] = strings.TrimSpace(name)
+		if p.formatter(formatters[i]) == nil {
+			return "", nil, fmt.Errorf("neste: unknown formatter: %q", name)
+		}
+	}
+	return
+}
+
+// format writes data formatted with the given chain of formatters to w,
+// like the template package does for variables.
+func (p *preprocessor) format(w io.Writer, formatters []string, data ...interface{}) {
+	for _, name := range formatters[:len(formatters)-1] {
+		var buf bytes.Buffer
+		p.formatter(name)(&buf, name, data...)
+		data = []interface{}{buf.Bytes()}
+	}
+
+	name := formatters[len(formatters)-1]
+	p.formatter(name)(w, name, data...)
+}
+
+// splitQuoted splits a directive argument beginning with a double quoted
+// string into the unquoted string and the rest of the argument.
+func splitQuoted(arg string) (s, rest string, err os.Error) {
+	if len(arg) > 0 && arg[0] == '"' {
+		for i := 1; i < len(arg); i++ {
+			if arg[i] == '\\' {
+				i++
+			} else if arg[i] == '"' {
+				s, err = unquote(arg[:i+1])
+				return s, strings.TrimSpace(arg[i+1:]), err
+			}
+		}
+	}
+	return "", "", fmt.Errorf("neste: expected quoted string, got %s", arg)
+}
+
+// Defines
+//
+// {define "name"}...{enddefine} in a template file defines a template of
+// its own, which is added to the template manager with the template file as
+// "filename#name". The defines are removed from the template file itself.
+// Defines can't be nested.
+
+// splitDefines splits src into the source outside its define blocks and
+// the bodies of the blocks by name. Verbatim regions are skipped, so that 
+// defines in them are left as they are.
+func (m *Manager) splitDefines(src string) (outer string, defines map[string]string,
+err os.Error) {
+	defines = make(map[string]string)
+	endVerbatim := m.ldelim + "endverbatim" + m.rdelim
+	var buf bytes.Buffer
+	var name string
+	open := false
+	last, bodyStart, pos := 0, 0, 0
+scan:
+	for {
+		for _, a := range scanActions(src[pos:], m.ldelim, m.rdelim) {
+			a.start += pos
+			a.end += pos
+			dname, arg := directive(a.text)
+			switch dname {
+			case "verbatim":
+				if arg != "" {
+					continue
+				}
+				i := strings.Index(src[a.end:], endVerbatim)
+				if i < 0 {
+					return "", nil, os.NewError("neste: unterminated verbatim")
+				}
+				pos = a.end + i + len(endVerbatim)
+				continue scan
+			case "define":
+				if open {
+					return "", nil, fmt.Errorf("neste: define %s in define %s", arg, name)
+				}
+				name, err = unquote(arg)
+				if err != nil {
+					return
+				}
+				if _, present := defines[name]; present {
+					return "", nil, fmt.Errorf("neste: %s is defined twice", name)
+				}
+				buf.WriteString(src[last:a.start])
+				open = true
+				bodyStart = a.end
+			case "enddefine":
+				if !open {
+					return "", nil, os.NewError("neste: unexpected enddefine")
+				}
+				defines[name] = src[bodyStart:a.start]
+				open = false
+				last = a.end
+			}
+		}
+		break
+	}
+	if open {
+		return "", nil, fmt.Errorf("neste: unterminated define %s", name)
+	}
+	buf.WriteString(src[last:])
+
+	return buf.String(), defines, nil
+}
+
+// Verbatim
+//
+// {verbatim}...{endverbatim} outputs its body exactly as written, without
+// interpreting any actions or directives in it. Verbatim regions can't be
+// nested.
+
+// expandVerbatim replaces the verbatim regions in src with actions
+// outputting their bodies. It is done before anything else but splitting 
+// the defines, which skips verbatim regions, so that the bodies are not 
+// seen by other directives.
+func (p *preprocessor) expandVerbatim(src string) (string, os.Error) {
+	ldelim, rdelim := p.m.ldelim, p.m.rdelim
+	end := ldelim + "endverbatim" + rdelim
+
+	var buf bytes.Buffer
+	for {
+		found := false
+		for _, a := range scanActions(src, ldelim, rdelim) {
+			if strings.TrimSpace(a.text) == "verbatim" {
+				buf.WriteString(src[:a.start])
+				src = src[a.end:]
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+
+		i := strings.Index(src, end)
+		if i < 0 {
+			return "", os.NewError("neste: unterminated verbatim")
+		}
+		body := src[:i]
+		buf.WriteString(p.call("@", func(w *contextWriter, data ...interface{}) {
+			io.WriteString(w, body)
+		}))
+		src = src[i+len(end):]
+	}
+	buf.WriteString(src)
+
+	return buf.String(), nil
+}
+
+// splitArgs splits a directive argument into space separated fields and
+// double quoted strings. For each field, fields has the field and literals
+// has "", and for each quoted string, fields has "" and literals has the
+// unquoted string.
+func splitArgs(arg string) (fields, literals []string, err os.Error) {
+	for arg != "" {
+		if arg[0] == '"' {
+			var s string
+			s, arg, err = splitQuoted(arg)
+			if err != nil {
+				return nil, nil, err
+			}
+			fields = append(fields, "")
+			literals = append(literals, s)
+			continue
+		}
+
+		i := strings.IndexFunc(arg, unicode.IsSpace)
+		if i < 0 {
+			i = len(arg)
+		}
+		fields = append(fields, arg[:i])
+		literals = append(literals, "")
+		arg = strings.TrimSpace(arg[i:])
+	}
+	return
+}
+
+// Whitespace control
+//
+// A hyphen immediately after the left delimiter, like in {-name}, removes
+// all white space, including newlines, between the action and the preceding
+// text. A hyphen immediately before the right delimiter, like in {name-},
+// removes all white space between the action and the following text.
+// Both may be used in the same action, and with any action or directive.
+
+// trimSpace removes the white space marked by whitespace control hyphens
+// in src, and the hyphens themselves.
+func (m *Manager) trimSpace(src string) string {
+	var buf bytes.Buffer
+	trimNext := false
+	last := 0
+	for _, a := range scanActions(src, m.ldelim, m.rdelim) {
+		text := a.text
+		left := strings.HasPrefix(text, "-")
+		if left {
+			text = text[1:]
+		}
+		right := strings.HasSuffix(text, "-")
+		if right {
+			text = text[:len(text)-1]
+		}
+		if !left && !right && !trimNext {
+			continue
+		}
+
+		before := src[last:a.start]
+		if trimNext {
+			before = strings.TrimLeftFunc(before, unicode.IsSpace)
+		}
+		if left {
+			before = strings.TrimRightFunc(before, unicode.IsSpace)
+		}
+		buf.WriteString(before)
+
+		if left || right {
+			buf.WriteString(m.ldelim + strings.TrimSpace(text) + m.rdelim)
+		} else {
+			buf.WriteString(src[a.start:a.end])
+		}
+		trimNext = right
+		last = a.end
+	}
+
+	rest := src[last:]
+	if trimNext {
+		rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+	}
+	buf.WriteString(rest)
+
+	return buf.String()
+}
+
+// escapeDelims returns s with the delimiters replaced by actions producing
+// them, so that the template package outputs s literally.
+func (p *preprocessor) escapeDelims(s string) string {
+	ldelim, rdelim := p.m.ldelim, p.m.rdelim
+	var buf bytes.Buffer
+	for len(s) > 0 {
+		l := strings.Index(s, ldelim)
+		r := strings.Index(s, rdelim)
+		switch {
+		case l >= 0 && (r < 0 || l <= r):
+			buf.WriteString(s[:l])
+			buf.WriteString(ldelim + ".meta-left" + rdelim)
+			s = s[l+len(ldelim):]
+		case r >= 0:
+			buf.WriteString(s[:r])
+			buf.WriteString(ldelim + ".meta-right" + rdelim)
+			s = s[r+len(rdelim):]
+		default:
+			buf.WriteString(s)
+			s = ""
+		}
+	}
+	return buf.String()
+}
+
+// Macros
+//
+// {macro name(param1, param2)}body{endmacro} defines a macro, which is
+// expanded in place of calls like {name("value1", "value2")}. Within the
+// body, {param1} is replaced by the value of the parameter, HTML escaped.
+// Macros may call other macros, passing their own parameters or quoted
+// strings as arguments. Calls to undefined macros and calls with a wrong
+// number of arguments are errors.
+
+// maxMacroDepth is the maximum depth of nested macro calls.
+const maxMacroDepth = 32
+
+// macro is a macro definition.
+type macro struct {
+	params []string
+	body   string
+}
+
+// isIdent returns true if s is a valid macro or parameter name.
+func isIdent(s string) bool {
+	for i, r := range s {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// parseCall splits action text of the form name(arg1, arg2) into the name
+// and the arguments. Ok is false if text is not of that form.
+func parseCall(text string) (name string, args []string, ok bool) {
+	text = strings.TrimSpace(text)
+	i := strings.Index(text, "(")
+	if i < 0 || !strings.HasSuffix(text, ")") || !isIdent(text[:i]) {
+		return "", nil, false
+	}
+	name = text[:i]
+
+	// Split the arguments at commas outside quoted strings.
+	rest := strings.TrimSpace(text[i+1 : len(text)-1])
+	quoted := false
+	start := 0
+	for j := 0; j < len(rest); j++ {
+		switch {
+		case quoted && rest[j] == '\\':
+			j++
+		case rest[j] == '"':
+			quoted = !quoted
+		case !quoted && rest[j] == ',':
+			args = append(args, strings.TrimSpace(rest[start:j]))
+			start = j + 1
+		}
+	}
+	if rest != "" {
+		args = append(args, strings.TrimSpace(rest[start:]))
+	}
+	return name, args, true
+}
+
+// expandMacros removes the macro definitions from src and expands the
+// calls to them.
+func (p *preprocessor) expandMacros(src string) (string, os.Error) {
+	macros := make(map[string]*macro)
+
+	var buf bytes.Buffer
+	var cur *macro
+	var curName string
+	last := 0
+	for _, a := range scanActions(src, p.m.ldelim, p.m.rdelim) {
+		name, arg := directive(a.text)
+		switch name {
+		case "macro":
+			if cur != nil {
+				return "", fmt.Errorf("neste: macro %s defined inside macro %s", arg, curName)
+			}
+
+			var params []string
+			var ok bool
+			curName, params, ok = parseCall(arg)
+			if !ok {
+				return "", fmt.Errorf("neste: bad macro definition: %s", arg)
+			}
+			for _, param := range params {
+				if !isIdent(param) {
+					return "", fmt.Errorf("neste: macro %s: bad parameter %s", curName, param)
+				}
+			}
+			if _, present := macros[curName]; present {
+				return "", fmt.Errorf("neste: macro %s redefined", curName)
+			}
+
+			cur = &macro{params: params}
+			buf.WriteString(src[last:a.start])
+			last = a.end
+		case "endmacro":
+			if cur == nil {
+				return "", os.NewError("neste: unexpected endmacro")
+			}
+			cur.body = src[last:a.start]
+			macros[curName] = cur
+			cur = nil
+			last = a.end
+		}
+	}
+	if cur != nil {
+		return "", fmt.Errorf("neste: unterminated macro %s", curName)
+	}
+	buf.WriteString(src[last:])
+
+	return p.expandCalls(buf.String(), macros, nil, 0)
+}
+
+// expandCalls expands the macro calls in src. Env holds the parameter values
+// of the macro being expanded, if any.
+func (p *preprocessor) expandCalls(src string, macros map[string]*macro,
+env map[string]string, depth int) (string, os.Error) {
+	return p.replaceActions(src, func(text string) (string, bool, os.Error) {
+		if v, present := env[strings.TrimSpace(text)]; present {
+			var buf bytes.Buffer
+			template.HTMLEscape(&buf, []byte(v))
+			return p.escapeDelims(buf.String()), true, nil
+		}
+
+		name, args, ok := parseCall(text)
+		if !ok {
+			return "", false, nil
+		}
+
+		mac := macros[name]
+		if mac == nil {
+			return "", false, fmt.Errorf("neste: undefined macro %s", name)
+		}
+		if len(args) != len(mac.params) {
+			return "", false, fmt.Errorf("neste: macro %s takes %d arguments, got %d",
+				name, len(mac.params), len(args))
+		}
+		if depth >= maxMacroDepth {
+			return "", false, fmt.Errorf("neste: macro %s: calls nested too deeply", name)
+		}
+
+		values := make(map[string]string, len(args))
+		for i, arg := range args {
+			v, present := env[arg]
+			if !present {
+				var err os.Error
+				v, err = unquote(arg)
+				if err != nil {
+					return "", false, fmt.Errorf("neste: macro %s: bad argument %s", name, arg)
+				}
+			}
+			values[mac.params[i]] = v
+		}
+
+		s, err := p.expandCalls(mac.body, macros, values, depth+1)
+		return s, true, err
+	})
+}
+
+// Block directives
+//
+// Block directives have a body closed by {end}, and optionally an {else}
+// branch. {else} and {end} outside block directives are left as they are.
+//
+// {with Field}...{else}...{end} executes its body with the cursor set to
+// the value of Field, which may be a path like User.Address. If the value
+// is empty, such as a nil pointer, an empty string or a missing map key,
+// the else branch is executed instead, if there is one. It is a shorthand
+// for a section.
+//
+// {autoescape off}...{end} turns automatic escaping off for its body, and
+// {autoescape on}...{end} turns it on. See Manager.SetAutoEscape.
+//
+// {ifequal A B}...{else}...{end} executes its body if A and B are equal,
+// and the else branch otherwise. {ifnotequal A B} is the opposite. A and B
+// are fields, @ for the cursor, or double quoted strings. They are compared
+// as strings, formatted like with the default formatter, so that 1 and "1"
+// are equal. Missing fields are empty strings. The branch not taken is
+// executed with its output discarded, so directives in it, like set, still
+// take effect.
+
+// blockAction holds the replacements for the {else} and {end} directives
+// of an open block directive.
+type blockAction struct {
+	name       string
+	elseAction string // Replacement for {else}, "" if not allowed
+	endAction  string // Replacement for {end}
+	autoEscape bool   // Whether variables in the body are escaped
+}
+
+// directives are the names of neste's directives. Actions beginning with
+// them are not variables, even without arguments, like {else} or {now}.
+var directives = map[string]bool{
+	"autoescape":   true,
+	"block":        true,
+	"cycle":        true,
+	"define":       true,
+	"else":         true,
+	"end":          true,
+	"endblock":     true,
+	"enddefine":    true,
+	"endmacro":     true,
+	"endspaceless": true,
+	"endverbatim":  true,
+	"extends":      true,
+	"firstof":      true,
+	"ifequal":      true,
+	"ifnotequal":   true,
+	"include":      true,
+	"macro":        true,
+	"now":          true,
+	"plural":       true,
+	"set":          true,
+	"spaceless":    true,
+	"trans":        true,
+	"verbatim":     true,
+	"with":         true,
+	"yield":        true}
+
+// escapingFormatters are the formatters whose output is escaped already, 
+// or markup meant to be output as it is. Variables ending with them are 
+// not escaped in automatic escaping mode.
+var escapingFormatters = map[string]bool{
+	"attr":     true,
+	"e":        true,
+	"html":     true,
+	"js":       true,
+	"json":     true,
+	"markdown": true,
+	"sanitize": true,
+	"urlAttr":  true,
+	"xml":      true}
+
+// isVariable returns true if action text is a variable, with or without 
+// formatters.
+func isVariable(text string) bool {
+	text = strings.TrimSpace(text)
+	if text == "" || text[0] == '.' || text[0] == '#' {
+		return false
+	}
+	if name, _ := directive(text); directives[name] {
+		return false
+	}
+	field := strings.TrimSpace(strings.Split(text, "|", 2)[0])
+	return field != "" && strings.IndexFunc(field, unicode.IsSpace) < 0
+}
+
+// needsEscaping returns true if the output of variable action text is 
+// escaped in automatic escaping mode, that is, unless it is marked with 
+// the safe formatter or its last formatter is an escaping formatter.
+func needsEscaping(text string) bool {
+	formatters := strings.Split(strings.TrimSpace(text), "|", -1)[1:]
+	last := ""
+	for _, name := range formatters {
+		name = strings.TrimSpace(name)
+		if i := strings.Index(name, ":"); i > 0 {
+			name = name[:i]
+		}
+		if name == "safe" {
+			return false
+		}
+		last = name
+	}
+	return !escapingFormatters[last]
+}
+
+// Escaping contexts
+//
+// In automatic escaping mode, the escaping formatter of a variable depends
+// on its position in the static markup around it: html in text, attr in
+// quoted attribute values, urlAttr at the beginning of URL attribute values
+// like href, js in JavaScript strings of script elements, and js followed
+// by attr in JavaScript strings of event handler attributes like onclick.
+// Only well-formed markup is recognized. Variables in other positions, such
+// as tags, unquoted attribute values and scripts outside of strings, are
+// escaped with html.
+
+// States of the markup around a variable.
+const (
+	stateText = iota
+	stateComment
+	stateTag
+	stateAttrName
+	stateAfterName
+	stateBeforeValue
+	stateValue // Quoted attribute value
+	stateUnquotedValue
+	stateScript
+)
+
+// urlAttrs are the attributes whose values are URLs.
+var urlAttrs = map[string]bool{
+	"action":     true,
+	"background": true,
+	"cite":       true,
+	"formaction": true,
+	"href":       true,
+	"poster":     true,
+	"src":        true}
+
+// escapeContext is the state of the markup at a position of a template.
+type escapeContext struct {
+	state      int
+	tag        string // Name of the current or last tag, "/name" for end tags
+	attr       string // Name of the current attribute
+	quote      byte   // Quote of the current attribute value
+	jsQuote    byte   // Quote of the current JavaScript string, 0 if none
+	jsEscape   bool   // Whether the last character was a backslash in a string
+	valueStart bool   // Whether the position begins the attribute value
+}
+
+// escaper returns the formatter escaping variables at the position.
+func (c *escapeContext) escaper() string {
+	switch c.state {
+	case stateText:
+		return "html"
+	case stateValue:
+		attr := strings.ToLower(c.attr)
+		switch {
+		case strings.HasPrefix(attr, "on"):
+			if c.jsQuote != 0 {
+				return "js|attr"
+			}
+		case urlAttrs[attr] && c.valueStart:
+			return "urlAttr"
+		default:
+			return "attr"
+		}
+	case stateScript:
+		if c.jsQuote != 0 {
+			return "js"
+		}
+	}
+	return "html"
+}
+
+// scan updates the state with the static markup s following the position.
+func (c *escapeContext) scan(s string) {
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch c.state {
+		case stateText:
+			if ch != '<' {
+				continue
+			}
+			if strings.HasPrefix(s[i:], "<!--") {
+				c.state = stateComment
+				i += len("<!--") - 1
+				continue
+			}
+			j := i + 1
+			if j < len(s) && s[j] == '/' {
+				j++
+			}
+			k := j
+			for k < len(s) && isAlphanumeric(s[k]) {
+				k++
+			}
+			if k > j {
+				c.state = stateTag
+				c.tag = strings.ToLower(s[i+1 : k])
+				i = k - 1
+			}
+		case stateComment:
+			if strings.HasPrefix(s[i:], "-->") {
+				c.state = stateText
+				i += len("-->") - 1
+			}
+		case stateTag, stateAfterName:
+			switch {
+			case ch == '>':
+				c.endTag()
+			case ch == '=' && c.state == stateAfterName:
+				c.state = stateBeforeValue
+			case isSpaceByte(ch) || ch == '/':
+			default:
+				c.state = stateAttrName
+				c.attr = string(ch)
+			}
+		case stateAttrName:
+			switch {
+			case ch == '>':
+				c.endTag()
+			case ch == '=':
+				c.state = stateBeforeValue
+			case isSpaceByte(ch):
+				c.state = stateAfterName
+			default:
+				c.attr += string(ch)
+			}
+		case stateBeforeValue:
+			switch {
+			case ch == '>':
+				c.endTag()
+			case ch == '"' || ch == '\'':
+				c.state = stateValue
+				c.quote = ch
+				c.jsQuote, c.jsEscape, c.valueStart = 0, false, true
+			case !isSpaceByte(ch):
+				c.state = stateUnquotedValue
+			}
+		case stateUnquotedValue:
+			if ch == '>' {
+				c.endTag()
+			} else if isSpaceByte(ch) {
+				c.state = stateTag
+			}
+		case stateValue:
+			if ch == c.quote {
+				c.state = stateTag
+				continue
+			}
+			c.valueStart = false
+			if strings.HasPrefix(strings.ToLower(c.attr), "on") {
+				c.scanJS(ch)
+			}
+		case stateScript:
+			if len(s)-i >= len("</script") && strings.ToLower(s[i:i+len("</script")]) == "</script" {
+				c.state = stateTag
+				c.tag = "/script"
+				i += len("</script") - 1
+				continue
+			}
+			c.scanJS(ch)
+		}
+	}
+}
+
+// endTag updates the state at the end of a tag.
+func (c *escapeContext) endTag() {
+	if c.tag == "script" {
+		c.state = stateScript
+		c.jsQuote, c.jsEscape = 0, false
+	} else {
+		c.state = stateText
+	}
+}
+
+// scanJS updates the JavaScript string state with the character ch.
+func (c *escapeContext) scanJS(ch byte) {
+	switch {
+	case c.jsEscape:
+		c.jsEscape = false
+	case c.jsQuote != 0 && ch == '\\':
+		c.jsEscape = true
+	case c.jsQuote != 0:
+		if ch == c.jsQuote {
+			c.jsQuote = 0
+		}
+	case ch == '"' || ch == '\'':
+		c.jsQuote = ch
+	}
+}
+
+// escapers returns the escaping formatters for the actions of src by their
+// positions.
+func escapers(src, ldelim, rdelim string) []string {
+	c := &escapeContext{state: stateText}
+	var names []string
+	last := 0
+	for _, a := range scanActions(src, ldelim, rdelim) {
+		c.scan(src[last:a.start])
+		names = append(names, c.escaper())
+		if isVariable(a.text) || strings.Contains(a.text, "|") {
+			// The action outputs something in the attribute value.
+			c.valueStart = false
+		}
+		last = a.end
+	}
+	return names
+}
+
+// isAlphanumeric returns true if ch is an ASCII letter or digit.
+func isAlphanumeric(ch byte) bool {
+	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || '0' <= ch && ch <= '9'
+}
+
+// isSpaceByte returns true if ch is an ASCII white space character.
+func isSpaceByte(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == '\f'
+}
+
+// expandBlocks replaces the block directives in src, and escapes variables
+// in automatic escaping mode.
+func (p *preprocessor) expandBlocks(src string) (string, os.Error) {
+	var stack []*blockAction
+	ldelim, rdelim := p.m.ldelim, p.m.rdelim
+	escaping, n := escapers(src, ldelim, rdelim), 0
+	autoEscape := func() bool {
+		if len(stack) == 0 {
+			return p.m.autoEscape
+		}
+		return stack[len(stack)-1].autoEscape
+	}
+
+	s, err := p.replaceActions(src, func(text string) (string, bool, os.Error) {
+		escaper := escaping[n]
+		if p.m.outputMode == ModeXML {
+			escaper = "xml"
+		}
+		n++
+		name, arg := directive(text)
+		switch name {
+		case "else":
+			if len(stack) == 0 || arg != "" {
+				return "", false, nil
+			}
+			b := stack[len(stack)-1]
+			if b.elseAction == "" {
+				return "", false, fmt.Errorf("neste: else is not allowed in %s", b.name)
+			}
+			return b.elseAction, true, nil
+		case "end":
+			if len(stack) == 0 || arg != "" {
+				return "", false, nil
+			}
+			b := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			return b.endAction, true, nil
+		case "with":
+			if arg == "" {
+				return "", false, os.NewError("neste: with without a field")
+			}
+			stack = append(stack, &blockAction{
+				name:       name,
+				elseAction: ldelim + ".or" + rdelim,
+				endAction:  ldelim + ".end" + rdelim,
+				autoEscape: autoEscape()})
+			return ldelim + ".section " + arg + rdelim, true, nil
+		case "ifequal", "ifnotequal":
+			fields, literals, err := splitArgs(arg)
+			if err != nil {
+				return "", false, err
+			}
+			if len(fields) != 2 {
+				return "", false, fmt.Errorf("neste: %s needs two arguments", name)
+			}
+			equal := name == "ifequal"
+
+			start := p.call("@", func(w *contextWriter, data ...interface{}) {
+				a := argString(data[0], fields[0], literals[0])
+				b := argString(data[0], fields[1], literals[1])
+				w.beginIf((a == b) == equal)
+			})
+			stack = append(stack, &blockAction{
+				name:       name,
+				elseAction: p.call("@", func(w *contextWriter, data ...interface{}) { w.elseIf() }),
+				endAction:  p.call("@", func(w *contextWriter, data ...interface{}) { w.endIf() }),
+				autoEscape: autoEscape()})
+			return start, true, nil
+		case "autoescape":
+			if arg != "on" && arg != "off" {
+				return "", false, fmt.Errorf("neste: bad autoescape: %s", text)
+			}
+			stack = append(stack, &blockAction{
+				name:       name,
+				autoEscape: arg == "on" && !p.m.text})
+			return "", true, nil
+		}
+
+		if autoEscape() && isVariable(text) && needsEscaping(text) {
+			return ldelim + strings.TrimSpace(text) + "|" + escaper + rdelim, true, nil
+		}
+		return "", false, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(stack) > 0 {
+		return "", fmt.Errorf("neste: unterminated %s", stack[len(stack)-1].name)
+	}
+	return s, nil
+}
+
+// Variables
+//
+// {set name = Field|formatter} sets the template-local variable name to the
+// value of Field, formatted with the optional formatters, during execution.
+// Later variable references to name, like {name} or {name|html}, use the
+// value of the variable instead of the data, if the variable has been set.
+// Otherwise name is looked up in the data of the enclosing sections, like
+// other variables, and in strict mode it is an error if it isn't found.
+// Variables are local to a single execution of the template.
+
+// expandSet replaces the set directives in src and the references to the
+// variables they set. Variables that aren't set are resolved through the
+// cursors of the enclosing sections, like the template package resolves
+// variables, so the sections of templates with set directives record their
+// cursors in the render context.
+func (p *preprocessor) expandSet(src string) (string, os.Error) {
+	actions := scanActions(src, p.m.ldelim, p.m.rdelim)
+	hasSet := false
+	for _, a := range actions {
+		if name, _ := directive(a.text); name == "set" {
+			hasSet = true
+			break
+		}
+	}
+	if !hasSet {
+		return src, nil
+	}
+
+	push := p.call("@", func(w *contextWriter, data ...interface{}) {
+		scope := &w.ctx.scopes[len(w.ctx.scopes)-1]
+		*scope = append(*scope, data[0])
+	})
+	pop := p.call("@", func(w *contextWriter, data ...interface{}) {
+		scope := &w.ctx.scopes[len(w.ctx.scopes)-1]
+		*scope = (*scope)[:len(*scope)-1]
+	})
+
+	var buf bytes.Buffer
+	var sections []bool // Whether the cursor of each open section is pushed
+	vars := make(map[string]bool)
+	last := 0
+	for _, a := range actions {
+		start, end := lineRegion(src, a)
+		name, arg := directive(a.text)
+		switch name {
+		case ".section", ".repeated":
+			sections = append(sections, true)
+			buf.WriteString(src[last:start])
+			buf.WriteString(src[a.start:a.end])
+			buf.WriteString(push)
+			last = end
+			continue
+		case ".alternates", ".or", ".end":
+			if len(sections) == 0 {
+				continue
+			}
+			i := len(sections) - 1
+			buf.WriteString(src[last:start])
+			if sections[i] {
+				buf.WriteString(pop)
+			}
+			buf.WriteString(src[a.start:a.end])
+			switch name {
+			case ".alternates":
+				// Alternates are executed with the cursor of the element.
+				buf.WriteString(push)
+				sections[i] = true
+			case ".or":
+				sections[i] = false
+			case ".end":
+				sections = sections[:i]
+			}
+			last = end
+			continue
+		}
+
+		s, err := p.setAction(a.text, name, arg, vars)
+		if err != nil {
+			return "", err
+		}
+		if s != "" {
+			buf.WriteString(src[last:a.start])
+			buf.WriteString(s)
+			last = a.end
+		}
+	}
+	buf.WriteString(src[last:])
+
+	return buf.String(), nil
+}
+
+// setAction returns the replacement of a set directive, or of a reference
+// to one of the variables in vars, or "" for other actions.
+func (p *preprocessor) setAction(text, name, arg string, vars map[string]bool) (string, os.Error) {
+	if name == "set" {
+		i := strings.Index(arg, "=")
+		if i < 0 {
+			return "", fmt.Errorf("neste: bad set: %s", text)
+		}
+		vname := strings.TrimSpace(arg[:i])
+		field, formatters, err := p.splitFormatters(arg[i+1:])
+		if err != nil {
+			return "", err
+		}
+		if !isIdent(vname) || field == "" {
+			return "", fmt.Errorf("neste: bad set: %s", text)
+		}
+		vars[vname] = true
+
+		return p.call(field, func(w *contextWriter, data ...interface{}) {
+			var buf bytes.Buffer
+			p.format(&buf, formatters, data...)
+			if w.ctx.vars == nil {
+				w.ctx.vars = make(map[string]string)
+			}
+			w.ctx.vars[vname] = buf.String()
+		}), nil
+	}
+
+	if strings.IndexFunc(strings.TrimSpace(text), unicode.IsSpace) >= 0 {
+		return "", nil
+	}
+	vname, formatters, err := p.splitFormatters(text)
+	if err != nil || !vars[vname] {
+		return "", nil
+	}
+
+	m := p.m
+	return p.call("@", func(w *contextWriter, data ...interface{}) {
+		if v, present := w.ctx.vars[vname]; present {
+			p.format(w, formatters, v)
+		} else if v, found := w.ctx.lookup(data[0], vname); found {
+			p.format(w, formatters, v)
+		} else if m.strict {
+			panic(&execError{fmt.Errorf("neste: variable %s is not set", vname)})
+		}
+	}), nil
+}
+
+// Cycles
+//
+// {cycle odd,even} outputs the next of the comma separated values on each
+// iteration of the enclosing repeated section, starting over with the first
+// value whenever the section is executed anew. The values are output as
+// they are, without escaping.
+
+// cycle holds the values of a cycle directive. Its address identifies the
+// position of the cycle in the render context.
+type cycle struct {
+	values []string
+}
+
+// lineRegion returns the region of src occupied by the special action a.
+// The template package drops the white space around special actions alone
+// on their lines, and the newline ending the line. As that no longer works
+// once other actions are put on the line, the region includes them then.
+func lineRegion(src string, a action) (start, end int) {
+	start = a.start
+	for start > 0 && (src[start-1] == ' ' || src[start-1] == '\t' || src[start-1] == '\r') {
+		start--
+	}
+	if start > 0 && src[start-1] != '\n' {
+		return a.start, a.end
+	}
+	for end = a.end; end < len(src); end++ {
+		switch src[end] {
+		case '\n':
+			return start, end + 1
+		case ' ', '\t', '\r':
+		default:
+			return a.start, a.end
+		}
+	}
+	return a.start, a.end
+}
+
+// expandCycles replaces the cycle directives in src. The positions of the
+// cycles in a repeated section are reset by an action inserted before it.
+func (p *preprocessor) expandCycles(src string) (string, os.Error) {
+	var stack []*[]*cycle // Cycles of the open sections, nil if not repeated
+	var buf bytes.Buffer
+	last := 0
+	for _, a := range scanActions(src, p.m.ldelim, p.m.rdelim) {
+		name, arg := directive(a.text)
+		switch name {
+		case ".section":
+			stack = append(stack, nil)
+		case ".repeated":
+			cycles := new([]*cycle)
+			stack = append(stack, cycles)
+			start, end := lineRegion(src, a)
+			buf.WriteString(src[last:start])
+			buf.WriteString(p.call("@", func(w *contextWriter, data ...interface{}) {
+				if w.ctx.cycles == nil {
+					return
+				}
+				for _, c := range *cycles {
+					w.ctx.cycles[c] = 0, false
+				}
+			}))
+			buf.WriteString(src[a.start:a.end])
+			last = end
+		case ".end":
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case "cycle":
+			i := len(stack) - 1
+			for i >= 0 && stack[i] == nil {
+				i--
+			}
+			if i < 0 {
+				return "", os.NewError("neste: cycle outside repeated section")
+			}
+			if arg == "" {
+				return "", os.NewError("neste: cycle without values")
+			}
+			c := &cycle{strings.Split(arg, ",", -1)}
+			for j, v := range c.values {
+				c.values[j] = strings.TrimSpace(v)
+			}
+			*stack[i] = append(*stack[i], c)
+
+			buf.WriteString(src[last:a.start])
+			buf.WriteString(p.call("@", func(w *contextWriter, data ...interface{}) {
+				if w.ctx.cycles == nil {
+					w.ctx.cycles = make(map[*cycle]int)
+				}
+				n := w.ctx.cycles[c]
+				io.WriteString(w, c.values[n%len(c.values)])
+				w.ctx.cycles[c] = n + 1
+			}))
+			last = a.end
+		}
+	}
+	buf.WriteString(src[last:])
+
+	return buf.String(), nil
+}
+
+// Limits
+//
+// {.repeated section Items offset 10 limit 5} repeats the section only for
+// the elements of Items from the offset on, and at most for limit of them.
+// Either of offset and limit may be left out. An offset past the end of
+// Items gives an empty section, for which the or part is executed.
+
+// limitData is the key of the data of a template with limited repeated 
+// sections in the map it is executed with.
+const limitData = "neste_data"
+
+// limitedTemplate is a template with limited repeated sections. It is 
+// executed with a map holding its data, which is wrapped in a repeated 
+// section over the data by wrapLimited. The elements of each limited 
+// section are put in the map by an action right before the section, and 
+// the section repeats over them, finding them in the outermost data like 
+// any variable that isn't in the current data.
+type limitedTemplate struct {
+	*template.Template
+}
+
+// Execute executes the template with the data wrapped in a map.
+func (t limitedTemplate) Execute(wr io.Writer, data interface{}) os.Error {
+	sections := map[string]interface{}{limitData: []interface{}{data}}
+	if w, ok := wr.(*contextWriter); ok {
+		w.ctx.limited = append(w.ctx.limited, sections)
+		defer func() { w.ctx.limited = w.ctx.limited[:len(w.ctx.limited)-1] }()
+	}
+	return t.Template.Execute(wr, sections)
+}
+
+// wrapLimited wraps the source of a limitedTemplate in a repeated section 
+// over its data. The left action is alone on its line, so that it doesn't 
+// change the output.
+func wrapLimited(src, ldelim, rdelim string) string {
+	return ldelim + ".repeated section " + limitData + rdelim + "\n" + src +
+		ldelim + ".end" + rdelim
+}
+
+// parseLimit parses the offset and limit of a repeated section, the limit 
+// being -1 if there is none. It returns "" as the field if the section has 
+// neither.
+func parseLimit(text string) (offset, limit int, field string, err os.Error) {
+	words := strings.Fields(text)
+	if len(words) <= 3 {
+		return 0, -1, "", nil
+	}
+
+	limit = -1
+	for i := 3; i < len(words); i += 2 {
+		n := -1
+		if i+1 < len(words) {
+			n, err = strconv.Atoi(words[i+1])
+		}
+		if n < 0 || err != nil || (words[i] != "offset" && words[i] != "limit") {
+			return 0, -1, "", fmt.Errorf("neste: bad repeated section: %s", text)
+		}
+		if words[i] == "offset" {
+			offset = n
+		} else {
+			limit = n
+		}
+	}
+	return offset, limit, words[2], nil
+}
+
+// sliceLimit returns the elements of the slice or array v from offset on, 
+// at most limit of them unless limit is -1. Other values are returned as 
+// they are, for the template package to report them.
+func sliceLimit(v interface{}, offset, limit int) interface{} {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return v
+	}
+
+	n := rv.Len()
+	if offset > n {
+		offset = n
+	}
+	end := n
+	if limit >= 0 && offset+limit < n {
+		end = offset + limit
+	}
+	elems := make([]interface{}, end-offset)
+	for i := range elems {
+		elems[i] = rv.Index(offset + i).Interface()
+	}
+	return elems
+}
+
+// expandLimits replaces the repeated sections with offsets or limits in src
+// by repeated sections over the limited elements, which are put in the data 
+// map of the template by an action before each section.
+func (p *preprocessor) expandLimits(src string) (string, os.Error) {
+	var buf bytes.Buffer
+	last := 0
+	for _, a := range scanActions(src, p.m.ldelim, p.m.rdelim) {
+		text := strings.TrimSpace(a.text)
+		if name, _ := directive(text); name != ".repeated" {
+			continue
+		}
+		offset, limit, field, err := parseLimit(text)
+		if err != nil {
+			return "", err
+		}
+		if field == "" {
+			continue
+		}
+
+		key := fmt.Sprintf("neste_limit_%d", p.limits)
+		p.limits++
+		start, end := lineRegion(src, a)
+		buf.WriteString(src[last:start])
+		buf.WriteString(p.call(field, func(w *contextWriter, data ...interface{}) {
+			sections := w.ctx.limited[len(w.ctx.limited)-1]
+			sections[key] = sliceLimit(data[0], offset, limit)
+		}))
+		buf.WriteString(p.m.ldelim + ".repeated section " + key + p.m.rdelim)
+		last = end
+	}
+	buf.WriteString(src[last:])
+
+	return buf.String(), nil
+}
+
+// Spaceless
+//
+// {spaceless}...{endspaceless} removes white space between HTML tags in the
+// output of its body, that is, between a > and a following <. White space
+// in text and within tags is left alone. Spaceless regions may be nested.
+
+// spaceBetweenTags matches white space between HTML tags.
+var spaceBetweenTags = regexp.MustCompile(`>[ \t\r\n]+<`)
+
+// expandSpaceless replaces the spaceless directives in src with actions
+// capturing the output of the region and writing it without the white space.
+func (p *preprocessor) expandSpaceless(src string) (string, os.Error) {
+	depth := 0
+	s, err := p.replaceActions(src, func(text string) (string, bool, os.Error) {
+		name, arg := directive(text)
+		if arg != "" {
+			return "", false, nil
+		}
+
+		switch name {
+		case "spaceless":
+			depth++
+			return p.call("@", func(w *contextWriter, data ...interface{}) {
+				w.capture()
+			}), true, nil
+		case "endspaceless":
+			if depth == 0 {
+				return "", false, os.NewError("neste: unexpected endspaceless")
+			}
+			depth--
+			return p.call("@", func(w *contextWriter, data ...interface{}) {
+				buf := w.release()
+				w.Write(spaceBetweenTags.ReplaceAll(buf.Bytes(), []byte("><")))
+			}), true, nil
+		}
+		return "", false, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if depth > 0 {
+		return "", os.NewError("neste: unterminated spaceless")
+	}
+	return s, nil
+}
+
+// Includes
+//
+// {include "name"} renders the template with the given identifier or
+// filename in place, with the current data. The template must have been
+// added to the template manager. {include "name" with Field} renders it with
+// the value of Field instead. Field may be a map key or an exported struct
+// field, or a path of them separated by periods, like User.Address.
+// If Field is not found, the template is rendered with nil data,
+// unless the template manager is in strict mode.
+// Templates in a group include the templates of the group before those
+// outside it. See Group. Partials may be included by their bare names, like
+// {include "nav"}. See Manager.SetPartialsDir.
+
+// include replaces an include directive.
+func (p *preprocessor) include(text string) (string, bool, os.Error) {
+	name, arg := directive(text)
+	if name != "include" {
+		return "", false, nil
+	}
+
+	tname, rest, err := splitQuoted(arg)
+	if err != nil {
+		return "", false, err
+	}
+
+	var field string
+	if rest != "" {
+		with := strings.Fields(rest)
+		if len(with) != 2 || with[0] != "with" {
+			return "", false, fmt.Errorf("neste: bad include: %s", text)
+		}
+		field = with[1]
+	}
+
+	m := p.m
+	return p.call("@", func(w *contextWriter, data ...interface{}) {
+		v := data[0]
+		if field != "" {
+			var found bool
+			v, found = resolvePath(v, field)
+			if !found && m.strict {
+				panic(&execError{fmt.Errorf("neste: include %s: %s not found", tname, field)})
+			}
+		}
+
+		// Templates in the group of the including template come first.
+		cur := w.ctx.chain[len(w.ctx.chain)-1]
+		t, ok := m.lookupIn(m.groupOf(cur.name), tname)
+		if !ok {
+			panic(&execError{fmt.Errorf("neste: include %s: no such template", tname)})
+		}
+		err := t.execute(w, v, w.ctx)
+		if err != nil {
+			panic(&execError{err})
+		}
+	}), true, nil
+}
+
+// Slots
+//
+// {yield name} is replaced by the content of the slot name given to
+// Template.RenderWithSlots. Slot content is written as it is, without any
+// escaping, so it must come from a trusted source, such as the output of
+// other templates. Slots that are not filled are empty, unless the template
+// manager is in strict mode.
+
+// yield replaces a yield directive.
+func (p *preprocessor) yield(text string) (string, bool, os.Error) {
+	name, slot := directive(text)
+	if name != "yield" {
+		return "", false, nil
+	}
+	if slot == "" {
+		return "", false, os.NewError("neste: yield without a slot name")
+	}
+
+	m := p.m
+	return p.call("@", func(w *contextWriter, data ...interface{}) {
+		content, present := w.ctx.slots[slot]
+		if !present && m.strict {
+			panic(&execError{fmt.Errorf("neste: slot %s is not filled", slot)})
+		}
+		io.WriteString(w, content)
+	}), true, nil
+}
+
+// First of
+//
+// {firstof Field1 Field2 "fallback"} outputs the first of its arguments that
+// is not empty, that is, nil, a nil pointer or an empty string. Fields are
+// HTML escaped and quoted strings are output as they are. Nothing is output
+// if all the arguments are empty.
+
+// firstOf replaces a firstof directive.
+func (p *preprocessor) firstOf(text string) (string, bool, os.Error) {
+	name, arg := directive(text)
+	if name != "firstof" {
+		return "", false, nil
+	}
+	if arg == "" {
+		return "", false, os.NewError("neste: firstof without arguments")
+	}
+
+	fields, literals, err := splitArgs(arg)
+	if err != nil {
+		return "", false, err
+	}
+
+	return p.call("@", func(w *contextWriter, data ...interface{}) {
+		for i, field := range fields {
+			if field == "" {
+				if literals[i] != "" {
+					io.WriteString(w, literals[i])
+					return
+				}
+			} else if v, found := resolvePath(data[0], field); found && !isEmpty(v) {
+				template.HTMLFormatter(w, "", v)
+				return
+			}
+		}
+	}), true, nil
+}
+
+// Current time
+//
+// {now layout} outputs the current time formatted with the layout, which is
+// like in time.Time.Format, for example {now 2006}. Without a layout, the
+// date format of the template manager is used. The current time is given
+// by the clock of the template manager.
+
+// now replaces a now directive.
+func (p *preprocessor) now(text string) (string, bool, os.Error) {
+	name, layout := directive(text)
+	if name != "now" {
+		return "", false, nil
+	}
+
+	m := p.m
+	return p.call("@", func(w *contextWriter, data ...interface{}) {
+		l := layout
+		if l == "" {
+			l = m.dateFormat
+		}
+		io.WriteString(w, m.clock().Format(l))
+	}), true, nil
+}
+
+// Translations
+//
+// {trans "text"} outputs the translation of the text in the message catalog
+// of the current locale, or the text itself if there is no translation.
+// Placeholders in the translation or the text, like {name}, are substituted
+// with the data, like in templates. See Manager.LoadCatalog.
+
+// trans replaces a trans directive.
+func (p *preprocessor) trans(text string) (string, bool, os.Error) {
+	name, arg := directive(text)
+	if name != "trans" {
+		return "", false, nil
+	}
+
+	msg, err := unquote(arg)
+	if err != nil {
+		return "", false, err
+	}
+	// The text itself is used when there is no translation.
+	fallback, err := p.m.parseMessage(msg)
+	if err != nil {
+		return "", false, fmt.Errorf("neste: trans %q: %s", msg, err)
+	}
+
+	m := p.m
+	return p.call("@", func(w *contextWriter, data ...interface{}) {
+		locale := w.ctx.locale
+		if locale == "" {
+			locale = m.locale
+		}
+		tt, present := m.catalogs[locale][msg]
+		if !present {
+			tt = fallback
+		}
+		err := tt.Execute(w, data[0])
+		if err != nil {
+			panic(&execError{err})
+		}
+	}), true, nil
+}
+
+// {plural Count "one form" "other form"} outputs the plural form of a
+// message for the count given by the field Count. The forms are selected by
+// the plural rule of the current locale (see Manager.SetPluralRule) from
+// the translations of the message in the plural catalog of the locale, or
+// from the forms of the directive if there is no translation. The message
+// is identified by its first form. Counts that aren't integers are 0. Like
+// with trans, placeholders in the forms are substituted with the data.
+// See Manager.LoadPluralCatalog.
+
+// plural replaces a plural directive.
+func (p *preprocessor) plural(text string) (string, bool, os.Error) {
+	name, arg := directive(text)
+	if name != "plural" {
+		return "", false, nil
+	}
+
+	fields, literals, err := splitArgs(arg)
+	if err != nil {
+		return "", false, err
+	}
+	if len(fields) < 3 || fields[0] == "" {
+		return "", false, fmt.Errorf("neste: plural needs a count and forms: %s", text)
+	}
+	field := fields[0]
+	// The forms themselves are used when there is no translation.
+	fallback := make([]*template.Template, len(literals)-1)
+	for i, form := range literals[1:] {
+		if fields[i+1] != "" {
+			return "", false, fmt.Errorf("neste: plural form %s is not quoted", fields[i+1])
+		}
+		fallback[i], err = p.m.parseMessage(form)
+		if err != nil {
+			return "", false, fmt.Errorf("neste: plural %q: %s", form, err)
+		}
+	}
+	msg := literals[1]
+
+	m := p.m
+	return p.call("@", func(w *contextWriter, data ...interface{}) {
+		locale := w.ctx.locale
+		if locale == "" {
+			locale = m.locale
+		}
+		forms, present := m.plurals[locale][msg]
+		if !present {
+			forms = fallback
+		}
+
+		n, _ := strconv.Atoi(argString(data[0], field, ""))
+		i := m.pluralRule(locale)(n)
+		if i >= len(forms) {
+			i = len(forms) - 1
+		} else if i < 0 {
+			i = 0
+		}
+		err := forms[i].Execute(w, data[0])
+		if err != nil {
+			panic(&execError{err})
+		}
+	}), true, nil
+}
+
+// Template inheritance
+//
+// A template may begin with {extends "base.html"}, in which case it is
+// merged into the named parent template file. The parent declares
+// overridable regions with {block name}default{endblock} and the child
+// replaces them with blocks of the same name. Content of the child outside
+// its blocks is ignored. Parents may extend other templates in turn.
+
+// block represents a {block name}...{endblock} region in template source.
+type block struct {
+	name      string
+	start     int // Offset of the block action
+	bodyStart int // Offset just past the block action
+	bodyEnd   int // Offset of the endblock action
+	end       int // Offset just past the endblock action
+}
+
+// parseBlocks returns the outermost blocks of src.
+func (m *Manager) parseBlocks(src string) (blocks []*block, err os.Error) {
+	var stack []*block
+	for _, a := range scanActions(src, m.ldelim, m.rdelim) {
+		name, arg := directive(a.text)
+		switch name {
+		case "block":
+			if arg == "" {
+				return nil, os.NewError("neste: block without a name")
+			}
+			stack = append(stack, &block{
+				name:      arg,
+				start:     a.start,
+				bodyStart: a.end})
+		case "endblock":
+			if len(stack) == 0 {
+				return nil, os.NewError("neste: unexpected endblock")
+			}
+			b := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			b.bodyEnd = a.start
+			b.end = a.end
+			if len(stack) == 0 {
+				blocks = append(blocks, b)
+			}
+		}
+	}
+
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("neste: unterminated block %s", stack[len(stack)-1].name)
+	}
+	return
+}
+
+// collectBlocks adds the bodies of all blocks in src, including nested ones,
+// to bodies unless a body with the same name is already present.
+func (m *Manager) collectBlocks(src string, bodies map[string]string) os.Error {
+	blocks, err := m.parseBlocks(src)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range blocks {
+		body := src[b.bodyStart:b.bodyEnd]
+		if _, present := bodies[b.name]; !present {
+			bodies[b.name] = body
+		}
+		err = m.collectBlocks(body, bodies)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fillBlocks replaces the blocks of src with their overriding bodies,
+// or with their own default bodies if they are not overridden.
+// Active holds the names of the blocks currently being filled.
+func (m *Manager) fillBlocks(src string, overrides map[string]string, active map[string]bool) (string, os.Error) {
+	blocks, err := m.parseBlocks(src)
+	if err != nil {
+		return "", err
+	}
+	if len(blocks) == 0 {
+		return src, nil
+	}
+
+	var buf bytes.Buffer
+	last := 0
+	for _, b := range blocks {
+		buf.WriteString(src[last:b.start])
+		last = b.end
+
+		body, present := overrides[b.name]
+		if !present || active[b.name] {
+			body = src[b.bodyStart:b.bodyEnd]
+		}
+
+		active[b.name] = true
+		body, err = m.fillBlocks(body, overrides, active)
+		active[b.name] = false, false
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString(body)
+	}
+	buf.WriteString(src[last:])
+
+	return buf.String(), nil
+}
+
+// extendsName returns the name of the parent template if src begins with
+// an extends directive.
+func (m *Manager) extendsName(src string) (parent string, err os.Error) {
+	actions := scanActions(src, m.ldelim, m.rdelim)
+	if len(actions) == 0 {
+		return
+	}
+
+	name, arg := directive(actions[0].text)
+	if name != "extends" {
+		return
+	}
+	if strings.TrimSpace(src[:actions[0].start]) != "" {
+		return "", os.NewError("neste: extends must be the first thing in a template")
+	}
+	return unquote(arg)
+}
+
+// resolveFile returns the filename of the template file with the given name,
+// which is looked up in the group of the template first, and in the partials
+// last.
+func (p *preprocessor) resolveFile(name string) string {
+	if p.group != "" {
+		filename := p.group + "/" + name
+		if _, err := os.Stat(path.Join(p.m.baseDir, filename)); err == nil {
+			return filename
+		}
+	}
+	if t, present := p.m.lookupPartial(name); present {
+		if _, err := os.Stat(path.Join(p.m.baseDir, name)); err != nil {
+			return t.name
+		}
+	}
+	return name
+}
+
+// expandExtends merges src with the templates it extends and
+// returns the resulting source.
+func (p *preprocessor) expandExtends(src string) (string, os.Error) {
+	m := p.m
+	overrides := make(map[string]string)
+	var chain []string               // Names of the parents in the chain
+	var overridden [][]string        // Names of the outermost blocks of each child
+	var declared []map[string]string // Block bodies of each parent
+
+	for {
+		parent, err := m.extendsName(src)
+		if err != nil {
+			return "", err
+		}
+
+		bodies := make(map[string]string)
+		err = m.collectBlocks(src, bodies)
+		if err != nil {
+			return "", err
+		}
+		if len(chain) > 0 {
+			declared = append(declared, bodies)
+		}
+		if parent == "" {
+			break
+		}
+		parent = p.resolveFile(parent)
+		err = checkFilename(parent)
+		if err != nil {
+			return "", err
+		}
+
+		for _, name := range chain {
+			if name == parent {
+				return "", fmt.Errorf("neste: template %q extends itself", parent)
+			}
+		}
+		chain = append(chain, parent)
+
+		blocks, _ := m.parseBlocks(src)
+		names := make([]string, len(blocks))
+		for i, b := range blocks {
+			names[i] = b.name
+		}
+		overridden = append(overridden, names)
+
+		// Blocks of the most derived template take precedence.
+		for k, v := range bodies {
+			if _, present := overrides[k]; !present {
+				overrides[k] = v
+			}
+		}
+
+		ppath := path.Join(m.baseDir, parent)
+		b, err := m.readFile(ppath)
+		if err != nil {
+			return "", fmt.Errorf("neste: can't load parent template %q: %s", parent, err)
+		}
+		p.deps[ppath] = getMtime(ppath)
+		// The templates defined in the parent are left out, like when 
+		// it is parsed itself.
+		src, _, err = m.splitDefines(string(b))
+		if err != nil {
+			return "", err
+		}
+		src, err = p.expandVerbatim(src)
+		if err != nil {
+			return "", err
+		}
+		src = m.trimSpace(src)
+	}
+
+	// Each block overridden by a child must be declared by one of its parents.
+	for i, names := range overridden {
+		for _, name := range names {
+			found := false
+			for _, bodies := range declared[i:] {
+				if _, found = bodies[name]; found {
+					break
+				}
+			}
+			if !found {
+				return "", fmt.Errorf("neste: block %s is not declared by %q or its parents",
+					name, chain[i])
+			}
+		}
+	}
+
+	return m.fillBlocks(src, overrides, make(map[string]bool))
+}
@@ -0,0 +1,914 @@
+package neste
+
+import (
+	. "launchpad.net/gocheck"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// writeTemplates writes the given template files to a new temporary
+// directory and returns its path.
+func writeTemplates(c *C, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "neste")
+	c.Assert(err, IsNil)
+
+	for name, src := range files {
+		fpath := path.Join(dir, name)
+		err = os.MkdirAll(path.Dir(fpath), 0755)
+		c.Assert(err, IsNil)
+		err = ioutil.WriteFile(fpath, []byte(src), 0644)
+		c.Assert(err, IsNil)
+	}
+	return dir
+}
+
+func (s *S) TestExtends(c *C) {
+	expected :=
+`<html>
+<head><title>Page</title></head>
+<body>
+<div>Page body.</div>
+<p>Footer</p>
+</body>
+</html>
+`
+	tm := New(baseDir, nil)
+	t, err := tm.AddFile("extends/page.html")
+	c.Assert(err, IsNil)
+
+	output, err := t.Render(map[string]string{"footer": "Footer"})
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, expected)
+}
+
+func (s *S) TestExtendsChain(c *C) {
+	expected :=
+`<html>
+<head><title>Article</title></head>
+<body>
+<div><article>Text</article></div>
+<p>Footer</p>
+</body>
+</html>
+`
+	tm := New(baseDir, nil)
+	t, err := tm.AddFile("extends/article.html")
+	c.Assert(err, IsNil)
+
+	output, err := t.Render(map[string]string{"footer": "Footer", "text": "Text"})
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, expected)
+}
+
+func (s *S) TestExtendsMissingParent(c *C) {
+	tm := New(baseDir, nil)
+	_, err := tm.Add(`{extends "extends/missing.html"}`, "missing")
+	c.Assert(err, ErrorMatches, `.*"extends/missing.html".*`)
+	c.Assert(tm.Get("missing"), IsNil)
+}
+
+func (s *S) TestExtendsUnknownBlock(c *C) {
+	tm := New(baseDir, nil)
+	_, err := tm.Add(`{extends "extends/base.html"}{block sidebar}x{endblock}`, "unknown")
+	c.Assert(err, ErrorMatches, ".*block sidebar.*")
+}
+
+func (s *S) TestExtendsReload(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"base.html":  "base: {block content}{endblock}\n",
+		"child.html": `{extends "base.html"}{block content}child{endblock}`})
+	defer os.RemoveAll(dir)
+
+	tm := New(dir, nil)
+	t := tm.MustAddFile("child.html")
+
+	output, err := t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "base: child\n")
+
+	// Modify the base template and reload the child.
+	bPath := path.Join(dir, "base.html")
+	ioutil.WriteFile(bPath, []byte("modified base: {block content}{endblock}\n"), 0644)
+	// Attempt to force mtime to change.
+	err = os.Chtimes(bPath, time.Nanoseconds(), time.Nanoseconds())
+	c.Assert(err, IsNil)
+
+	err = t.Reload()
+	c.Assert(err, IsNil)
+
+	output, err = t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "modified base: child\n")
+}
+
+type includeAddress struct {
+	City string
+}
+
+type includeUser struct {
+	Name    string
+	Address *includeAddress
+}
+
+func (s *S) TestInclude(c *C) {
+	tm := New(baseDir, nil)
+	tm.MustAdd("<b>{Name}</b>", "card")
+	tm.MustAdd("[{title}]", "title")
+	t := tm.MustAdd(`{include "title"} {include "card" with User}`, "page")
+
+	// Map data
+	output, err := t.Render(map[string]interface{}{
+		"title": "Users",
+		"User":  map[string]string{"Name": "Map"}})
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "[Users] <b>Map</b>")
+
+	// Struct data
+	tStruct := tm.MustAdd(`{include "card" with User}`, "struct")
+	output, err = tStruct.Render(struct{ User includeUser }{includeUser{Name: "Struct"}})
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "<b>Struct</b>")
+}
+
+func (s *S) TestIncludePath(c *C) {
+	tm := New(baseDir, nil)
+	tm.MustAdd("{City}", "city")
+	t := tm.MustAdd(`{.section User}{Name}: {include "city" with Address}{.end} `+
+		`{include "city" with User.Address}`, "path")
+
+	user := &includeUser{"Ann", &includeAddress{"Helsinki"}}
+	output, err := t.Render(map[string]interface{}{"User": user})
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "Ann: Helsinki Helsinki")
+}
+
+func (s *S) TestIncludeMissing(c *C) {
+	tm := New(baseDir, nil)
+	tm.MustAdd("partial", "partial")
+	t := tm.MustAdd(`{include "partial" with User.Phone}`, "missing")
+	data := map[string]interface{}{"User": includeUser{Name: "Ann"}}
+
+	output, err := t.Render(data)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "partial")
+
+	tm.SetStrict(true)
+	_, err = t.Render(data)
+	c.Assert(err, ErrorMatches, ".*User.Phone not found")
+
+	// Included templates must exist.
+	t = tm.MustAdd(`{include "nonexistent"}`, "nonexistent")
+	_, err = t.Render(data)
+	c.Assert(err, ErrorMatches, ".*nonexistent: no such template")
+}
+
+func (s *S) TestIncludeCycle(c *C) {
+	tm := New(baseDir, nil)
+	tm.MustAdd(`{include "b"}`, "a")
+	tm.MustAdd(`{include "a"}`, "b")
+
+	_, err := tm.Get("a").Render(map[string]string{})
+	c.Assert(err, ErrorMatches, ".*template cycle: a -> b -> a")
+}
+
+func (s *S) TestRenderWithSlots(c *C) {
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("<title>{yield title}</title>{yield body}<p>{yield footer}</p>|{name}", "slots")
+
+	slots := map[string]string{
+		"title": "Slots & more",
+		"body":  "<div>Body</div>"}
+
+	output, err := t.RenderWithSlots(map[string]string{"name": "neste"}, slots)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "<title>Slots & more</title><div>Body</div><p></p>|neste")
+
+	tm.SetStrict(true)
+	_, err = t.RenderWithSlots(map[string]string{"name": "neste"}, slots)
+	c.Assert(err, ErrorMatches, ".*slot footer is not filled")
+}
+
+func (s *S) TestMacro(c *C) {
+	src := `{macro field(label, name)}<label>{label}</label><input name="{name}">{endmacro}` +
+		`{field("Email", "email")}
+{field("Name & \"nick\"", "{name}")}
+{value}`
+	expected := `<label>Email</label><input name="email">
+<label>Name &amp; &quot;nick&quot;</label><input name="{name}">
+macros`
+
+	tm := New(baseDir, nil)
+	t, err := tm.Add(src, "macro")
+	c.Assert(err, IsNil)
+
+	output, err := t.Render(map[string]string{"value": "macros"})
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, expected)
+}
+
+func (s *S) TestMacroNested(c *C) {
+	src := `{macro field(label, name)}<input name="{name}" title="{label}">{endmacro}` +
+		`{macro row(name)}<tr>{field("Row", name)}</tr>{endmacro}` +
+		`{row("first")}{row("second")}`
+
+	tm := New(baseDir, nil)
+	t, err := tm.Add(src, "nested")
+	c.Assert(err, IsNil)
+
+	output, err := t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, `<tr><input name="first" title="Row"></tr>`+
+		`<tr><input name="second" title="Row"></tr>`)
+}
+
+func (s *S) TestMacroErrors(c *C) {
+	tm := New(baseDir, nil)
+
+	_, err := tm.Add(`{macro field(label, name)}{label}{endmacro}{field("Email")}`, "arity")
+	c.Assert(err, ErrorMatches, "neste: macro field takes 2 arguments, got 1")
+
+	_, err = tm.Add(`{undefined("x")}`, "undefined")
+	c.Assert(err, ErrorMatches, "neste: undefined macro undefined")
+
+	_, err = tm.Add(`{macro loop()}{loop()}{endmacro}{loop()}`, "loop")
+	c.Assert(err, ErrorMatches, "neste: macro loop: calls nested too deeply")
+}
+
+func (s *S) TestTrimSpace(c *C) {
+	tm := New(baseDir, nil)
+	data := map[string]interface{}{
+		"items": []string{"a", "b"},
+		"title": "Trim"}
+
+	// Repeated section
+	t := tm.MustAdd("<ul>\n  {-.repeated section items-}\n  <li>{@}</li>\n  {-.end-}\n</ul>\n", "repeated")
+	output, err := t.Render(data)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "<ul><li>a</li><li>b</li></ul>\n")
+
+	// Include
+	tm.MustAdd("\n<h1>{title}</h1>\n", "include")
+	t = tm.MustAdd("<div>\n\t{- include \"include\" -}\n</div>", "includer")
+	output, err = t.Render(data)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "<div>\n<h1>Trim</h1>\n</div>")
+
+	// Actions at the start and the end of the source
+	t = tm.MustAdd("{title-}  \n\n{.section title}:{.end}\n\n {-title}", "ends")
+	output, err = t.Render(data)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "Trim:Trim")
+
+	// Only marked white space is removed.
+	t = tm.MustAdd(" {title} \n {-title} \n", "unmarked")
+	output, err = t.Render(data)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, " TrimTrim \n")
+}
+
+type withData struct {
+	User    *includeUser
+	Missing *includeUser
+}
+
+func (s *S) TestWith(c *C) {
+	tm := New(baseDir, nil)
+	data := withData{User: &includeUser{"Ann", &includeAddress{"Helsinki"}}}
+
+	// Present field
+	t := tm.MustAdd("{with User}<b>{Name}</b>{end}", "present")
+	output, err := t.Render(data)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "<b>Ann</b>")
+
+	// Nil field with else
+	t = tm.MustAdd("{with Missing}{Name}{else}nobody{end}", "nil")
+	output, err = t.Render(data)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "nobody")
+
+	// Dotted path
+	t = tm.MustAdd("{with User.Address}{City}{end}", "path")
+	output, err = t.Render(data)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "Helsinki")
+
+	// Nested with blocks
+	t = tm.MustAdd("{with User}{Name}: {with Address}{City}{else}-{end}.{end}", "nested")
+	output, err = t.Render(data)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "Ann: Helsinki.")
+
+	// Map data
+	output, err = t.Render(map[string]interface{}{
+		"User": map[string]interface{}{"Name": "Bob"}})
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "Bob: -.")
+
+	_, err = tm.Add("{with User}{Name}", "unterminated")
+	c.Assert(err, ErrorMatches, "neste: unterminated with")
+}
+
+func (s *S) TestSet(c *C) {
+	tm := New(baseDir, nil)
+	t := tm.MustAdd(`{set cls = kind|capFirst}<p class="{cls}">{cls|html}</p>`, "set")
+
+	output, err := t.Render(map[string]string{"kind": "note<>"})
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, `<p class="Note<>">Note&lt;&gt;</p>`)
+
+	// Variables don't leak between executions.
+	output, err = t.Render(map[string]string{"kind": "warning"})
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, `<p class="Warning">Warning</p>`)
+}
+
+func (s *S) TestSetShadowing(c *C) {
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("{title} {set title = other}{title} "+
+		"{.section empty}{set empty = other}{.end}{empty}", "shadow")
+
+	output, err := t.Render(map[string]string{"title": "data", "other": "var", "empty": ""})
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "data var ")
+
+	_, err = tm.Add("{set x = y|unknown}", "unknown")
+	c.Assert(err, ErrorMatches, `neste: unknown formatter: "unknown"`)
+}
+
+func (s *S) TestSetScope(c *C) {
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("{.section none}{set title = none}{.end}"+
+		"{.repeated section items}{.section tags}{title}{.end}{.alternates with}|{.end}\n"+
+		"{.section user}\n"+
+		"  {title}\n"+
+		"{.end}\n", "scope")
+
+	data := map[string]interface{}{
+		"none": "",
+		"items": []map[string]interface{}{
+			{"title": "a", "tags": []string{"x"}},
+			{"title": "b", "tags": []string{"y"}}},
+		"user":  map[string]string{"name": "x"},
+		"title": "root"}
+	output, err := t.Render(data)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "a|b\n  root\n")
+
+	// Variables that aren't set or found are errors in strict mode.
+	t = tm.MustAdd("{.section none}{set v = title}{.end}<{v}>", "unset")
+	output, err = t.Render(data)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "<>")
+
+	tm.SetStrict(true)
+	_, err = t.Render(data)
+	c.Assert(err, ErrorMatches, "neste: variable v is not set")
+}
+
+func (s *S) TestCycle(c *C) {
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("{.repeated section items}{cycle a, b, c}{@} {.end}", "cycle")
+
+	data := map[string]interface{}{"items": []int{1, 2, 3, 4, 5}}
+	output, err := t.Render(data)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "a1 b2 c3 a4 b5 ")
+
+	// Every execution of the section starts from the first value.
+	t = tm.MustAdd("{.repeated section items}{cycle a,b,c}{.end}|"+
+		"{.repeated section items}{cycle a,b,c}{.end}", "twice")
+	output, err = t.Render(data)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "abcab|abcab")
+
+	_, err = tm.Add("{cycle a,b}", "outside")
+	c.Assert(err, ErrorMatches, "neste: cycle outside repeated section")
+}
+
+func (s *S) TestCycleIndependent(c *C) {
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("<table>\n"+
+		"{.repeated section rows}\n"+
+		"<tr class=\"{cycle odd,even}\"><td class=\"{cycle x,y,z}\">{@}</td></tr>\n"+
+		"{.end}\n"+
+		"</table>\n", "table")
+
+	output, err := t.Render(map[string]interface{}{"rows": []string{"1", "2", "3", "4"}})
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "<table>\n"+
+		"<tr class=\"odd\"><td class=\"x\">1</td></tr>\n"+
+		"<tr class=\"even\"><td class=\"y\">2</td></tr>\n"+
+		"<tr class=\"odd\"><td class=\"z\">3</td></tr>\n"+
+		"<tr class=\"even\"><td class=\"x\">4</td></tr>\n"+
+		"</table>\n")
+}
+
+func (s *S) TestRepeatedLimit(c *C) {
+	tm := New(baseDir, nil)
+	data := map[string]interface{}{
+		"items":  []int{1, 2, 3, 4, 5},
+		"groups": [][]int{{1, 2}, {3, 4, 5}},
+		"title":  "x"}
+	tests := []struct{ src, output string }{
+		{"{.repeated section items limit 3}{@}{.end}", "123"},
+		{"{.repeated section items limit 5}{@}{.end}", "12345"},
+		{"{.repeated section items limit 10}{@}{.end}", "12345"},
+		{"{.repeated section items limit 0}{@}{.end}", ""},
+		{"{.repeated section items offset 2}{@}{.end}", "345"},
+		{"{.repeated section items offset 1 limit 2}{@}{.end}", "23"},
+		{"{.repeated section items offset 10 limit 5}{@}{.end}", ""},
+		{"{.repeated section items offset 1 limit 3}{@}{.alternates with}, {.end}", "2, 3, 4"},
+		{"{.repeated section items limit 2}{@}{.or}none{.end}", "12"},
+		{"{.repeated section items offset 5}{@}{.or}none{.end}", "none"},
+		{"{.repeated section items limit 2}{cycle a,b}{@}{.end}", "a1b2"},
+		{"{.repeated section items limit 2}{@}{title}{.end}", "1x2x"},
+		{"{.repeated section groups}{.repeated section @ offset 1}{@}{.end};{.end}", "2;45;"},
+	}
+	for i, test := range tests {
+		output, err := tm.MustAdd(test.src, "limit"+string('a'+i)).Render(data)
+		c.Assert(err, IsNil)
+		c.Check(output, Equals, test.output)
+	}
+
+	// Alone on their lines, the section actions keep their lines out of
+	// the output.
+	t := tm.MustAdd("<ul>\n"+
+		"{.repeated section items offset 3 limit 1}\n"+
+		"<li>{@}</li>\n"+
+		"{.end}\n"+
+		"</ul>\n", "lines")
+	output, err := t.Render(data)
+	c.Assert(err, IsNil)
+	c.Assert(output, Equals, "<ul>\n<li>4</li>\n</ul>\n")
+
+	_, err = tm.Add("{.repeated section items limit x}{.end}", "bad")
+	c.Assert(err, ErrorMatches, "neste: bad repeated section: .*")
+	_, err = tm.Add("{.repeated section items first 2}{.end}", "bad")
+	c.Assert(err, ErrorMatches, "neste: bad repeated section: .*")
+}
+
+func (s *S) TestFirstOf(c *C) {
+	tm := New(baseDir, nil)
+	t := tm.MustAdd(`{firstof DisplayName UserName Email "<anonymous>"}`, "firstof")
+
+	// First present
+	output, err := t.Render(map[string]interface{}{"DisplayName": "Ann & Bob", "UserName": "ann"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "Ann &amp; Bob")
+
+	// Only last present
+	output, err = t.Render(map[string]interface{}{"DisplayName": "", "UserName": nil, "Email": "ann@example.com"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "ann@example.com")
+
+	// All empty with a literal fallback
+	output, err = t.Render(map[string]interface{}{"DisplayName": ""})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "<anonymous>")
+
+	// All empty without a literal fallback
+	t = tm.MustAdd("[{firstof DisplayName UserName}]", "nofallback")
+	output, err = t.Render(map[string]interface{}{"DisplayName": "", "UserName": (*string)(nil)})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "[]")
+
+	_, err = tm.Add("{firstof}", "noargs")
+	c.Assert(err, ErrorMatches, "neste: firstof without arguments")
+}
+
+func (s *S) TestNow(c *C) {
+	tm := New(baseDir, nil)
+	tm.SetClock(func() *time.Time {
+		return &time.Time{Year: 2011, Month: 5, Day: 3, Hour: 14, Minute: 30, Zone: "UTC"}
+	})
+
+	t := tm.MustAdd("© {now 2006} Example Corp, rendered {now Jan 2 15:04}", "layout")
+	output, err := t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "© 2011 Example Corp, rendered May 3 14:30")
+
+	t = tm.MustAdd("{now}", "default")
+	output, err = t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "2011-05-03")
+
+	tm.SetDateFormat("02.01.2006")
+	output, err = t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "03.05.2011")
+}
+
+func (s *S) TestTrans(c *C) {
+	tm := New(baseDir, nil)
+	err := tm.LoadCatalog("fi", map[string]string{
+		"Welcome back": "Tervetuloa takaisin",
+		"Hello {name}": "Hei {name}"})
+	c.Assert(err, IsNil)
+	err = tm.LoadCatalog("sv", map[string]string{
+		"Welcome back": "Välkommen tillbaka",
+		"Hello {name}": "Hej {name}"})
+	c.Assert(err, IsNil)
+
+	t := tm.MustAdd(`<h1>{trans "Welcome back"}</h1><p>{trans "Hello {name}"}</p>`+
+		`<p>{trans "Goodbye {name}"}</p>`, "trans")
+	data := map[string]string{"name": "Ann"}
+
+	// Default locale without a catalog
+	output, err := t.Render(data)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "<h1>Welcome back</h1><p>Hello Ann</p><p>Goodbye Ann</p>")
+
+	tm.SetLocale("fi")
+	output, err = t.Render(data)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "<h1>Tervetuloa takaisin</h1><p>Hei Ann</p><p>Goodbye Ann</p>")
+
+	// Per-render override
+	var buf bytes.Buffer
+	err = t.ExecuteLocalized(&buf, data, "sv")
+	c.Assert(err, IsNil)
+	c.Check(buf.String(), Equals, "<h1>Välkommen tillbaka</h1><p>Hej Ann</p><p>Goodbye Ann</p>")
+
+	err = tm.LoadCatalog("de", map[string]string{"Welcome back": "{.section x}"})
+	c.Assert(err, NotNil)
+}
+
+func (s *S) TestPlural(c *C) {
+	tm := New(baseDir, nil)
+	err := tm.LoadPluralCatalog("ru", map[string][]string{
+		"{n} file": {"{n} файл", "{n} файла", "{n} файлов"}})
+	c.Assert(err, IsNil)
+	err = tm.LoadPluralCatalog("pl_PL", map[string][]string{
+		"{n} file": {"{n} plik", "{n} pliki", "{n} plików"}})
+	c.Assert(err, IsNil)
+
+	t := tm.MustAdd(`{plural n "{n} file" "{n} files"}`, "plural")
+	tests := []struct {
+		locale string
+		n      int
+		output string
+	}{
+		{"", 1, "1 file"},
+		{"", 3, "3 files"},
+		{"", 21, "21 files"},
+		{"ru", 1, "1 файл"},
+		{"ru", 3, "3 файла"},
+		{"ru", 5, "5 файлов"},
+		{"ru", 21, "21 файл"},
+		{"pl_PL", 1, "1 plik"},
+		{"pl_PL", 3, "3 pliki"},
+		{"pl_PL", 5, "5 plików"},
+		{"pl_PL", 21, "21 plików"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		err = t.ExecuteLocalized(&buf, map[string]int{"n": test.n}, test.locale)
+		c.Assert(err, IsNil)
+		c.Check(buf.String(), Equals, test.output)
+	}
+
+	// Custom rules, with the forms of the directive as the fallback
+	tm.SetPluralRule("fr", func(n int) int {
+		if n <= 1 {
+			return 0
+		}
+		return 1
+	})
+	tm.SetLocale("fr")
+	output, err := t.Render(map[string]int{"n": 0})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "0 file")
+
+	// Indexes past the forms select the last form.
+	tm.SetLocale("uk")
+	output, err = t.Render(map[string]int{"n": 5})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "5 files")
+
+	_, err = tm.Add(`{plural n "{n} file"}`, "oneform")
+	c.Check(err, ErrorMatches, "neste: plural needs a count and forms: .*")
+	_, err = tm.Add(`{plural n "{n} file" files}`, "unquoted")
+	c.Check(err, ErrorMatches, "neste: plural form files is not quoted")
+	err = tm.LoadPluralCatalog("de", map[string][]string{"{n} file": {"{.section x}"}})
+	c.Check(err, NotNil)
+}
+
+func (s *S) TestSpaceless(c *C) {
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("<div>\n"+
+		"{spaceless}\n"+
+		"<ul>\n"+
+		"  <li> <a href=\"{url}\" title=\"a  b\">Read  more</a> </li>\n"+
+		"{.repeated section items}\n"+
+		"  <li>{@} and {@}</li>\n"+
+		"{.end}\n"+
+		"</ul>\n"+
+		"{endspaceless}\n"+
+		"</div>\n", "spaceless")
+
+	output, err := t.Render(map[string]interface{}{"url": "/x", "items": []string{"a", "b"}})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "<div>\n\n"+
+		"<ul><li><a href=\"/x\" title=\"a  b\">Read  more</a></li><li>a and a</li><li>b and b</li></ul>\n\n"+
+		"</div>\n")
+
+	// Nested regions
+	t = tm.MustAdd("{spaceless}<p> <b> x </b> {spaceless}<i> y </i> <i> z </i>{endspaceless} </p>{endspaceless}", "nested")
+	output, err = t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "<p><b> x </b><i> y </i><i> z </i></p>")
+
+	_, err = tm.Add("{spaceless}<p> </p>", "unterminated")
+	c.Assert(err, ErrorMatches, "neste: unterminated spaceless")
+
+	_, err = tm.Add("<p> </p>{endspaceless}", "unexpected")
+	c.Assert(err, ErrorMatches, "neste: unexpected endspaceless")
+}
+
+func (s *S) TestVerbatim(c *C) {
+	snippet := "<script type=\"text/x-template\">\n" +
+		"  {name} {{ user.name }} {-x-} {.section a}{.end} {include \"x\"}\n" +
+		"  { } {{ }} }{\n" +
+		"</script>"
+
+	tm := New(baseDir, nil)
+	t := tm.MustAdd("<p>{title}</p>\n{verbatim}"+snippet+"{endverbatim}\n<p>{title}</p>", "verbatim")
+	output, err := t.Render(map[string]string{"title": "Title"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "<p>Title</p>\n"+snippet+"\n<p>Title</p>")
+
+	tm.SetDelims("<<", ">>")
+	t = tm.MustAdd("<<title>> <<verbatim>>"+snippet+" <<title>><<endverbatim>> <<title>>", "delims")
+	output, err = t.Render(map[string]string{"title": "Title"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "Title "+snippet+" <<title>> Title")
+
+	_, err = tm.Add("<<verbatim>>{x}", "unterminated")
+	c.Assert(err, ErrorMatches, "neste: unterminated verbatim")
+}
+
+func (s *S) TestAutoEscape(c *C) {
+	data := map[string]interface{}{
+		"title": "<b>Tom & Jerry</b>",
+		"items": []string{"<i>", "\"q\""},
+		"user":  map[string]string{"name": "<ann>"}}
+
+	tm := New(baseDir, nil)
+	tm.SetAutoEscape(true)
+
+	// Unannotated fields are escaped.
+	t := tm.MustAdd("{title} { title }{.repeated section items} {@}{.end} {user.name}", "plain")
+	output, err := t.Render(data)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "&lt;b&gt;Tom &amp; Jerry&lt;/b&gt; &lt;b&gt;Tom &amp; Jerry&lt;/b&gt; "+
+		"&lt;i&gt; &#34;q&#34; &lt;ann&gt;")
+
+	// Output is the same as with manual escaping.
+	manual := New(baseDir, nil).MustAdd("{title|html} {title|html}{.repeated section items} {@|html}{.end} "+
+		"{user.name|html}", "manual")
+	expected, err := manual.Render(data)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, expected)
+
+	// Escaping formatters and safe are left alone.
+	t = tm.MustAdd(`{title|safe} {title|e} <a title="{title|attr}"> {title|safe|capFirst}`, "formatted")
+	output, err = t.Render(data)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, `<b>Tom & Jerry</b> &lt;b&gt;Tom &amp; Jerry&lt;/b&gt; `+
+		`<a title="&lt;b&gt;Tom &amp; Jerry&lt;/b&gt;"> <b>Tom & Jerry</b>`)
+
+	// The output of other formatters is escaped.
+	t = tm.MustAdd(`{user.name|capFirst} {title|html|htmlunescape}`, "unsafe")
+	output, err = t.Render(data)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, `&lt;ann&gt; &lt;b&gt;Tom &amp; Jerry&lt;/b&gt;`)
+
+	// Blocks turn escaping off and on.
+	t = tm.MustAdd("{autoescape off}{title}{with user} {name}{autoescape on} {name}{end}{end}{end} {title}",
+		"blocks")
+	output, err = t.Render(data)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "<b>Tom & Jerry</b> <ann> &lt;ann&gt; &lt;b&gt;Tom &amp; Jerry&lt;/b&gt;")
+
+	// Custom delimiters and set variables
+	tm.SetDelims("<<", ">>")
+	t = tm.MustAdd("<<set x = title>><<x>> {title}", "delims")
+	output, err = t.Render(data)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "&lt;b&gt;Tom &amp; Jerry&lt;/b&gt; {title}")
+
+	_, err = tm.Add("<<autoescape maybe>><<end>>", "bad")
+	c.Assert(err, ErrorMatches, "neste: bad autoescape: autoescape maybe")
+}
+
+func (s *S) TestAutoEscapeContexts(c *C) {
+	data := map[string]interface{}{
+		"link":  "javascript:alert(1)",
+		"path":  "/a?b=1&c=\"2\"",
+		"name":  "'); alert(1); ('<b>",
+		"count": "<1>"}
+
+	tm := New(baseDir, nil)
+	tm.SetAutoEscape(true)
+
+	tests := []struct{ src, output string }{
+		// URL attributes reject dangerous schemes.
+		{`<a href="{link}">{link}</a>`, `<a href="#">javascript:alert(1)</a>`},
+		{`<a href="{path}">`, `<a href="/a?b=1&amp;c=&#34;2&#34;">`},
+		{`<a href='/users/{link}'>`, `<a href='/users/javascript:alert(1)'>`},
+		{`<p title="{name}">`, `<p title="&#39;); alert(1); (&#39;&lt;b&gt;">`},
+		// Event handlers
+		{`<button onclick="greet('{name}')">{name}</button>`,
+			`<button onclick="greet('\x27); alert(1); (\x27\x3cb\x3e')">` +
+				`&#39;); alert(1); (&#39;&lt;b&gt;</button>`},
+		// Scripts, with variables outside of strings HTML escaped
+		{`<script>var name = "{name}", n = {count};</script><p>{count}</p>`,
+			`<script>var name = "\x27); alert(1); (\x27\x3cb\x3e", n = &lt;1&gt;;</script>` +
+				`<p>&lt;1&gt;</p>`},
+		// Body text and ambiguous positions
+		{`<!-- <a href="{link}"> --><p {count}>{name}</p>`,
+			`<!-- <a href="javascript:alert(1)"> --><p &lt;1&gt;>&#39;); alert(1); (&#39;&lt;b&gt;</p>`},
+	}
+
+	for i, test := range tests {
+		t := tm.MustAdd(test.src, "context"+string('a'+i))
+		output, err := t.Render(data)
+		c.Assert(err, IsNil)
+		c.Check(output, Equals, test.output)
+	}
+}
+
+func (s *S) TestXMLMode(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"sitemap.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+{.repeated section urls}
+<url><loc>{loc}</loc><lastmod>{lastmod}</lastmod><!-- {note|safe} --></url>
+{.end}
+</urlset>
+`})
+	defer os.RemoveAll(dir)
+	data := map[string]interface{}{"urls": []map[string]string{
+		{"loc": "http://example.com/?a=1&b=<2>", "lastmod": "2011-05-03", "note": "safe"},
+		{"loc": "http://example.com/\"it's\"", "lastmod": "2011\x01-05\x1f-03\ufffe", "note": "also safe"},
+	}}
+
+	tm := New(dir, nil)
+	tm.SetAutoEscape(true)
+	tm.SetOutputMode(ModeXML)
+	t, err := tm.AddFile("sitemap.xml")
+	c.Assert(err, IsNil)
+
+	output, err := t.Render(data)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+<url><loc>http://example.com/?a=1&amp;b=&lt;2&gt;</loc><lastmod>2011-05-03</lastmod><!-- safe --></url>
+<url><loc>http://example.com/&quot;it&apos;s&quot;</loc><lastmod>2011-05-03</lastmod><!-- also safe --></url>
+</urlset>
+`)
+	c.Check(ValidateXML(output), IsNil)
+
+	// Without escaping, the output is not well-formed.
+	output, err = New(dir, nil).MustAddFile("sitemap.xml").Render(data)
+	c.Assert(err, IsNil)
+	c.Check(ValidateXML(output), NotNil)
+}
+
+func (s *S) TestDefine(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"rows.html": `{define "row"}<tr><td>{name}</td></tr>{enddefine}` +
+			`{define "empty"}<tr><td>No rows</td></tr>{enddefine}` +
+			`<table>{.repeated section rows}{include "rows.html#row"}` +
+			`{.or}{include "rows.html#empty"}{.end}</table>`})
+	defer os.RemoveAll(dir)
+
+	tm := New(dir, nil)
+	tm.SetReloading(true)
+	t := tm.MustAddFile("rows.html")
+	c.Check(tm.AllFilenames(), DeepEquals, []string{"rows.html", "rows.html#empty", "rows.html#row"})
+
+	data := map[string]interface{}{"rows": []map[string]string{{"name": "a"}, {"name": "b"}}}
+	output, err := t.Render(data)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "<table><tr><td>a</td></tr><tr><td>b</td></tr></table>")
+
+	output, err = t.Render(map[string]interface{}{"rows": []string{}})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "<table><tr><td>No rows</td></tr></table>")
+
+	row := tm.GetFile("rows.html#row")
+	c.Assert(row, NotNil)
+	output, err = row.Render(map[string]string{"name": "c"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "<tr><td>c</td></tr>")
+
+	output, err = tm.GetFile("rows.html#empty").Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "<tr><td>No rows</td></tr>")
+
+	// Reloading updates the defined templates.
+	fpath := path.Join(dir, "rows.html")
+	err = ioutil.WriteFile(fpath, []byte(`{define "row"}<tr><th>{name}</th></tr>{enddefine}rows`), 0644)
+	c.Assert(err, IsNil)
+	later := time.Nanoseconds() + 10e9
+	err = os.Chtimes(fpath, later, later)
+	c.Assert(err, IsNil)
+
+	output, err = row.Render(map[string]string{"name": "c"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "<tr><th>c</th></tr>")
+	c.Check(tm.GetFile("rows.html#row"), Equals, row)
+	c.Check(tm.GetFile("rows.html#empty"), IsNil)
+
+	output, err = t.Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "rows")
+
+	c.Check(tm.HealthCheck(), IsNil)
+	c.Check(tm.ReadinessCheck(), IsNil)
+	c.Check(tm.TotalSize(), Equals, int64(len(t.source)))
+
+	tm.RemoveFile("rows.html")
+	c.Check(len(tm.AllFilenames()), Equals, 0)
+}
+
+func (s *S) TestDefineVerbatimAndExtends(c *C) {
+	dir := writeTemplates(c, map[string]string{
+		"docs.html":  `{verbatim}{define "x"}{x}{enddefine}{endverbatim}`,
+		"base.html":  `{define "row"}<li>{name}</li>{enddefine}<ul>{block items}{endblock}</ul>`,
+		"child.html": `{extends "base.html"}{block items}child{endblock}`})
+	defer os.RemoveAll(dir)
+
+	// Defines in verbatim regions are output as they are.
+	tm := New(dir, nil)
+	c.Assert(tm.AddDir(""), IsNil)
+	c.Check(tm.AllFilenames(), DeepEquals, []string{"base.html", "base.html#row", "child.html", "docs.html"})
+	output, err := tm.MustGetFile("docs.html").Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, `{define "x"}{x}{enddefine}`)
+
+	// Defines of parents are left out of their children.
+	output, err = tm.MustGetFile("child.html").Render(nil)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "<ul>child</ul>")
+}
+
+func (s *S) TestDefineErrors(c *C) {
+	tm := New(baseDir, nil)
+	_, err := tm.Add(`{define "a"}x`, "unterminated")
+	c.Check(err, ErrorMatches, "neste: unterminated define a")
+
+	_, err = tm.Add(`{define "a"}{define "b"}{enddefine}{enddefine}`, "nested")
+	c.Check(err, ErrorMatches, `neste: define "b" in define a`)
+
+	_, err = tm.Add(`{define "a"}{enddefine}{define "a"}{enddefine}`, "twice")
+	c.Check(err, ErrorMatches, "neste: a is defined twice")
+}
+
+func (s *S) TestIfEqual(c *C) {
+	tm := New(baseDir, nil)
+	data := map[string]interface{}{
+		"current": "about",
+		"page":    "about",
+		"other":   "home",
+		"count":   1}
+
+	// Equal
+	t := tm.MustAdd("{ifequal current page}yes{else}no{end}", "equal")
+	output, err := t.Render(data)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "yes")
+
+	// Unequal with else
+	t = tm.MustAdd("{ifequal current other}yes{else}no{end} {ifnotequal current other}differ{end}", "unequal")
+	output, err = t.Render(data)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "no differ")
+
+	// Literals, formatted values and missing fields
+	t = tm.MustAdd(`{ifequal current "about"}a{end}{ifequal count "1"}b{end}`+
+		`{ifequal missing ""}c{end}{ifnotequal "x" "x"}d{else}e{end}`, "literal")
+	output, err = t.Render(data)
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "abce")
+
+	// Inside a repeated section, and nested
+	t = tm.MustAdd("<ul>{.repeated section nav}"+
+		`<li{ifequal Name "about"} class="current"{end}>{Name}`+
+		`{ifequal @ "x"}{else}{ifnotequal Name "home"}!{end}{end}</li>`+
+		"{.end}</ul>", "repeated")
+	output, err = t.Render(map[string]interface{}{
+		"nav": []map[string]string{{"Name": "home"}, {"Name": "about"}, {"Name": "blog"}}})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, `<ul><li>home</li><li class="current">about!</li><li>blog!</li></ul>`)
+
+	_, err = tm.Add("{ifequal a}{end}", "bad")
+	c.Check(err, ErrorMatches, "neste: ifequal needs two arguments")
+	_, err = tm.Add("{ifequal a b}", "unterminated")
+	c.Check(err, ErrorMatches, "neste: unterminated ifequal")
+}
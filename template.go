@@ -3,42 +3,149 @@
 package neste
 
 import (
-	"template"
+	"fmt"
 	"os"
 	"bytes"
 	"io"
-	"path"
+	"strings"
+	"time"
 )
 
 type templateFileInfo struct {
 	filename  string
-	mtime     int64 // Modified time
+	path      string           // Path of the template file
+	mtime     int64            // Modified time
+	parsed    int64            // Time of parsing in nanoseconds
+	checked   int64            // Time of the last check for modifications in nanoseconds
+	deps      map[string]int64 // Modified times of extended templates
 	mustParse bool
 }
 
-// Template is a type for holding a *template.Template and other information.
+// modified returns true if the template file or any of the files it 
+// depends on has been modified since they were parsed.
+func (fi *templateFileInfo) modified(path string) bool {
+	if getMtime(path) > fi.mtime {
+		return true
+	}
+
+	for p, mtime := range fi.deps {
+		if getMtime(p) > mtime {
+			return true
+		}
+	}
+	return false
+}
+
+// expired returns true if the template file was parsed longer than 
+// duration nanoseconds ago. Templates never expire with a zero duration.
+func (fi *templateFileInfo) expired(duration int64) bool {
+	return duration > 0 && time.Nanoseconds()-fi.parsed > duration
+}
+
+// Template is a type for holding a parsed template and other information.
 type Template struct {
-	m     *Manager
-	cache *template.Template
-	fi    *templateFileInfo // Used only for template files
+	m       *Manager
+	name    string // Identifier or filename of the template
+	source  string // Template source before preprocessing
+	cache   Executer
+	fi      *templateFileInfo    // Used only for template files
+	parent  *Template            // Template file defining the template, if any
+	defines map[string]*Template // Templates defined in the template file by name
+	partial string               // Bare name if the template is a partial
+	email   *emailParts          // Parts for RenderEmail, nil if there is no header
+}
+
+// emailParts holds the subject and body of an email template.
+type emailParts struct {
+	subject *Template
+	body    *Template
+	err     os.Error // Error parsing the parts, returned by RenderEmail
+}
+
+// Nested is a type for pairing a template with its own data.
+// See Execute.
+type Nested struct {
+	T    *Template
+	Data interface{}
 }
 
 // Execute applies a parsed template to the specified data object, 
 // generating output to wr. If the template is a template file and the 
 // template's template manager has reloading mode enabled, 
 // then this method will attempt to reparse the template file if its modified 
-// time has changed.
-// If any errors occur, err will be non-nil.
+// time has changed. The template file is also reparsed if it has expired 
+// (see SetCacheDuration).
+// If data is a map[string]interface{}, any *Template and Nested values in it 
+// are rendered first and replaced by their output. *Template values are 
+// rendered with nil data and Nested values with their own data.
+// If any errors occur, err will be non-nil. This includes a template 
+// being nested in itself, directly or through other templates.
+// Strings output by variables with the default formatter and by neste's 
+// directives, such as slot content, are written with wr's WriteString 
+// method if it has one, saving a copy.
 func (t *Template) Execute(wr io.Writer, data interface{}) (err os.Error) {
-	if t.fi != nil && t.m.reloading {
+	return t.execute(wr, data, new(renderContext))
+}
+
+// ExecuteFresh is like Execute, but reparses the template file first if 
+// its modified time has changed, whether the template manager has reloading 
+// mode enabled or not. It can be used to make sure that a single execution 
+// sees the latest version of a template file, for example for previewing 
+// changes on a production server.
+func (t *Template) ExecuteFresh(wr io.Writer, data interface{}) (err os.Error) {
+	if t.fi != nil || t.parent != nil {
 		err = t.Reload()
 		if err != nil {
 			return
 		}
 	}
+	return t.Execute(wr, data)
+}
+
+// execute is like Execute, but takes the render context of the 
+// top-level execution.
+func (t *Template) execute(wr io.Writer, data interface{}, ctx *renderContext) (err os.Error) {
+	// Pass the render context to directives through the writer.
+	cw, ok := wr.(*contextWriter)
+	if !ok || cw.ctx != ctx {
+		cw = &contextWriter{Writer: wr, ctx: ctx}
+	}
+
+	if t.m.traceBegin != nil || t.m.traceEnd != nil {
+		defer t.trace(cw)(&err)
+	}
+
+	err = ctx.enter(t)
+	if err != nil {
+		return
+	}
+	defer ctx.leave()
+	defer catchError(&err)
+
+	// In lazy reloading mode, only the templates executed at the top level 
+	// are reloaded.
+	reloading, strategy := t.m.reloadMode()
+	if (t.fi != nil || t.parent != nil) && (reloading || t.m.cacheDuration > 0) &&
+		(strategy != ReloadLazy || len(ctx.chain) == 1) && t.checkDue() {
+		err = t.Reload()
+		if err != nil {
+			return
+		}
+	}
+
+	data, err = t.renderNested(data, ctx)
+	if err != nil {
+		return
+	}
+
+	// The data is the outermost cursor of the template for set directives.
+	ctx.scopes = append(ctx.scopes, []interface{}{data})
+	defer func() { ctx.scopes = ctx.scopes[:len(ctx.scopes)-1] }()
 
+	t.m.mu.RLock()
 	tt := t.cache
-	err = tt.Execute(wr, data)
+	t.m.mu.RUnlock()
+	err = tt.Execute(cw, data)
 	if err != nil {
 		return
 	}
@@ -46,27 +153,179 @@ func (t *Template) Execute(wr io.Writer, data interface{}) (err os.Error) {
 	return
 }
 
+// checkDue returns true if the template file is due to be checked for 
+// modifications when executed, and records the time of the check. 
+// See SetMinReloadInterval.
+func (t *Template) checkDue() bool {
+	if t.parent != nil {
+		return t.parent.checkDue()
+	}
+	if t.m.minReloadInterval <= 0 {
+		return true
+	}
+
+	// Most executions aren't due, and only take the read lock.
+	now := time.Nanoseconds()
+	t.m.mu.RLock()
+	due := now-t.fi.checked >= t.m.minReloadInterval
+	t.m.mu.RUnlock()
+	if !due {
+		return false
+	}
+
+	// Only one of the executions finding the file due records the check.
+	t.m.mu.Lock()
+	defer t.m.mu.Unlock()
+	if now-t.fi.checked < t.m.minReloadInterval {
+		return false
+	}
+	t.fi.checked = now
+	return true
+}
+
+// trace calls the begin trace hook of the template manager for executing 
+// the template into w, and returns a function calling the end hook with the 
+// error of the execution.
+func (t *Template) trace(w *contextWriter) func(*os.Error) {
+	var token interface{}
+	if t.m.traceBegin != nil {
+		token = t.m.traceBegin(t.name)
+	}
+	start, written := time.Nanoseconds(), w.written
+
+	return func(err *os.Error) {
+		if t.m.traceEnd != nil {
+			t.m.traceEnd(t.name, token, *err, w.written-written, time.Nanoseconds()-start)
+		}
+	}
+}
+
+// renderNested returns a copy of data with all nested templates replaced by 
+// their rendered output. Data is returned as is if it has no nested templates.
+func (t *Template) renderNested(data interface{}, ctx *renderContext) (interface{}, os.Error) {
+	dmap, ok := data.(map[string]interface{})
+	if !ok {
+		return data, nil
+	}
+
+	var rendered map[string]interface{}
+	for k, v := range dmap {
+		var n Nested
+		switch v := v.(type) {
+		case *Template:
+			n.T = v
+		case Nested:
+			n = v
+		default:
+			continue
+		}
+
+		var buf bytes.Buffer
+		err := n.T.execute(&buf, n.Data, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("neste: %s: nested template %s: %s", t.name, n.T.name, err)
+		}
+
+		if rendered == nil {
+			rendered = make(map[string]interface{}, len(dmap))
+			for k, v := range dmap {
+				rendered[k] = v
+			}
+		}
+		rendered[k] = buf.String()
+	}
+
+	if rendered == nil {
+		return data, nil
+	}
+	return rendered, nil
+}
+
+// ExecuteLocalized is like Execute, but translates the {trans "text"} 
+// directives of the template, and the templates it includes, to the given 
+// locale instead of the default locale of the template manager.
+func (t *Template) ExecuteLocalized(wr io.Writer, data interface{}, locale string) os.Error {
+	return t.execute(wr, data, &renderContext{locale: locale})
+}
+
+// IsStale returns true if the template's associated template file, or any 
+// template it extends, has been modified since it was parsed, that is, 
+// if Reload would reparse it. The template isn't reloaded.
+// Templates added from strings are never stale.
+func (t *Template) IsStale() bool {
+	if t.parent != nil {
+		return t.parent.IsStale()
+	}
+	if t.fi == nil {
+		return false
+	}
+
+	t.m.mu.RLock()
+	defer t.m.mu.RUnlock()
+	return t.fi.modified(t.fi.path)
+}
+
 // Reload rereads and reparses the template's associated template file
-// if its modified time has changed since initial loading.
+// if its modified time, or the modified time of any template it extends, 
+// has changed since initial loading.
 // Calling this method is unnecessary when reloading mode is enabled,
 // unless the file's modified time is erroneous.
+// The templates defined in a template file are reloaded with it, and 
+// reloading a defined template reloads the file defining it.
+// Reading the file is retried up to three times, after 1, 2 and 4 
+// milliseconds, if it fails with EINTR or EBUSY.
 // If any errors occur, err will be non-nil.
 func (t *Template) Reload() (err os.Error) {
-	filename := t.fi.filename
-	path := path.Join(t.m.baseDir, filename)
-	oldMtime := t.fi.mtime
-	curMtime := getMtime(path)
+	if t.parent != nil {
+		return t.parent.Reload()
+	}
+	filename, path := t.fi.filename, t.fi.path
 
-	if curMtime > oldMtime {
+	t.m.mu.RLock()
+	modified := t.fi.modified(path) || t.fi.expired(t.m.cacheDuration)
+	t.m.mu.RUnlock()
+
+	if modified {
 		// Template has changed.
 		// Reparse the template file.
-		t.cache, err = t.m.parsett(path, t.fi.mustParse)
+		var tt Executer
+		var src string
+		var deps map[string]int64
+		// Reading the file is retried if it is interrupted.
+		err = retry(func() (err os.Error) {
+			tt, src, deps, err = t.m.parsett(filename, path, false)
+			return
+		})
+		if err != nil {
+			t.m.logf(LogError, "neste: reloading %s failed: %s", filename, err)
+			if t.fi.mustParse {
+				panic(err)
+			}
+			return err
+		}
+		var defines map[string]*Template
+		defines, err = t.m.parseDefines(src, filename)
 		if err != nil {
+			err = t.m.fileError("parse", filename, path, err)
+			t.m.logf(LogError, "neste: reloading %s failed: %s", filename, err)
+			if t.fi.mustParse {
+				panic(err)
+			}
 			return err
 		}
+		email := t.m.parseEmail(filename, src)
+		t.m.mu.Lock()
+		t.cache = tt
+		t.source = src
+		t.email = email
+		t.m.setDefines(t, defines)
 		
-		// Update modified time
+		// Update modified times
 		t.fi.mtime = getMtime(path)
+		t.fi.parsed = time.Nanoseconds()
+		t.fi.deps = deps
+		t.m.mu.Unlock()
+		t.m.logf(LogInfo, "neste: reloaded %s", filename)
 	}
 
 	return
@@ -86,3 +345,131 @@ func (t *Template) Render(data interface{}) (s string, err os.Error) {
 	return
 }
 
+// RenderEmail renders an email template with the given data, returning 
+// the subject and body of the email separately. Email templates may start 
+// with a header that holds the subject, like
+//
+//	Subject: Welcome, {name}!
+//
+//	Hello {name},
+//	...
+//
+// The header ends at the first blank line, and the rest of the template is 
+// the body. Other lines in the header are ignored. Lines may end with CRLF. 
+// A header without a blank line after it is an error. The rendered subject 
+// is cut to its first line. Without a header, the subject is empty and the 
+// whole template is the body. The header is parsed when the template is 
+// added or reloaded.
+// If any errors occur, subject and body will be empty and err will be non-nil.
+func (t *Template) RenderEmail(data interface{}) (subject, body string, err os.Error) {
+	if reloading, _ := t.m.reloadMode(); (t.fi != nil || t.parent != nil) && reloading {
+		err = t.Reload()
+		if err != nil {
+			return
+		}
+	}
+
+	t.m.mu.RLock()
+	e := t.email
+	t.m.mu.RUnlock()
+	if e == nil {
+		body, err = t.Render(data)
+		return
+	}
+	if e.err != nil {
+		return "", "", e.err
+	}
+
+	subject, err = e.subject.Render(data)
+	if err != nil {
+		return "", "", err
+	}
+	if i := strings.IndexAny(subject, "\r\n"); i >= 0 {
+		subject = subject[:i]
+	}
+	subject = strings.TrimSpace(subject)
+
+	body, err = e.body.Render(data)
+	if err != nil {
+		return "", "", err
+	}
+	return
+}
+
+// RenderWithSlots is like Render, but fills the {yield name} slots of 
+// the template, and the templates it includes, with the given content.
+// The content is not escaped in any way.
+// Unfilled slots are left empty, unless the template manager is in 
+// strict mode, in which case they cause an error.
+func (t *Template) RenderWithSlots(data interface{}, slots map[string]string) (s string,
+err os.Error) {
+	buf := new(bytes.Buffer)
+	err = t.execute(buf, data, &renderContext{slots: slots})
+	if err != nil {
+		return
+	}
+
+	s = string(buf.Bytes())
+	return
+}
+
+// Size returns the size of the template's source in bytes.
+// It can be used as a rough estimate of the memory used by the template.
+func (t *Template) Size() int {
+	t.m.mu.RLock()
+	defer t.m.mu.RUnlock()
+	return len(t.source)
+}
+
+// modTime returns the latest modified time in nanoseconds of the template 
+// file and the templates it extends, or 0 if the template is not a file.
+// The caller holds the lock of the template manager.
+func (t *Template) modTime() int64 {
+	if t.parent != nil {
+		return t.parent.modTime()
+	}
+	if t.fi == nil {
+		return 0
+	}
+
+	mtime := t.fi.mtime
+	for _, depMtime := range t.fi.deps {
+		if depMtime > mtime {
+			mtime = depMtime
+		}
+	}
+	return mtime
+}
+
+// parseEmail parses the subject and body of the email template with the 
+// given name and source, or returns nil if the template has no header. 
+// See RenderEmail.
+func (m *Manager) parseEmail(name, src string) *emailParts {
+	if !strings.HasPrefix(src, "Subject:") {
+		return nil
+	}
+
+	src = strings.Replace(src, "\r\n", "\n", -1)
+	i := strings.Index(src, "\n\n")
+	if i < 0 {
+		return &emailParts{err: fmt.Errorf("neste: %s: no blank line after the email header", name)}
+	}
+	header, bodySrc := src[:i], src[i+2:]
+	subjectSrc := header[len("Subject:"):]
+	if i := strings.Index(subjectSrc, "\n"); i >= 0 {
+		subjectSrc = subjectSrc[:i]
+	}
+
+	subjectTT, err := m.parseSource(subjectSrc, name, make(map[string]int64))
+	if err != nil {
+		return &emailParts{err: err}
+	}
+	bodyTT, err := m.parseSource(bodySrc, name, make(map[string]int64))
+	if err != nil {
+		return &emailParts{err: err}
+	}
+
+	return &emailParts{
+		subject: &Template{m: m, name: name, source: subjectSrc, cache: subjectTT},
+		body:    &Template{m: m, name: name, source: bodySrc, cache: bodyTT}}
+}